@@ -2,74 +2,179 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/archekb/gipam/pkg/admin"
+	"github.com/archekb/gipam/pkg/cli"
+	"github.com/archekb/gipam/pkg/cluster"
 	"github.com/archekb/gipam/pkg/config"
+	"github.com/archekb/gipam/pkg/docker"
 	"github.com/archekb/gipam/pkg/gipam"
 	"github.com/archekb/gipam/pkg/leaser"
+	"github.com/archekb/gipam/pkg/metrics"
+	"github.com/archekb/gipam/pkg/remote"
 
 	"github.com/docker/go-plugins-helpers/ipam"
+	"github.com/hashicorp/raft"
 )
 
 func init() {
 }
 
 func main() {
+	// operator subcommands act on lease file or admin API of running driver
+	if len(os.Args) > 1 && cli.IsCommand(os.Args[1]) {
+		err := cli.Run(os.Args[1:], os.Stdout)
+		if err == flag.ErrHelp {
+			return
+		}
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	// 'gipam server' hosts leasers behind API for drivers of many hosts
+	serverMode := len(os.Args) > 1 && os.Args[1] == "server"
+	if serverMode {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	cnf, err := config.New()
 	if err != nil {
 		config.Help()
 		log.Fatalln("Config Error:", err)
 	}
 
-	// make new Backup to file struct
-	lsrBackup, err := leaser.NewBackup(cnf.Lease.File)
-	if err != nil {
-		log.Fatalln("Lease Backup and Restore state from file error:", err)
+	if cnf.Lease.MigrateFrom != "" {
+		migrate(cnf)
+		return
 	}
 
-	// try restore previous state from file
-	lsr, err := lsrBackup.Restore()
-	if lsr == nil {
-		log.Println("Can't Restore state from file, because", err)
+	ctxBackuper, cancelBackuper := context.WithCancel(context.Background())
+	defer cancelBackuper()
 
-		// creates new leaser if can't restore
-		lsr, err = leaser.New(cnf.Lease.IPv6, cnf.Lease.IPv4, cnf.Lease.IPv6AB, cnf.Lease.IPv4AB)
-		if err != nil {
-			log.Fatalln("Create Leaser Instance Error:", err)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+
+	if cnf.Server.Admin != "" && (cnf.Server.Remote != "" || cnf.Cluster.ID != "") {
+		log.Println("Admin API is available only with local leasers, it is disabled")
+	}
+
+	if cnf.Docker.Reconcile != 0 && (serverMode || cnf.Server.Remote != "" || cnf.Cluster.ID != "") {
+		log.Println("Reconciliation with Docker is available only for driver with local leasers, it is disabled")
+	}
+
+	// driver of remote server has no own state, only plugin calls are measured
+	if cnf.Server.Remote != "" {
+		m := metrics.New(nil)
+		startMetrics(cnf, m)
+		runDriver(cnf, remoteSpaces(cnf), m, stop)
+		return
+	}
+
+	// leasers are replicated by cluster, followers redirect to leader API
+	if cnf.Cluster.ID != "" {
+		c := newCluster(cnf)
+		defer c.Shutdown()
+
+		api := startAPI(cnf, c.Spaces())
+		defer api.Shutdown(context.Background())
+
+		if serverMode {
+			<-stop
+			log.Println("Stop GIPAM cluster node")
+			return
 		}
+
+		m := metrics.New(nil)
+		startMetrics(cnf, m)
+		runDriver(cnf, c.Spaces(), m, stop)
+		return
 	}
 
-	// run every 30 seconds save
-	ctxBackuper, cancelBackuper := context.WithCancel(context.Background())
-	go lsrBackup.Saver(ctxBackuper, lsr)
-	defer cancelBackuper()
+	// one leaser for every address space
+	spaces := map[string]gipam.LeaserInterface{}
+	leasers := map[string]admin.Leaser{}
+	rl := &reloader{cnf: cnf, leasers: map[string]*leaser.Leaser{}}
+	inspectors := map[string]metrics.Inspector{}
+	m := metrics.New(inspectors)
+	for _, s := range cnf.AddressSpaces() {
+		lsr, store := newLeaser(cnf, s, !serverMode, stop)
+		store = m.Store(s.Name, store)
+
+		// run every 30 seconds save
+		go leaser.Saver(ctxBackuper, store, lsr)
+
+		// finally save state
+		defer func() {
+			if err := store.Save(lsr); err != nil {
+				log.Println(err)
+			}
+			store.Close()
+		}()
+
+		spaces[s.Name] = lsr
+		leasers[s.Name] = lsr
+		rl.leasers[s.Name] = lsr
+		inspectors[s.Name] = lsr
+	}
+
+	// SIGHUP re-reads configuration and applies safe changes of main pools
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			rl.logReload()
+		}
+	}()
+
+	startMetrics(cnf, m)
 
-	// finally save state
-	defer lsrBackup.Save(lsr)
+	if cnf.Server.Admin != "" {
+		srv := startAdmin(cnf, leasers, rl.reload)
+		defer srv.Shutdown(context.Background())
+	}
 
-	// Notify current state
-	if lsr.V6Pool != nil {
-		log.Printf("IPv6 address pool: %s / Len (%d): %d", lsr.V6Pool, lsr.V6AllocateBlock, lsr.V6Pool.SubnetCount(lsr.V6AllocateBlock))
+	if serverMode {
+		runServer(cnf, spaces, stop)
+		return
 	}
 
-	if lsr.V4Pool != nil {
-		log.Printf("IPv4 address pool: %s / Len (%d): %d", lsr.V4Pool, lsr.V4AllocateBlock, lsr.V4Pool.SubnetCount(lsr.V4AllocateBlock))
+	if cnf.Docker.Reconcile != 0 {
+		startReconciler(ctxBackuper, cnf, leasers)
+	}
+
+	runDriver(cnf, spaces, m, stop)
+}
+
+// runDriver - serve Docker IPAM driver until stop, calls of driver are measured by m
+func runDriver(cnf *config.Config, spaces map[string]gipam.LeaserInterface, m *metrics.Metrics, stop chan os.Signal) {
+	global := cnf.Space.Global
+	if global == "" {
+		global = cnf.Space.Local
 	}
 
 	// new GIpam
-	g, err := gipam.New(lsr)
+	g, err := gipam.NewSpaces(cnf.Space.Local, global, spaces)
 	if err != nil {
 		log.Fatalln("Create GIPAM Instance Error:", err)
 	}
 
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
-
 	go func() {
-		h := ipam.NewHandler(g)
+		h := ipam.NewHandler(m.Instrument(g))
 		if cnf.Server.Address == "" {
 			log.Println("Start UNIX socket GIPAM driver...")
 			log.Println(h.ServeUnix("gipam", 755))
@@ -82,3 +187,441 @@ func main() {
 	<-stop
 	log.Println("Stop GIPAM driver")
 }
+
+// runServer - serve leaser API until stop
+func runServer(cnf *config.Config, spaces map[string]gipam.LeaserInterface, stop chan os.Signal) {
+	srv := startAPI(cnf, spaces)
+
+	<-stop
+	srv.Shutdown(context.Background())
+	log.Println("Stop GIPAM leaser API")
+}
+
+// startAPI - start leaser API in background
+func startAPI(cnf *config.Config, spaces map[string]gipam.LeaserInterface) *http.Server {
+	if cnf.Server.API == "" {
+		log.Fatalln("Server mode Error: API address (-api) is empty")
+	}
+
+	if cnf.Server.Token == "" {
+		if !cnf.Server.Insecure {
+			log.Fatalln("Server mode Error: leaser API token (-token) is empty, set it or start with -insecure to serve API without authentication")
+		}
+
+		log.Println("Leaser API is available without authentication (-insecure)")
+	}
+
+	srv := &http.Server{Addr: cnf.Server.API, Handler: remote.NewServer(spaces, cnf.Server.Token)}
+	go func() {
+		var err error
+		if cnf.Server.TLSCert != "" {
+			log.Println("Start HTTPS [" + cnf.Server.API + "] GIPAM leaser API...")
+			err = srv.ListenAndServeTLS(cnf.Server.TLSCert, cnf.Server.TLSKey)
+		} else {
+			log.Println("Start HTTP [" + cnf.Server.API + "] GIPAM leaser API...")
+			err = srv.ListenAndServe()
+		}
+
+		if err != http.ErrServerClosed {
+			log.Fatalln("Leaser API Error:", err)
+		}
+	}()
+
+	return srv
+}
+
+// startAdmin - start admin API in background
+func startAdmin(cnf *config.Config, leasers map[string]admin.Leaser, reload admin.ReloadFunc) *http.Server {
+	l, err := admin.Listen(cnf.Server.Admin)
+	if err != nil {
+		log.Fatalln("Admin API Error:", err)
+	}
+
+	if cnf.Server.AdminToken == "" && !admin.IsSocket(cnf.Server.Admin) {
+		log.Println("Admin API token (-admin-token) is empty, admin API is available without authentication")
+	}
+
+	as := admin.NewServer(leasers, cnf.Server.AdminToken)
+	as.Reload = reload
+
+	srv := &http.Server{Handler: as}
+	go func() {
+		log.Println("Start [" + cnf.Server.Admin + "] GIPAM admin API...")
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			log.Fatalln("Admin API Error:", err)
+		}
+	}()
+
+	return srv
+}
+
+// startReconciler - reconcile leasers with Docker in background
+func startReconciler(ctx context.Context, cnf *config.Config, leasers map[string]admin.Leaser) {
+	c, err := docker.NewClient(cnf.Docker.Host)
+	if err != nil {
+		log.Fatalln("Docker API Error:", err)
+	}
+
+	spaces := map[string]docker.Leaser{}
+	for name, lsr := range leasers {
+		spaces[name] = lsr
+	}
+
+	log.Println("Start reconciliation with Docker [" + cnf.Docker.Host + "] every " + cnf.Docker.Reconcile.String())
+	go docker.NewReconciler(c, cnf.Docker.Driver, spaces, cnf.Docker.Fix).Run(ctx, cnf.Docker.Reconcile)
+}
+
+// startMetrics - serve Prometheus /metrics in background if metrics address is set
+func startMetrics(cnf *config.Config, m *metrics.Metrics) {
+	if cnf.Server.Metrics == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+	go func() {
+		log.Println("Start HTTP [" + cnf.Server.Metrics + "] GIPAM metrics...")
+		log.Fatalln("Metrics Error:", http.ListenAndServe(cnf.Server.Metrics, mux))
+	}()
+}
+
+// newCluster - start cluster node of leasers of all address spaces
+func newCluster(cnf *config.Config) *cluster.Cluster {
+	self, _ := cnf.Cluster.Peers.Find(cnf.Cluster.ID)
+	bind := cnf.Cluster.Bind
+	if bind == "" {
+		bind = self.Raft
+	}
+
+	advertise, err := net.ResolveTCPAddr("tcp", self.Raft)
+	if err != nil {
+		log.Fatalln("Cluster raft address Error:", err)
+	}
+
+	trans, err := raft.NewTCPTransport(bind, advertise, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		log.Fatalln("Cluster raft transport Error:", err)
+	}
+
+	var peers []cluster.Peer
+	for _, p := range cnf.Cluster.Peers {
+		peers = append(peers, cluster.Peer{ID: p.ID, Raft: p.Raft, API: p.API})
+	}
+
+	spaces := map[string]cluster.Space{}
+	for _, s := range cnf.AddressSpaces() {
+		s := s
+		spaces[s.Name] = cluster.Space{
+			New: func() (*leaser.Leaser, error) {
+				lsr, err := emptyLeaser(s)
+				if err != nil {
+					return nil, err
+				}
+
+				return lsr, drainPools(s, lsr)
+			},
+			Setup: func(lsr *leaser.Leaser) error {
+				return setupLeaser(cnf, s, lsr)
+			},
+		}
+	}
+
+	c, err := cluster.New(cluster.Config{ID: cnf.Cluster.ID, Dir: cnf.Cluster.Dir, Peers: peers, Token: cnf.Server.Token}, trans, spaces)
+	if err != nil {
+		log.Fatalln("Start cluster node Error:", err)
+	}
+
+	log.Println("Cluster node " + cnf.Cluster.ID + " is started, raft [" + bind + "]")
+	return c
+}
+
+// remoteSpaces - leasers of all address spaces of remote server
+func remoteSpaces(cnf *config.Config) map[string]gipam.LeaserInterface {
+	names, err := remote.Spaces(cnf.Server.Remote, cnf.Server.Token)
+	if err != nil {
+		log.Fatalln("Get address spaces of server "+cnf.Server.Remote+" Error:", err)
+	}
+
+	spaces := map[string]gipam.LeaserInterface{}
+	for _, name := range names {
+		c, err := remote.NewClient(cnf.Server.Remote, cnf.Server.Token, name)
+		if err != nil {
+			log.Fatalln("Create client of address space '"+name+"' Error:", err)
+		}
+
+		log.Printf("[%s] Address space of server %s", name, cnf.Server.Remote)
+		spaces[name] = c
+	}
+
+	return spaces
+}
+
+// newLeaser - restore or create leaser of address space, lost state of driver is rebuilt from Docker unless -fresh is set
+func newLeaser(cnf *config.Config, s config.Space, driver bool, stop chan os.Signal) (*leaser.Leaser, leaser.Store) {
+	store, err := leaser.NewStore(cnf.Lease.Store, s.File, cnf.Lease.Generations)
+	if err != nil {
+		log.Fatalln("Open state store of address space '"+s.Name+"' Error:", err)
+	}
+
+	// try restore previous state with journal, new state is created only if store is empty,
+	// broken state must be fixed by hand, else allocated blocks can be given twice
+	lsr, err := store.Load()
+	if err != nil {
+		if err != leaser.ErrNoState {
+			log.Fatalln("Can't Restore state of address space '"+s.Name+"':", err)
+		}
+
+		log.Println("Can't Restore state of address space '"+s.Name+"', because", err)
+
+		// new state gives blocks of existing networks again, so driver rebuilds it from Docker
+		if driver && !cnf.Docker.Fresh {
+			lsr = recoverLeaser(cnf, s, stop)
+		} else {
+			lsr = createLeaser(s)
+		}
+
+		if err := drainPools(s, lsr); err != nil {
+			log.Fatalln("Drain main pools of address space '"+s.Name+"' Error:", err)
+		}
+	} else if err := resolveConflicts(cnf, s, lsr); err != nil {
+		log.Fatalln(err)
+	}
+
+	err = setupLeaser(cnf, s, lsr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// state is saved before first mutation, then every mutation is written to store
+	err = store.Save(lsr)
+	if err != nil {
+		log.Fatalln("Save state of address space '"+s.Name+"' Error:", err)
+	}
+
+	lsr.SetStore(store)
+
+	// Notify current state, main pools of IP version are used in order
+	for _, p := range lsr.Pools() {
+		log.Printf("[%s] IPv%d address pool: %s / Len (%d): %.0f", s.Name, p.V, p.Pool, p.AllocateBlock, p.Capacity)
+		if p.Drain {
+			log.Printf("[%s] Main pool %s is draining, %d networks block its retirement", s.Name, p.Pool, p.Blocks)
+		}
+
+		log.Printf("[%s] Free blocks of %s: %v / Fragmentation: %.2f", s.Name, p.Pool, p.Free, p.Fragmentation)
+	}
+
+	return lsr, store
+}
+
+// createLeaser - new leaser of address space with empty state
+func createLeaser(s config.Space) *leaser.Leaser {
+	lsr, err := emptyLeaser(s)
+	if err != nil {
+		log.Fatalln("Create Leaser Instance of address space '"+s.Name+"' Error:", err)
+	}
+
+	return lsr
+}
+
+// emptyLeaser - leaser with all main pools of address space and empty state, draining pools are set by drainPools,
+// so networks of them can be recovered from Docker
+func emptyLeaser(s config.Space) (*leaser.Leaser, error) {
+	lsr, err := leaser.New(s.IPv6, s.IPv4, s.IPv6AB, s.IPv4AB)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range []uint8{6, 4} {
+		pools := mainPools(s, v)
+		for k := range pools {
+			pools[k].Drain = false
+		}
+
+		if len(pools) > 1 {
+			if err := lsr.SetPools(v, pools); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return lsr, nil
+}
+
+// drainPools - set draining main pools of new state, draining pools without blocks are retired
+func drainPools(s config.Space, lsr *leaser.Leaser) error {
+	for _, v := range []uint8{6, 4} {
+		if pools := mainPools(s, v); len(pools) != 0 {
+			if err := lsr.SetPools(v, pools); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// mainPools - main pools of address space by IP version in configured order
+func mainPools(s config.Space, v uint8) []leaser.MainPool {
+	var r []leaser.MainPool
+	for _, p := range s.Family(v) {
+		r = append(r, leaser.MainPool{Pool: p.CIDR, AllocateBlock: p.Block, Drain: p.Drain})
+	}
+
+	return r
+}
+
+// recoverLeaser - rebuild lost state of address space from networks of Docker, driver isn't started until it succeeds.
+// Every attempt starts with empty state, so partly adopted blocks are not kept.
+func recoverLeaser(cnf *config.Config, s config.Space, stop chan os.Signal) *leaser.Leaser {
+	c, err := docker.NewClient(cnf.Docker.Host)
+	if err != nil {
+		log.Fatalln("Docker API Error:", err)
+	}
+
+	log.Println("State of address space '" + s.Name + "' is rebuilt from networks of Docker [" + cnf.Docker.Host + "], start with -fresh to use empty state")
+	for {
+		lsr := createLeaser(s)
+		err := setupLeaser(cnf, s, lsr)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		n, err := docker.Recover(c, cnf.Docker.Driver, lsr)
+		if err == nil {
+			log.Printf("[%s] State is recovered, %d blocks of networks are adopted", s.Name, n)
+			return lsr
+		}
+
+		log.Println("Recovery of address space '"+s.Name+"' Error:", err)
+		select {
+		case <-stop:
+			log.Fatalln("GIPAM driver is stopped, state of address space '" + s.Name + "' is not recovered")
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// resolveConflicts - compare configured main pools with restored state and apply -conflict policy.
+// Allocated blocks out of configured pools are released only with -drop-blocks, pools of IP version which isn't configured are kept.
+func resolveConflicts(cnf *config.Config, s config.Space, lsr *leaser.Leaser) error {
+	type family struct {
+		v     uint8
+		pools []leaser.MainPool
+		pc    *leaser.PoolChange
+	}
+
+	var diff []family
+	for _, v := range []uint8{6, 4} {
+		f := family{v: v, pools: mainPools(s, v)}
+		if len(f.pools) == 0 {
+			continue
+		}
+
+		if f.pc = lsr.PlanPools(f.v, f.pools); f.pc != nil {
+			diff = append(diff, f)
+			log.Printf("[%s] Config differs from state: %s", s.Name, f.pc)
+		}
+	}
+
+	if len(diff) == 0 {
+		return nil
+	}
+
+	switch cnf.Lease.Conflict {
+	case config.PreferState:
+		log.Printf("[%s] Main pools of state are used (-conflict %s)", s.Name, cnf.Lease.Conflict)
+		return nil
+
+	case config.Fail:
+		return errors.New("Config of address space '" + s.Name + "' differs from state (-conflict " + cnf.Lease.Conflict + ")")
+	}
+
+	for _, f := range diff {
+		if f.pc.Error == "" {
+			if err := lsr.SetPools(f.v, f.pools); err != nil {
+				return errors.New("[" + s.Name + "] " + err.Error())
+			}
+
+			continue
+		}
+
+		if !cnf.Lease.DropBlocks {
+			return errors.New("[" + s.Name + "] Config can't be applied to state: " + f.pc.String() + ". Start with -drop-blocks to release allocated blocks which are out of configured pools")
+		}
+
+		released, err := lsr.ForcePools(f.v, f.pools)
+		for _, b := range released {
+			log.Printf("[%s] Allocated block %s is released (-drop-blocks)", s.Name, b)
+		}
+
+		if err != nil {
+			return errors.New("[" + s.Name + "] " + err.Error())
+		}
+	}
+
+	log.Printf("[%s] Main pools of config are used (-conflict %s)", s.Name, cnf.Lease.Conflict)
+	return nil
+}
+
+// setupLeaser - apply lease parameters which are not stored in state
+func setupLeaser(cnf *config.Config, s config.Space, lsr *leaser.Leaser) error {
+	err := lsr.SetGatewayPolicy(cnf.Lease.Gateway)
+	if err != nil {
+		return errors.New("Gateway policy Error: " + err.Error())
+	}
+
+	err = lsr.SetMACRetention(cnf.Lease.MACRetention)
+	if err != nil {
+		return errors.New("MAC retention Error: " + err.Error())
+	}
+
+	err = lsr.SetHoldDown(cnf.Lease.AddressHold, cnf.Lease.BlockHold)
+	if err != nil {
+		return errors.New("Hold-down Error: " + err.Error())
+	}
+
+	err = lsr.SetExclude(s.Excluded())
+	if err != nil {
+		return errors.New("Excluded addresses Error: " + err.Error())
+	}
+
+	for _, p := range s.Pools {
+		err = lsr.SetPoolGateway(p.CIDR, p.Gateway)
+		if err != nil {
+			return errors.New("Gateway policy of pool '" + p.Name + "' Error: " + err.Error())
+		}
+	}
+
+	lsr.SetV6Anycast(cnf.Lease.V6Anycast)
+	return nil
+}
+
+// migrate - copy state of all address spaces from -migrate-from store to -store
+func migrate(cnf *config.Config) {
+	for _, s := range cnf.AddressSpaces() {
+		kind, file, err := cnf.Migration(s.Name)
+		if err != nil {
+			log.Fatalln("Migration Error:", err)
+		}
+
+		from, err := leaser.NewStore(kind, file, cnf.Lease.Generations)
+		if err != nil {
+			log.Fatalln("Open source store of address space '"+s.Name+"' Error:", err)
+		}
+
+		to, err := leaser.NewStore(cnf.Lease.Store, s.File, cnf.Lease.Generations)
+		if err != nil {
+			log.Fatalln("Open target store of address space '"+s.Name+"' Error:", err)
+		}
+
+		err = leaser.Migrate(from, to)
+		from.Close()
+		to.Close()
+
+		if err != nil {
+			log.Fatalln("Migration of address space '"+s.Name+"' Error:", err)
+		}
+
+		log.Println("State of address space '"+s.Name+"' is copied from", kind+":"+file, "to", cnf.Lease.Store+":"+s.File)
+	}
+}
@@ -0,0 +1,279 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/archekb/gipam/pkg/gipam"
+	"github.com/archekb/gipam/pkg/leaser"
+)
+
+// Leaser - leaser which state can be inspected, leaser.Leaser implements it
+type Leaser interface {
+	gipam.LeaserInterface
+
+	Pools() []leaser.PoolInfo
+	Blocks() []leaser.BlockInfo
+	Block(string) (leaser.BlockInfo, error)
+	Whois(string) (*leaser.Owner, error)
+	Snapshot() ([]byte, uint64, error)
+	PinBlock(string, string) (string, string, error)
+	PinAddress(string, string, string) (string, error)
+}
+
+// Request - body of reserve requests
+type Request struct {
+	Pool    string `json:"pool,omitempty"`
+	SubPool string `json:"subpool,omitempty"`
+	Address string `json:"address,omitempty"`
+	MAC     string `json:"mac,omitempty"`
+}
+
+// Reserved - result of reserve requests
+type Reserved struct {
+	ID      string `json:"id,omitempty"`
+	Pool    string `json:"pool,omitempty"`
+	Address string `json:"address,omitempty"`
+}
+
+// Reloaded - result of reload request
+type Reloaded struct {
+	Changes []string `json:"changes"`
+}
+
+// Error - body of failed request
+type Error struct {
+	Error string `json:"error"`
+}
+
+// NewServer - create admin API of leasers, if token is not empty every request must have 'Authorization: Bearer <token>' header
+func NewServer(spaces map[string]Leaser, token string) *Server {
+	return &Server{Spaces: spaces, Token: token}
+}
+
+// ReloadFunc - re-read configuration and apply safe changes, it returns applied changes
+// or error with every planned change if some of them are unsafe, then nothing is applied
+type ReloadFunc func() ([]string, error)
+
+// Server - admin HTTP API of leasers of address spaces, all operations use leaser locks so they are safe while driver works.
+//
+//	GET    /v1/spaces                                   - names of address spaces
+//	GET    /v1/spaces/<space>/pools                     - main pools usage and free blocks
+//	GET    /v1/spaces/<space>/blocks                    - allocated blocks with leases
+//	POST   /v1/spaces/<space>/blocks                    - reserve block {"pool": "...", "subpool": "..."}
+//	GET    /v1/spaces/<space>/blocks/<id>               - allocated block with leases
+//	DELETE /v1/spaces/<space>/blocks/<id>               - force release block
+//	POST   /v1/spaces/<space>/blocks/<id>/addresses     - reserve address {"address": "...", "mac": "..."}
+//	DELETE /v1/spaces/<space>/blocks/<id>/addresses/<ip> - force release address
+//	GET    /v1/spaces/<space>/whois/<ip>                - owner of address
+//	GET    /v1/spaces/<space>/state                     - state in lease file format
+//	POST   /v1/reload                                   - re-read configuration, it is the same as SIGHUP
+type Server struct {
+	Spaces map[string]Leaser
+	Token  string
+	Reload ReloadFunc // nil disables reload
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		writeError(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(path) == 2 && path[0] == "v1" && path[1] == "reload" {
+		s.reload(w, r)
+		return
+	}
+
+	if len(path) < 2 || path[0] != "v1" || path[1] != "spaces" {
+		writeError(w, http.StatusNotFound, errors.New("Not found"))
+		return
+	}
+
+	if len(path) == 2 {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+			return
+		}
+
+		names := []string{}
+		for name := range s.Spaces {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+		writeJSON(w, http.StatusOK, names)
+		return
+	}
+
+	lsr, ok := s.Spaces[path[2]]
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("Unknown address space '"+path[2]+"'"))
+		return
+	}
+
+	route := r.Method + " " + strings.Join(path[3:], "/")
+	switch {
+	case route == "GET pools":
+		writeJSON(w, http.StatusOK, lsr.Pools())
+
+	case route == "GET blocks":
+		writeJSON(w, http.StatusOK, lsr.Blocks())
+
+	case route == "GET state":
+		data, _, err := lsr.Snapshot()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+
+	case route == "POST blocks":
+		var req Request
+		if !readJSON(w, r, &req) {
+			return
+		}
+
+		// block reserved by operator isn't released by reconciler
+		id, pool, err := lsr.PinBlock(req.Pool, req.SubPool)
+		writeResult(w, &Reserved{ID: id, Pool: pool}, err)
+
+	case len(path) == 5 && path[3] == "blocks" && r.Method == http.MethodGet:
+		b, err := lsr.Block(path[4])
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, b)
+
+	case len(path) == 5 && path[3] == "blocks" && r.Method == http.MethodDelete:
+		writeResult(w, nil, lsr.ReturnBlock(path[4]))
+
+	case len(path) == 6 && path[3] == "blocks" && path[5] == "addresses" && r.Method == http.MethodPost:
+		var req Request
+		if !readJSON(w, r, &req) {
+			return
+		}
+
+		addr, err := lsr.PinAddress(path[4], req.Address, req.MAC)
+		writeResult(w, &Reserved{ID: path[4], Address: addr}, err)
+
+	case len(path) == 7 && path[3] == "blocks" && path[5] == "addresses" && r.Method == http.MethodDelete:
+		writeResult(w, nil, lsr.ReturnAddress(path[4], path[6]))
+
+	case len(path) == 5 && path[3] == "whois" && r.Method == http.MethodGet:
+		o, err := lsr.Whois(path[4])
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, o)
+
+	default:
+		writeError(w, http.StatusNotFound, errors.New("Not found"))
+	}
+}
+
+// reload - apply configuration, rejected reload is returned with 422 status
+func (s *Server) reload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+		return
+	}
+
+	if s.Reload == nil {
+		writeError(w, http.StatusNotFound, errors.New("Reload is not available"))
+		return
+	}
+
+	changes, err := s.Reload()
+	if changes == nil {
+		changes = []string{}
+	}
+
+	writeResult(w, &Reloaded{Changes: changes}, err)
+}
+
+// authorized - check bearer token, empty token disables authentication
+func (s *Server) authorized(r *http.Request) bool {
+	if s.Token == "" {
+		return true
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(s.Token)) == 1
+}
+
+// Listen - listen admin address: 'host:port' or path of UNIX socket, old socket file is removed
+func Listen(address string) (net.Listener, error) {
+	if !IsSocket(address) {
+		return net.Listen("tcp", address)
+	}
+
+	if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", address)
+	if err != nil {
+		return nil, err
+	}
+
+	// socket gives full control of leases
+	return l, os.Chmod(address, 0600)
+}
+
+// IsSocket - true if admin address is path of UNIX socket
+func IsSocket(address string) bool {
+	return strings.HasPrefix(address, "/") || strings.HasPrefix(address, ".")
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("Wrong request: "+err.Error()))
+		return false
+	}
+
+	return true
+}
+
+// writeResult - leaser error is returned with 422 status
+func writeResult(w http.ResponseWriter, v interface{}, err error) {
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	if v == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, &Error{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
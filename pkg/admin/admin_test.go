@@ -0,0 +1,116 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/archekb/gipam/pkg/leaser"
+
+	"github.com/stretchr/testify/require"
+)
+
+func request(t *testing.T, h http.Handler, method, path, body string, res interface{}) int {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Authorization", "Bearer secret")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if res != nil {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), res))
+	}
+
+	return w.Code
+}
+
+func TestAdmin(t *testing.T) {
+	lsr, err := leaser.New("fe80::/48", "192.168.0.0/16", 64, 24)
+	require.NoError(t, err)
+
+	srv := NewServer(map[string]Leaser{"local": lsr}, "secret")
+
+	id, _, err := lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+	lsr.GetGateway(id, "")
+	lsr.GetAddress(id, "02:42:c0:a8:00:02")
+	lsr.ReserveAddress(id, "192.168.0.10", "")
+
+	var pools []leaser.PoolInfo
+	require.Equal(t, http.StatusOK, request(t, srv, "GET", "/v1/spaces/local/pools", "", &pools))
+	require.Len(t, pools, 2)
+	require.Equal(t, "192.168.0.0/16", pools[1].Pool)
+	require.Equal(t, 1, pools[1].Blocks)
+	require.InDelta(t, 1.0/256, pools[1].Used, 1e-9)
+
+	var blocks []leaser.BlockInfo
+	require.Equal(t, http.StatusOK, request(t, srv, "GET", "/v1/spaces/local/blocks", "", &blocks))
+	require.Len(t, blocks, 1)
+	require.Equal(t, []string{"192.168.0.2", "192.168.0.10"}, blocks[0].Leases)
+	require.Equal(t, uint64(2), blocks[0].Leased)
+
+	var o leaser.Owner
+	require.Equal(t, http.StatusOK, request(t, srv, "GET", "/v1/spaces/local/whois/192.168.0.2", "", &o))
+	require.Equal(t, id, o.Block)
+	require.Equal(t, "02:42:c0:a8:00:02", o.MAC)
+	require.True(t, o.Leased)
+
+	require.Equal(t, http.StatusNotFound, request(t, srv, "GET", "/v1/spaces/local/whois/10.0.0.1", "", nil))
+
+	// reserve and force release
+	var res Reserved
+	require.Equal(t, http.StatusOK, request(t, srv, "POST", "/v1/spaces/local/blocks/"+id+"/addresses", `{"address": "192.168.0.20"}`, &res))
+	require.Equal(t, "192.168.0.20/24", res.Address)
+	require.Equal(t, http.StatusUnprocessableEntity, request(t, srv, "POST", "/v1/spaces/local/blocks/"+id+"/addresses", `{"address": "192.168.0.20"}`, nil))
+	require.Equal(t, http.StatusNoContent, request(t, srv, "DELETE", "/v1/spaces/local/blocks/"+id+"/addresses/192.168.0.10", "", nil))
+
+	var b leaser.BlockInfo
+	require.Equal(t, http.StatusOK, request(t, srv, "GET", "/v1/spaces/local/blocks/"+id, "", &b))
+	require.Equal(t, []string{"192.168.0.2", "192.168.0.20"}, b.Leases)
+
+	require.Equal(t, http.StatusOK, request(t, srv, "POST", "/v1/spaces/local/blocks", `{"pool": "192.168.10.0/24"}`, &res))
+	require.Equal(t, "192.168.10.0/24", res.Pool)
+	require.Equal(t, http.StatusNoContent, request(t, srv, "DELETE", "/v1/spaces/local/blocks/"+id, "", nil))
+	require.Len(t, lsr.Blocks(), 1)
+
+	require.Equal(t, http.StatusNotFound, request(t, srv, "GET", "/v1/spaces/global/pools", "", nil))
+	require.Equal(t, http.StatusBadRequest, request(t, srv, "POST", "/v1/spaces/local/blocks", `{`, nil))
+
+	req := httptest.NewRequest("GET", "/v1/spaces", nil)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestReload(t *testing.T) {
+	srv := NewServer(map[string]Leaser{}, "secret")
+	require.Equal(t, http.StatusNotFound, request(t, srv, "POST", "/v1/reload", "", nil))
+
+	var fail bool
+	srv.Reload = func() ([]string, error) {
+		if fail {
+			return nil, errors.New("Unsafe changes")
+		}
+
+		return []string{"[local] IPv4 pool 192.168.0.0/24 block /26 -> 192.168.0.0/23 block /26"}, nil
+	}
+
+	hs := httptest.NewServer(srv)
+	defer hs.Close()
+
+	c, err := NewClient(hs.URL, "secret", "local")
+	require.NoError(t, err)
+
+	changes, err := c.Reload()
+	require.NoError(t, err)
+	require.Equal(t, []string{"[local] IPv4 pool 192.168.0.0/24 block /26 -> 192.168.0.0/23 block /26"}, changes)
+
+	fail = true
+	_, err = c.Reload()
+	require.EqualError(t, err, "Unsafe changes")
+
+	require.Equal(t, http.StatusMethodNotAllowed, request(t, srv, "GET", "/v1/reload", "", nil))
+}
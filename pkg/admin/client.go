@@ -0,0 +1,169 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/archekb/gipam/pkg/leaser"
+)
+
+// NewClient - client of admin API of address space, address is 'host:port', URL or path of UNIX socket
+func NewClient(address, token, space string) (*Client, error) {
+	if address == "" {
+		return nil, errors.New("Admin API address is empty")
+	}
+
+	c := &Client{URL: strings.TrimRight(address, "/"), Token: token, Space: space, HTTP: &http.Client{Timeout: 30 * time.Second}}
+	switch {
+	case IsSocket(address):
+		c.URL = "http://gipam"
+		c.HTTP.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", address)
+			},
+		}
+
+	case !strings.Contains(address, "://"):
+		c.URL = "http://" + c.URL
+	}
+
+	return c, nil
+}
+
+// Client - client of admin API of address space
+type Client struct {
+	URL   string
+	Token string
+	Space string
+	HTTP  *http.Client
+}
+
+// Pools - usage of main pools
+func (c *Client) Pools() ([]leaser.PoolInfo, error) {
+	var r []leaser.PoolInfo
+	return r, c.do(http.MethodGet, "pools", nil, &r)
+}
+
+// Blocks - allocated blocks with leases
+func (c *Client) Blocks() ([]leaser.BlockInfo, error) {
+	var r []leaser.BlockInfo
+	return r, c.do(http.MethodGet, "blocks", nil, &r)
+}
+
+// Block - allocated block with leases by ID
+func (c *Client) Block(id string) (leaser.BlockInfo, error) {
+	var r leaser.BlockInfo
+	return r, c.do(http.MethodGet, "blocks/"+url.PathEscape(id), nil, &r)
+}
+
+// Whois - owner of address
+func (c *Client) Whois(ip string) (*leaser.Owner, error) {
+	var r leaser.Owner
+	if err := c.do(http.MethodGet, "whois/"+url.PathEscape(ip), nil, &r); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// PinBlock - reserve block for operator, reconciler doesn't release it
+func (c *Client) PinBlock(pool, subPool string) (string, string, error) {
+	var r Reserved
+	err := c.do(http.MethodPost, "blocks", &Request{Pool: pool, SubPool: subPool}, &r)
+	return r.ID, r.Pool, err
+}
+
+// PinAddress - reserve address of block for operator, reconciler doesn't release it
+func (c *Client) PinAddress(id, address, mac string) (string, error) {
+	var r Reserved
+	err := c.do(http.MethodPost, "blocks/"+url.PathEscape(id)+"/addresses", &Request{Address: address, MAC: mac}, &r)
+	return r.Address, err
+}
+
+// ReturnBlock - force release block
+func (c *Client) ReturnBlock(id string) error {
+	return c.do(http.MethodDelete, "blocks/"+url.PathEscape(id), nil, nil)
+}
+
+// ReturnAddress - force release address of block
+func (c *Client) ReturnAddress(id, address string) error {
+	return c.do(http.MethodDelete, "blocks/"+url.PathEscape(id)+"/addresses/"+url.PathEscape(strings.Split(address, "/")[0]), nil, nil)
+}
+
+// Export - state in lease file format
+func (c *Client) Export() ([]byte, error) {
+	var r json.RawMessage
+	return r, c.do(http.MethodGet, "state", nil, &r)
+}
+
+// Reload - re-read configuration of driver and apply safe changes, applied changes are returned
+func (c *Client) Reload() ([]string, error) {
+	var r Reloaded
+	return r.Changes, c.call(http.MethodPost, "/v1/reload", nil, &r)
+}
+
+// Close - nothing to close
+func (c *Client) Close() error {
+	return nil
+}
+
+// do - send request to address space, API error is returned as error
+func (c *Client) do(method, path string, body, res interface{}) error {
+	return c.call(method, "/v1/spaces/"+url.PathEscape(c.Space)+"/"+path, body, res)
+}
+
+// call - send request to admin API
+func (c *Client) call(method, path string, body, res interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, c.URL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return errors.New("Admin API is unavailable: " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	data, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		var e Error
+		if json.Unmarshal(data, &e) != nil || e.Error == "" {
+			return errors.New("Admin API returns " + resp.Status)
+		}
+
+		return errors.New(e.Error)
+	}
+
+	if res == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	return json.Unmarshal(data, res)
+}
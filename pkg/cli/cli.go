@@ -0,0 +1,507 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/archekb/gipam/pkg/admin"
+	"github.com/archekb/gipam/pkg/leaser"
+)
+
+// Commands - operator subcommands
+var Commands = map[string]string{
+	"status":  "status                              - capacity of main pools",
+	"leases":  "leases [-block ID]                  - allocated blocks and their leases",
+	"whois":   "whois <ip>                          - block and MAC which own address",
+	"release": "release -block ID [ip]              - force release block or its address",
+	"reserve": "reserve <prefix> [-subpool R] | reserve -block ID <ip> [-mac MAC] - reserve block or address",
+	"export":  "export [file]                       - write state in lease file format",
+	"import":  "import [-force] <file>              - replace state of stopped driver by file",
+	"reload":  "reload -admin ADDR                  - re-read configuration of running driver and apply safe changes",
+}
+
+// IsCommand - true if name is operator subcommand
+func IsCommand(name string) bool {
+	_, ok := Commands[name]
+	return ok
+}
+
+// backend - state of address space: lease store (offline) or admin API of running driver (online)
+type backend interface {
+	Pools() ([]leaser.PoolInfo, error)
+	Blocks() ([]leaser.BlockInfo, error)
+	Block(string) (leaser.BlockInfo, error)
+	Whois(string) (*leaser.Owner, error)
+	PinBlock(string, string) (string, string, error)
+	PinAddress(string, string, string) (string, error)
+	ReturnBlock(string) error
+	ReturnAddress(string, string) error
+	Export() ([]byte, error)
+	Close() error
+}
+
+// options - common flags of subcommands
+type options struct {
+	Admin       string
+	AdminToken  string
+	File        string
+	Store       string
+	Generations uint
+	Space       string
+	JSON        bool
+
+	Block   string
+	SubPool string
+	MAC     string
+	Force   bool
+}
+
+// Run - run subcommand, args[0] is subcommand name. Without -admin subcommand works with lease file of stopped driver.
+func Run(args []string, out io.Writer) error {
+	if len(args) == 0 || !IsCommand(args[0]) {
+		return errors.New("Unknown command")
+	}
+
+	opt := options{
+		Admin:       os.Getenv("GIPAM_ADMIN"),
+		AdminToken:  os.Getenv("GIPAM_ADMIN_TOKEN"),
+		File:        getEnv("GIPAM_FILE", "lease.json"),
+		Store:       getEnv("GIPAM_STORE", leaser.StoreJSON),
+		Generations: 3,
+		Space:       getEnv("GIPAM_LOCAL", "local"),
+	}
+
+	fs := flag.NewFlagSet("gipam "+args[0], flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.Usage = func() {
+		fmt.Fprintln(out, "Usage: gipam "+Commands[args[0]])
+		fs.PrintDefaults()
+	}
+
+	fs.StringVar(&opt.Admin, "admin", opt.Admin, "Admin API of running driver: 'host:port' or path of UNIX socket. If empty lease file is used")
+	fs.StringVar(&opt.AdminToken, "admin-token", opt.AdminToken, "Bearer token of admin API")
+	fs.StringVar(&opt.File, "file", opt.File, "Lease file or database of address space")
+	fs.StringVar(&opt.Store, "store", opt.Store, "State store: 'json', 'bolt' or 'sqlite'")
+	fs.StringVar(&opt.Space, "space", opt.Space, "Address space")
+	fs.BoolVar(&opt.JSON, "json", false, "Print JSON instead of table")
+	fs.StringVar(&opt.Block, "block", "", "ID of allocated block")
+	fs.StringVar(&opt.SubPool, "subpool", "", "Range of reserved block which addresses are given from")
+	fs.StringVar(&opt.MAC, "mac", "", "MAC address which reserved address is bound to")
+	fs.BoolVar(&opt.Force, "force", false, "Import replaces existing state")
+
+	pos, err := parse(fs, args[1:])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "import":
+		return runImport(&opt, pos, out)
+	case "reload":
+		return runReload(&opt, out)
+	}
+
+	// offline store is changed only by release and reserve, other commands read it
+	b, err := open(&opt, args[0] == "release" || args[0] == "reserve")
+	if err != nil {
+		return err
+	}
+
+	err = run(b, args[0], &opt, pos, out)
+	if cerr := b.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// parse - flags can be before and after positional arguments
+func parse(fs *flag.FlagSet, args []string) ([]string, error) {
+	var pos []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		if fs.NArg() == 0 {
+			return pos, nil
+		}
+
+		pos = append(pos, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// open - admin API if it is set, else lease store. Store which isn't changed is opened read-only,
+// store is locked, so it isn't opened while driver runs with it.
+func open(opt *options, change bool) (backend, error) {
+	if opt.Admin != "" {
+		return admin.NewClient(opt.Admin, opt.AdminToken, opt.Space)
+	}
+
+	var st leaser.Store
+	var err error
+	if change {
+		st, err = leaser.NewStore(opt.Store, opt.File, opt.Generations)
+	} else {
+		st, err = leaser.NewReadOnlyStore(opt.Store, opt.File, opt.Generations)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	lsr, err := st.Load()
+	if err != nil {
+		st.Close()
+		if err == leaser.ErrNoState {
+			return nil, errors.New("No state in " + opt.Store + ":" + opt.File)
+		}
+
+		return nil, err
+	}
+
+	if change {
+		lsr.SetStore(st)
+	}
+
+	return &offline{Leaser: lsr, store: st, change: change}, nil
+}
+
+// offline - leaser restored from store, changes are written to journal and saved on close
+type offline struct {
+	*leaser.Leaser
+	store  leaser.Store
+	change bool // store is opened for changes, else it is read-only and isn't saved
+}
+
+func (o *offline) Pools() ([]leaser.PoolInfo, error) {
+	return o.Leaser.Pools(), nil
+}
+
+func (o *offline) Blocks() ([]leaser.BlockInfo, error) {
+	return o.Leaser.Blocks(), nil
+}
+
+func (o *offline) Export() ([]byte, error) {
+	data, _, err := o.Snapshot()
+	return data, err
+}
+
+func (o *offline) Close() error {
+	var err error
+	if o.change {
+		err = o.store.Save(o.Leaser)
+	}
+
+	if cerr := o.store.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// run - run subcommand with backend
+func run(b backend, cmd string, opt *options, pos []string, out io.Writer) error {
+	switch cmd {
+	case "status":
+		pools, err := b.Pools()
+		if err != nil {
+			return err
+		}
+
+		if opt.JSON {
+			return printJSON(out, pools)
+		}
+
+		t := newTable(out, "POOL", "BLOCK", "ALLOCATED", "USED", "LARGEST FREE", "FRAGMENTATION", "STATE")
+		for _, p := range pools {
+			largest := "-"
+			if p.Largest != 0 {
+				largest = "/" + strconv.Itoa(int(p.Largest))
+			}
+
+			// draining pool is retired when all its networks are removed
+			state := "active"
+			if p.Drain {
+				state = "drain, " + strconv.Itoa(p.Blocks) + " networks left"
+			}
+
+			t.row(p.Pool, "/"+strconv.Itoa(int(p.AllocateBlock)), strconv.Itoa(p.Blocks), percent(p.Used), largest, percent(p.Fragmentation), state)
+		}
+
+		return t.flush()
+
+	case "leases":
+		if opt.Block != "" {
+			blk, err := b.Block(opt.Block)
+			if err != nil {
+				return err
+			}
+
+			if opt.JSON {
+				return printJSON(out, blk)
+			}
+
+			return printBlock(out, blk)
+		}
+
+		blocks, err := b.Blocks()
+		if err != nil {
+			return err
+		}
+
+		if opt.JSON {
+			return printJSON(out, blocks)
+		}
+
+		t := newTable(out, "ID", "POOL", "GATEWAY", "LEASED", "ADDRESSES")
+		for _, blk := range blocks {
+			t.row(blk.ID, blk.Pool, dash(blk.Gateway), strconv.FormatUint(blk.Leased, 10), dash(strings.Join(blk.Leases, ",")))
+		}
+
+		return t.flush()
+
+	case "whois":
+		if len(pos) != 1 {
+			return errors.New("Usage: gipam " + Commands[cmd])
+		}
+
+		o, err := b.Whois(pos[0])
+		if err != nil {
+			return err
+		}
+
+		if opt.JSON {
+			return printJSON(out, o)
+		}
+
+		state := "free"
+		switch {
+		case o.Gateway:
+			state = "gateway"
+		case o.Leased:
+			state = "leased"
+		case o.Released != 0:
+			state = "retained since " + time.Unix(o.Released, 0).UTC().Format(time.RFC3339)
+		}
+
+		t := newTable(out, "IP", "BLOCK", "POOL", "STATE", "MAC")
+		t.row(o.IP, o.Block, o.Pool, state, dash(o.MAC))
+		return t.flush()
+
+	case "release":
+		if opt.Block == "" || len(pos) > 1 {
+			return errors.New("Usage: gipam " + Commands[cmd])
+		}
+
+		if len(pos) == 1 {
+			return done(out, opt, b.ReturnAddress(opt.Block, pos[0]), map[string]string{"id": opt.Block, "address": pos[0]})
+		}
+
+		return done(out, opt, b.ReturnBlock(opt.Block), map[string]string{"id": opt.Block})
+
+	case "reserve":
+		if len(pos) != 1 {
+			return errors.New("Usage: gipam " + Commands[cmd])
+		}
+
+		if opt.Block != "" {
+			addr, err := b.PinAddress(opt.Block, pos[0], opt.MAC)
+			return done(out, opt, err, map[string]string{"id": opt.Block, "address": addr})
+		}
+
+		id, pool, err := b.PinBlock(pos[0], opt.SubPool)
+		return done(out, opt, err, map[string]string{"id": id, "pool": pool})
+
+	case "export":
+		data, err := b.Export()
+		if err != nil {
+			return err
+		}
+
+		if len(pos) == 0 {
+			_, err = out.Write(append(data, '\n'))
+			return err
+		}
+
+		return ioutil.WriteFile(pos[0], data, 0644)
+	}
+
+	return errors.New("Unknown command")
+}
+
+// runImport - save state from file to store, existing state is replaced only with -force
+func runImport(opt *options, pos []string, out io.Writer) error {
+	if len(pos) != 1 {
+		return errors.New("Usage: gipam " + Commands["import"])
+	}
+
+	if opt.Admin != "" {
+		return errors.New("State can't be imported to running driver, stop it and import to lease file")
+	}
+
+	data, err := ioutil.ReadFile(pos[0])
+	if err != nil {
+		return err
+	}
+
+	var lsr leaser.Leaser
+	err = lsr.UnmarshalJSON(data)
+	if err != nil {
+		return errors.New("Wrong state in " + pos[0] + ": " + err.Error())
+	}
+
+	st, err := leaser.NewStore(opt.Store, opt.File, opt.Generations)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	prev, err := st.Load()
+	if err != leaser.ErrNoState && !opt.Force {
+		// store is broken or locked by running driver
+		if err != nil {
+			return err
+		}
+
+		return errors.New("Store " + opt.Store + ":" + opt.File + " has state, use -force to replace it")
+	}
+
+	// journal entries of replaced state must not be replayed to imported state
+	if prev != nil && prev.Seq > lsr.Seq {
+		lsr.Seq = prev.Seq
+	}
+
+	err = st.Save(&lsr)
+	return done(out, opt, err, map[string]string{"file": opt.File, "blocks": strconv.Itoa(len(lsr.Allocated))})
+}
+
+// runReload - reload configuration of running driver, every applied change is printed
+func runReload(opt *options, out io.Writer) error {
+	if opt.Admin == "" {
+		return errors.New("Configuration is reloaded only by running driver, set its admin API by -admin")
+	}
+
+	c, err := admin.NewClient(opt.Admin, opt.AdminToken, opt.Space)
+	if err != nil {
+		return err
+	}
+
+	changes, err := c.Reload()
+	if err != nil {
+		return err
+	}
+
+	if opt.JSON {
+		return printJSON(out, &admin.Reloaded{Changes: changes})
+	}
+
+	for _, ch := range changes {
+		fmt.Fprintln(out, ch)
+	}
+
+	_, err = fmt.Fprintln(out, "OK", strconv.Itoa(len(changes))+" changes")
+	return err
+}
+
+// done - print result of change
+func done(out io.Writer, opt *options, err error, res map[string]string) error {
+	if err != nil {
+		return err
+	}
+
+	if opt.JSON {
+		return printJSON(out, res)
+	}
+
+	var kv []string
+	for _, k := range []string{"id", "pool", "address", "file", "blocks"} {
+		if v, ok := res[k]; ok {
+			kv = append(kv, k+"="+v)
+		}
+	}
+
+	_, err = fmt.Fprintln(out, "OK", strings.Join(kv, " "))
+	return err
+}
+
+// printBlock - block with every lease range and MAC bindings
+func printBlock(out io.Writer, blk leaser.BlockInfo) error {
+	fmt.Fprintln(out, "Block:  ", blk.ID, blk.Pool)
+	if blk.Range != "" {
+		fmt.Fprintln(out, "Range:  ", blk.Range)
+	}
+
+	fmt.Fprintln(out, "Gateway:", dash(blk.Gateway))
+	if len(blk.Exclude) != 0 {
+		fmt.Fprintln(out, "Exclude:", strings.Join(blk.Exclude, ","))
+	}
+
+	macs := map[string]string{}
+	for mac, b := range blk.MACs {
+		macs[b.IP] = mac
+	}
+
+	fmt.Fprintln(out)
+	t := newTable(out, "ADDRESS", "MAC")
+	for _, l := range blk.Leases {
+		t.row(l, dash(macs[l]))
+	}
+
+	return t.flush()
+}
+
+// table - aligned columns
+type table struct {
+	w *tabwriter.Writer
+}
+
+func newTable(out io.Writer, head ...string) *table {
+	t := &table{w: tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)}
+	t.row(head...)
+	return t
+}
+
+func (t *table) row(cols ...string) {
+	fmt.Fprintln(t.w, strings.Join(cols, "\t"))
+}
+
+func (t *table) flush() error {
+	return t.w.Flush()
+}
+
+func printJSON(out io.Writer, v interface{}) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func percent(f float64) string {
+	return strconv.FormatFloat(f*100, 'f', 1, 64) + "%"
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+func getEnv(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+
+	return def
+}
@@ -0,0 +1,198 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/archekb/gipam/pkg/admin"
+	"github.com/archekb/gipam/pkg/leaser"
+
+	"github.com/stretchr/testify/require"
+)
+
+func runCmd(t *testing.T, args ...string) (string, error) {
+	var out bytes.Buffer
+	err := Run(args, &out)
+	return out.String(), err
+}
+
+func TestOffline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gipam")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "lease.json")
+	st, err := leaser.NewStore(leaser.StoreJSON, file, 3)
+	require.NoError(t, err)
+
+	lsr, err := leaser.New("fe80::/48", "192.168.0.0/16", 64, 24)
+	require.NoError(t, err)
+	require.NoError(t, st.Save(lsr))
+	lsr.SetStore(st)
+
+	id, _, err := lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+	lsr.GetGateway(id, "")
+	lsr.GetAddress(id, "02:42:c0:a8:00:02")
+	require.NoError(t, st.Close())
+
+	out, err := runCmd(t, "status", "-file", file)
+	require.NoError(t, err)
+	require.Contains(t, out, "192.168.0.0/16")
+	require.Contains(t, out, "0.4%")
+	require.Contains(t, out, "active")
+
+	out, err = runCmd(t, "leases", "-file", file)
+	require.NoError(t, err)
+	require.Contains(t, out, id)
+	require.Contains(t, out, "192.168.0.2")
+
+	out, err = runCmd(t, "whois", "192.168.0.2", "-file", file, "-json")
+	require.NoError(t, err)
+	var o leaser.Owner
+	require.NoError(t, json.Unmarshal([]byte(out), &o))
+	require.Equal(t, id, o.Block)
+	require.Equal(t, "02:42:c0:a8:00:02", o.MAC)
+
+	// changes are saved to lease file
+	_, err = runCmd(t, "reserve", "-file", file, "-block", id, "192.168.0.10")
+	require.NoError(t, err)
+	_, err = runCmd(t, "release", "-file", file, "-block", id, "192.168.0.2")
+	require.NoError(t, err)
+
+	out, err = runCmd(t, "leases", "-file", file, "-block", id)
+	require.NoError(t, err)
+	require.Contains(t, out, "192.168.0.10")
+	require.NotContains(t, out, "192.168.0.2 ")
+
+	_, err = runCmd(t, "whois", "-file", file)
+	require.Error(t, err)
+
+	// export and import to other store
+	export := filepath.Join(dir, "export.json")
+	_, err = runCmd(t, "export", "-file", file, export)
+	require.NoError(t, err)
+
+	db := filepath.Join(dir, "lease.db")
+	_, err = runCmd(t, "import", "-store", "bolt", "-file", db, export)
+	require.NoError(t, err)
+	_, err = runCmd(t, "import", "-store", "bolt", "-file", db, export)
+	require.Error(t, err)
+	_, err = runCmd(t, "import", "-store", "bolt", "-file", db, "-force", export)
+	require.NoError(t, err)
+
+	out, err = runCmd(t, "leases", "-store", "bolt", "-file", db)
+	require.NoError(t, err)
+	require.Contains(t, out, "192.168.0.10")
+
+	_, err = runCmd(t, "status", "-file", filepath.Join(dir, "none.json"))
+	require.Error(t, err)
+}
+
+// TestOfflineReadOnly - commands which only read don't rewrite lease file, offline commands don't run while driver holds it
+func TestOfflineReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gipam")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "lease.json")
+	st, err := leaser.NewStore(leaser.StoreJSON, file, 3)
+	require.NoError(t, err)
+
+	lsr, err := leaser.New("fe80::/48", "192.168.0.0/16", 64, 24)
+	require.NoError(t, err)
+	require.NoError(t, st.Save(lsr))
+	lsr.SetStore(st)
+
+	id, _, err := lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+
+	lease, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	journal, err := ioutil.ReadFile(file + ".journal")
+	require.NoError(t, err)
+
+	state, _, err := lsr.Snapshot()
+	require.NoError(t, err)
+	export := filepath.Join(dir, "export.json")
+	require.NoError(t, ioutil.WriteFile(export, state, 0644))
+
+	// store is held by driver
+	for _, args := range [][]string{{"status"}, {"export"}, {"release", "-block", id}, {"import", "-force", export}} {
+		_, err = runCmd(t, append(args, "-file", file)...)
+		require.Error(t, err, args[0])
+		require.Contains(t, err.Error(), "locked", args[0])
+	}
+
+	require.NoError(t, st.Close())
+
+	for i := 0; i < 4; i++ {
+		for _, cmd := range []string{"status", "leases", "export"} {
+			_, err = runCmd(t, cmd, "-file", file)
+			require.NoError(t, err)
+		}
+
+		_, err = runCmd(t, "whois", "192.168.0.1", "-file", file)
+		require.NoError(t, err)
+	}
+
+	data, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, lease, data)
+
+	data, err = ioutil.ReadFile(file + ".journal")
+	require.NoError(t, err)
+	require.Equal(t, journal, data)
+
+	_, err = os.Stat(file + ".1")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestOnline(t *testing.T) {
+	lsr, err := leaser.New("fe80::/48", "192.168.0.0/16", 64, 24)
+	require.NoError(t, err)
+
+	srv := admin.NewServer(map[string]admin.Leaser{"local": lsr}, "secret")
+	srv.Reload = func() ([]string, error) { return []string{"[local] IPv4 pool none -> 10.0.0.0/8 block /24"}, nil }
+
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	out, err := runCmd(t, "reserve", "-admin", ts.URL, "-admin-token", "secret", "192.168.5.0/24", "-json")
+	require.NoError(t, err)
+
+	var res map[string]string
+	require.NoError(t, json.Unmarshal([]byte(out), &res))
+	require.Equal(t, "192.168.5.0/24", res["pool"])
+
+	out, err = runCmd(t, "leases", "-admin", ts.URL, "-admin-token", "secret")
+	require.NoError(t, err)
+	require.Contains(t, out, res["id"])
+
+	out, err = runCmd(t, "export", "-admin", ts.URL, "-admin-token", "secret")
+	require.NoError(t, err)
+	require.True(t, strings.Contains(out, `"192.168.5.0/24"`))
+
+	_, err = runCmd(t, "release", "-admin", ts.URL, "-admin-token", "secret", "-block", res["id"])
+	require.NoError(t, err)
+	require.Len(t, lsr.Allocated, 0)
+
+	_, err = runCmd(t, "status", "-admin", ts.URL, "-admin-token", "bla")
+	require.Error(t, err)
+
+	_, err = runCmd(t, "import", "-admin", ts.URL, "state.json")
+	require.Error(t, err)
+
+	out, err = runCmd(t, "reload", "-admin", ts.URL, "-admin-token", "secret")
+	require.NoError(t, err)
+	require.Equal(t, "[local] IPv4 pool none -> 10.0.0.0/8 block /24\nOK 1 changes\n", out)
+
+	_, err = runCmd(t, "reload")
+	require.Error(t, err)
+}
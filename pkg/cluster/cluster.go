@@ -0,0 +1,273 @@
+package cluster
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/archekb/gipam/pkg/gipam"
+	"github.com/archekb/gipam/pkg/leaser"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// Peer - cluster member, Raft is address of raft transport, API is URL of leaser API which followers redirect to
+type Peer struct {
+	ID   string
+	Raft string
+	API  string
+}
+
+// Config - cluster node config
+type Config struct {
+	ID    string
+	Dir   string // raft log and snapshots, if empty they are kept in memory
+	Peers []Peer // all voting members with this node
+
+	Token   string        // token of leaser API of leader
+	Timeout time.Duration // heartbeat and election timeout, 0 is raft default
+}
+
+// Space - address space which is replicated, New creates empty leaser with main pools,
+// Setup applies not replicated parameters (gateway policy, MAC retention, exclusions) to every leaser instance
+type Space struct {
+	New   func() (*leaser.Leaser, error)
+	Setup func(*leaser.Leaser) error
+}
+
+// New - start cluster node. Every node has replica of leasers of all address spaces which is changed only by
+// committed raft log. Leader serves requests by working copy of replica, every mutation is committed to raft log
+// before it is acknowledged. Followers forward requests of driver to leader and redirect API requests to it.
+func New(cnf Config, trans raft.Transport, spaces map[string]Space) (*Cluster, error) {
+	if cnf.ID == "" {
+		return nil, errors.New("Cluster node ID is empty")
+	}
+
+	if len(spaces) == 0 {
+		return nil, errors.New("Cluster has no address spaces")
+	}
+
+	c := &Cluster{Config: cnf, spaces: spaces, replicas: map[string]*leaser.Leaser{}, views: map[string]*view{}}
+	for name := range spaces {
+		lsr, err := c.newLeaser(name)
+		if err != nil {
+			return nil, err
+		}
+
+		c.replicas[name] = lsr
+		c.views[name] = &view{c: c, name: name}
+	}
+
+	rc := raft.DefaultConfig()
+	rc.LocalID = raft.ServerID(cnf.ID)
+	rc.LogLevel = "WARN"
+	if cnf.Timeout > 0 {
+		rc.HeartbeatTimeout = cnf.Timeout
+		rc.ElectionTimeout = cnf.Timeout
+		rc.LeaderLeaseTimeout = cnf.Timeout
+		rc.CommitTimeout = cnf.Timeout / 10
+	}
+
+	notify := make(chan bool, 1)
+	rc.NotifyCh = notify
+
+	logs, stable, snaps, err := c.stores()
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := raft.HasExistingState(logs, stable, snaps)
+	if err != nil {
+		return nil, err
+	}
+
+	c.raft, err = raft.NewRaft(rc, (*fsm)(c), logs, stable, snaps, trans)
+	if err != nil {
+		return nil, errors.New("Can't start raft: " + err.Error())
+	}
+
+	// every node is bootstrapped with same members, it is safe
+	if !exists {
+		var members raft.Configuration
+		for _, p := range cnf.Peers {
+			members.Servers = append(members.Servers, raft.Server{Suffrage: raft.Voter, ID: raft.ServerID(p.ID), Address: raft.ServerAddress(p.Raft)})
+		}
+
+		if err := c.raft.BootstrapCluster(members).Error(); err != nil && err != raft.ErrCantBootstrap {
+			c.raft.Shutdown()
+			return nil, errors.New("Can't bootstrap cluster: " + err.Error())
+		}
+	}
+
+	go c.watch(notify)
+	return c, nil
+}
+
+// Cluster - node of replicated leasers
+type Cluster struct {
+	Config
+
+	raft   *raft.Raft
+	spaces map[string]Space
+
+	sync.RWMutex
+	replicas map[string]*leaser.Leaser // committed state
+	views    map[string]*view
+}
+
+// stores - raft log, stable and snapshot stores in Dir or in memory
+func (c *Cluster) stores() (raft.LogStore, raft.StableStore, raft.SnapshotStore, error) {
+	if c.Dir == "" {
+		mem := raft.NewInmemStore()
+		return mem, mem, raft.NewInmemSnapshotStore(), nil
+	}
+
+	err := os.MkdirAll(c.Dir, 0755)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	db, err := raftboltdb.NewBoltStore(filepath.Join(c.Dir, "raft.db"))
+	if err != nil {
+		return nil, nil, nil, errors.New("Can't open raft log: " + err.Error())
+	}
+
+	snaps, err := raft.NewFileSnapshotStore(c.Dir, 2, os.Stderr)
+	if err != nil {
+		db.Close()
+		return nil, nil, nil, errors.New("Can't open raft snapshots: " + err.Error())
+	}
+
+	return db, db, snaps, nil
+}
+
+// newLeaser - empty leaser of address space
+func (c *Cluster) newLeaser(name string) (*leaser.Leaser, error) {
+	lsr, err := c.spaces[name].New()
+	if err != nil {
+		return nil, errors.New("Create leaser of address space '" + name + "' Error: " + err.Error())
+	}
+
+	return lsr, c.setup(name, lsr)
+}
+
+// setup - apply not replicated parameters to leaser
+func (c *Cluster) setup(name string, lsr *leaser.Leaser) error {
+	if c.spaces[name].Setup == nil {
+		return nil
+	}
+
+	return c.spaces[name].Setup(lsr)
+}
+
+// Spaces - leasers of all address spaces for GIPAM driver and leaser API
+func (c *Cluster) Spaces() map[string]gipam.LeaserInterface {
+	r := map[string]gipam.LeaserInterface{}
+	for name, v := range c.views {
+		r[name] = v.WithKey("")
+	}
+
+	return r
+}
+
+// Leader - ID of current leader, empty if it is unknown
+func (c *Cluster) Leader() string {
+	_, id := c.raft.LeaderWithID()
+	return string(id)
+}
+
+// IsLeader - this node is leader and serves requests
+func (c *Cluster) IsLeader() bool {
+	return c.raft.State() == raft.Leader
+}
+
+// Replica - committed state of address space in JSON
+func (c *Cluster) Replica(name string) ([]byte, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	lsr, ok := c.replicas[name]
+	if !ok {
+		return nil, errors.New("Unknown address space '" + name + "'")
+	}
+
+	data, _, err := lsr.Snapshot()
+	return data, err
+}
+
+// Shutdown - stop node
+func (c *Cluster) Shutdown() error {
+	return c.raft.Shutdown().Error()
+}
+
+// leaderAPI - leader API URL, empty if leader is unknown
+func (c *Cluster) leaderAPI() string {
+	id := c.Leader()
+	for _, p := range c.Peers {
+		if p.ID == id {
+			return p.API
+		}
+	}
+
+	return ""
+}
+
+// watch - leader serves requests by working copy of committed state, it is dropped when leadership is lost
+func (c *Cluster) watch(notify chan bool) {
+	for leader := range notify {
+		if !leader {
+			log.Println("Cluster node " + c.ID + " is follower")
+			for _, v := range c.views {
+				v.drop()
+			}
+
+			continue
+		}
+
+		log.Println("Cluster node " + c.ID + " is leader")
+		if err := c.promote(); err != nil {
+			log.Println("Cluster node "+c.ID+" can't take state:", err)
+		}
+	}
+}
+
+// promote - wait all committed entries are applied and copy state to working leasers
+func (c *Cluster) promote() error {
+	err := c.raft.Barrier(0).Error()
+	if err != nil {
+		return err
+	}
+
+	for _, v := range c.views {
+		if err := v.load(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// working - copy of committed state of address space, its mutations are written to raft log
+func (c *Cluster) working(name string) (*leaser.Leaser, error) {
+	data, err := c.Replica(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var lsr leaser.Leaser
+	err = lsr.UnmarshalJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.setup(name, &lsr); err != nil {
+		return nil, err
+	}
+
+	lsr.SetStore(&raftStore{c: c, name: name})
+	return &lsr, nil
+}
@@ -0,0 +1,257 @@
+package cluster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/archekb/gipam/pkg/leaser"
+	"github.com/archekb/gipam/pkg/remote"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+type node struct {
+	c     *Cluster
+	trans *raft.InmemTransport
+	api   *httptest.Server
+}
+
+// newNodes - cluster of n nodes over in-memory transports, every node has leaser API
+func newNodes(t *testing.T, n int) []*node {
+	remote.RetryDelay = 10 * time.Millisecond
+
+	nodes := make([]*node, n)
+	var peers []Peer
+	for i := range nodes {
+		nd := &node{}
+		var addr raft.ServerAddress
+		addr, nd.trans = raft.NewInmemTransport("")
+
+		// handler is set when cluster is started
+		var h http.Handler
+		nd.api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { h.ServeHTTP(w, r) }))
+		defer func(nd *node, h *http.Handler) {
+			*h = remote.NewServer(nd.c.Spaces(), "secret")
+		}(nd, &h)
+
+		nodes[i] = nd
+		peers = append(peers, Peer{ID: "node" + strconv.Itoa(i), Raft: string(addr), API: nd.api.URL})
+	}
+
+	for _, a := range nodes {
+		for _, b := range nodes {
+			if a != b {
+				a.trans.Connect(b.trans.LocalAddr(), b.trans)
+			}
+		}
+	}
+
+	spaces := map[string]Space{"local": {
+		New: func() (*leaser.Leaser, error) {
+			return leaser.New("fe80::/48", "192.168.0.0/16", 64, 24)
+		},
+		Setup: func(lsr *leaser.Leaser) error {
+			return lsr.SetGatewayPolicy("first")
+		},
+	}}
+
+	for i, nd := range nodes {
+		var err error
+		nd.c, err = New(Config{ID: peers[i].ID, Peers: peers, Token: "secret", Timeout: 100 * time.Millisecond}, nd.trans, spaces)
+		require.NoError(t, err)
+	}
+
+	return nodes
+}
+
+func stopNodes(nodes []*node) {
+	for _, nd := range nodes {
+		nd.c.Shutdown()
+		nd.api.Close()
+	}
+}
+
+// leader - wait leader among nodes
+func leader(t *testing.T, nodes []*node) *node {
+	for i := 0; i < 100; i++ {
+		for _, nd := range nodes {
+			if nd.c.IsLeader() {
+				return nd
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatal("Leader isn't elected")
+	return nil
+}
+
+// converged - wait same committed state on all nodes
+func converged(t *testing.T, nodes []*node) string {
+	var want []byte
+	for i := 0; i < 100; i++ {
+		want, _ = nodes[0].c.Replica("local")
+		same := true
+		for _, nd := range nodes[1:] {
+			got, _ := nd.c.Replica("local")
+			same = same && string(got) == string(want)
+		}
+
+		if same {
+			return string(want)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatal("State of nodes differs")
+	return ""
+}
+
+func TestClusterReplication(t *testing.T) {
+	nodes := newNodes(t, 3)
+	defer stopNodes(nodes)
+
+	ld := leader(t, nodes)
+	lsr := ld.c.Spaces()["local"]
+
+	id, pool, err := lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.0/24", pool)
+
+	addr, err := lsr.GetAddress(id, "02:42:c0:a8:00:02")
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.1/24", addr)
+
+	state := converged(t, nodes)
+	require.Contains(t, state, `"192.168.0.0/24"`)
+
+	// follower forwards driver requests to leader
+	var follower *node
+	for _, nd := range nodes {
+		if nd != ld {
+			follower = nd
+		}
+	}
+
+	_, pool, err = follower.c.Spaces()["local"].GetBlock(4, 0)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.1.0/24", pool)
+
+	// follower redirects API requests to leader
+	c, err := remote.NewClient(follower.api.URL, "secret", "local")
+	require.NoError(t, err)
+	_, pool, err = c.GetBlock(4, 0)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.2.0/24", pool)
+
+	converged(t, nodes)
+}
+
+// TestClusterFailover - leader is cut off while allocation, new leader never gives acknowledged block again
+func TestClusterFailover(t *testing.T) {
+	nodes := newNodes(t, 3)
+	defer stopNodes(nodes)
+
+	old := leader(t, nodes)
+	_, first, err := old.c.Spaces()["local"].GetBlock(4, 0)
+	require.NoError(t, err)
+	converged(t, nodes)
+
+	// partition: allocation on old leader can't be committed
+	var rest []*node
+	old.trans.DisconnectAll()
+	for _, nd := range nodes {
+		if nd != old {
+			nd.trans.Disconnect(old.trans.LocalAddr())
+			rest = append(rest, nd)
+		}
+	}
+
+	_, _, err = old.c.Spaces()["local"].GetBlock(4, 0)
+	require.Equal(t, remote.ErrUnavailable, err)
+
+	ld := leader(t, rest)
+	_, second, err := ld.c.Spaces()["local"].GetBlock(4, 0)
+	require.NoError(t, err)
+	require.NotEqual(t, first, second)
+
+	// old leader joins as follower and takes committed state
+	for _, a := range nodes {
+		for _, b := range nodes {
+			if a != b {
+				a.trans.Connect(b.trans.LocalAddr(), b.trans)
+			}
+		}
+	}
+
+	state := converged(t, nodes)
+	require.Contains(t, state, `"`+first+`"`)
+	require.Contains(t, state, `"`+second+`"`)
+	require.False(t, old.c.IsLeader() && ld.c.IsLeader())
+
+	// allocation continues on any leader without overlap
+	_, third, err := leader(t, nodes).c.Spaces()["local"].GetBlock(4, 0)
+	require.NoError(t, err)
+	require.NotEqual(t, first, third)
+	require.NotEqual(t, second, third)
+}
+
+// TestClusterFailoverKey - request is committed by leader which is lost before answer, retry with the same key
+// on new leader gets the same block and nothing is allocated twice
+func TestClusterFailoverKey(t *testing.T) {
+	nodes := newNodes(t, 3)
+	defer stopNodes(nodes)
+
+	old := leader(t, nodes)
+	c, err := remote.NewClient(old.api.URL, "secret", "local")
+	require.NoError(t, err)
+	c.Key = "k1"
+
+	id, pool, err := c.GetBlock(4, 0)
+	require.NoError(t, err)
+	converged(t, nodes)
+
+	// answer is lost with old leader
+	var rest []*node
+	old.trans.DisconnectAll()
+	for _, nd := range nodes {
+		if nd != old {
+			nd.trans.Disconnect(old.trans.LocalAddr())
+			rest = append(rest, nd)
+		}
+	}
+
+	ld := leader(t, rest)
+	c, err = remote.NewClient(ld.api.URL, "secret", "local")
+	require.NoError(t, err)
+	c.Key = "k1"
+
+	retryID, retryPool, err := c.GetBlock(4, 0)
+	require.NoError(t, err)
+	require.Equal(t, id, retryID)
+	require.Equal(t, pool, retryPool)
+
+	// driver on new leader keeps the key too
+	retryID, _, err = ld.c.Spaces()["local"].(remote.Idempotent).WithKey("k1").GetBlock(4, 0)
+	require.NoError(t, err)
+	require.Equal(t, id, retryID)
+
+	data, err := ld.c.Replica("local")
+	require.NoError(t, err)
+
+	var replica leaser.Leaser
+	require.NoError(t, replica.UnmarshalJSON(data))
+	require.Len(t, replica.Allocated, 1)
+
+	// new key allocates new block
+	c.Key = ""
+	_, next, err := c.GetBlock(4, 0)
+	require.NoError(t, err)
+	require.NotEqual(t, pool, next)
+}
@@ -0,0 +1,180 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/archekb/gipam/pkg/leaser"
+
+	"github.com/hashicorp/raft"
+)
+
+// ApplyTimeout - how long mutation waits to be queued to raft log
+var ApplyTimeout = 10 * time.Second
+
+// command - raft log entry, journal entry of address space
+type command struct {
+	Space string               `json:"space"`
+	Entry *leaser.JournalEntry `json:"entry"`
+}
+
+// fsm - raft state machine, it applies committed journal entries to replicas
+type fsm Cluster
+
+// Apply implements raft.FSM, returns error of entry or saved result if request with idempotency key of entry is already applied
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	var cmd command
+	err := json.Unmarshal(l.Data, &cmd)
+	if err != nil {
+		return err
+	}
+
+	f.RLock()
+	defer f.RUnlock()
+
+	lsr, ok := f.replicas[cmd.Space]
+	if !ok || cmd.Entry == nil {
+		return errors.New("Unknown address space '" + cmd.Space + "' of raft log entry")
+	}
+
+	// entry of stale working leaser is skipped by all replicas, Seq is changed only here
+	if cmd.Entry.Seq != lsr.Seq+1 {
+		return errors.New("Raft log entry " + strconv.FormatUint(cmd.Entry.Seq, 10) + " doesn't continue state " + strconv.FormatUint(lsr.Seq, 10) + ", it is skipped")
+	}
+
+	// mutation of retried request is skipped, so block or address isn't allocated twice
+	if r, ok := lsr.Result(cmd.Entry.Key); ok {
+		return r
+	}
+
+	return lsr.Replay([]*leaser.JournalEntry{cmd.Entry})
+}
+
+// Snapshot implements raft.FSM, it is state of all replicas
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	f.RLock()
+	defer f.RUnlock()
+
+	s := snapshot{}
+	for name, lsr := range f.replicas {
+		data, _, err := lsr.Snapshot()
+		if err != nil {
+			return nil, err
+		}
+
+		s[name] = data
+	}
+
+	return s, nil
+}
+
+// Restore implements raft.FSM, replicas are replaced by snapshot
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	var s snapshot
+	err := json.NewDecoder(rc).Decode(&s)
+	if err != nil {
+		return err
+	}
+
+	c := (*Cluster)(f)
+	replicas := map[string]*leaser.Leaser{}
+	for name := range c.spaces {
+		data, ok := s[name]
+		if !ok {
+			// address space is added after snapshot
+			lsr, err := c.newLeaser(name)
+			if err != nil {
+				return err
+			}
+
+			replicas[name] = lsr
+			continue
+		}
+
+		var lsr leaser.Leaser
+		if err := lsr.UnmarshalJSON(data); err != nil {
+			return errors.New("Can't restore address space '" + name + "' from snapshot: " + err.Error())
+		}
+
+		if err := c.setup(name, &lsr); err != nil {
+			return err
+		}
+
+		replicas[name] = &lsr
+	}
+
+	f.Lock()
+	f.replicas = replicas
+	f.Unlock()
+
+	return nil
+}
+
+// snapshot - state of replicas by address space
+type snapshot map[string]json.RawMessage
+
+// Persist implements raft.FSMSnapshot
+func (s snapshot) Persist(sink raft.SnapshotSink) error {
+	err := json.NewEncoder(sink).Encode(s)
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	return sink.Close()
+}
+
+// Release implements raft.FSMSnapshot
+func (s snapshot) Release() {}
+
+// raftStore - leaser store of leader, mutation is acknowledged when it is committed to raft log
+type raftStore struct {
+	c    *Cluster
+	name string
+}
+
+// Load - working leaser is copied from replica, it is never loaded from store
+func (rs *raftStore) Load() (*leaser.Leaser, error) {
+	return nil, leaser.ErrNoState
+}
+
+// Save - state is saved by raft snapshots
+func (rs *raftStore) Save(*leaser.Leaser) error {
+	return nil
+}
+
+// Update - commit entry to raft log, entry which isn't applied to replica marks working leaser as stale.
+// Entry of request which is already applied is skipped, retry gets saved result from state copied again.
+func (rs *raftStore) Update(e *leaser.JournalEntry) error {
+	data, err := json.Marshal(&command{Space: rs.name, Entry: e})
+	if err != nil {
+		return err
+	}
+
+	f := rs.c.raft.Apply(data, ApplyTimeout)
+	err = f.Error()
+	if err == nil {
+		switch r := f.Response().(type) {
+		case error:
+			err = r
+		case *leaser.Result:
+			err = errors.New("Request " + e.Key + " is already applied")
+		}
+	}
+
+	if err != nil {
+		rs.c.views[rs.name].stale()
+	}
+
+	return err
+}
+
+// Close - nothing to close
+func (rs *raftStore) Close() error {
+	return nil
+}
@@ -0,0 +1,218 @@
+package cluster
+
+import (
+	"sync"
+
+	"github.com/archekb/gipam/pkg/gipam"
+	"github.com/archekb/gipam/pkg/leaser"
+	"github.com/archekb/gipam/pkg/remote"
+)
+
+// view - leaser of address space on cluster node, implements gipam.LeaserInterface
+type view struct {
+	c    *Cluster
+	name string
+
+	sync.Mutex
+	lsr     *leaser.Leaser // working copy of leader, nil on follower
+	isStale bool           // mutation of working copy wasn't committed, it must be copied again
+}
+
+// load - copy committed state to working leaser
+func (v *view) load() error {
+	lsr, err := v.c.working(v.name)
+	if err != nil {
+		return err
+	}
+
+	v.Lock()
+	defer v.Unlock()
+
+	v.lsr = lsr
+	v.isStale = false
+	return nil
+}
+
+// drop - leadership is lost, requests are forwarded to new leader
+func (v *view) drop() {
+	v.Lock()
+	defer v.Unlock()
+
+	v.lsr = nil
+	v.isStale = false
+}
+
+// stale - working leaser differs from committed state
+func (v *view) stale() {
+	v.Lock()
+	defer v.Unlock()
+
+	v.isStale = true
+}
+
+// leaser - working leaser of leader or client of leader API, calls of request with idempotency key keep it,
+// so the key is written to raft log with mutation and new leader gives the same result for it
+func (v *view) leaser(key string) (gipam.LeaserInterface, error) {
+	if !v.c.IsLeader() {
+		url := v.c.leaderAPI()
+		if url == "" {
+			return nil, remote.ErrUnavailable
+		}
+
+		c, err := remote.NewClient(url, v.c.Token, v.name)
+		if err != nil {
+			return nil, err
+		}
+
+		// retry after failover goes to new leader
+		c.Leader = v.c.leaderAPI
+		c.Key = key
+		return c, nil
+	}
+
+	v.Lock()
+	stale := v.isStale || v.lsr == nil
+	v.Unlock()
+
+	// uncommitted mutation can be committed later, so state is taken from replica again
+	if stale {
+		if err := v.c.raft.Barrier(ApplyTimeout).Error(); err != nil {
+			return nil, remote.ErrUnavailable
+		}
+
+		if err := v.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	v.Lock()
+	defer v.Unlock()
+
+	if key != "" {
+		return v.lsr.WithKey(key), nil
+	}
+
+	return v.lsr, nil
+}
+
+// result - error of mutation which wasn't committed can be retried on new leader
+func (v *view) result(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	v.Lock()
+	defer v.Unlock()
+
+	if v.isStale || v.lsr == nil {
+		return remote.ErrUnavailable
+	}
+
+	return err
+}
+
+// Redirect implements remote.Redirector, API requests to follower are redirected to leader
+func (v *view) Redirect() (string, bool) {
+	if v.c.IsLeader() {
+		return "", false
+	}
+
+	url := v.c.leaderAPI()
+	return url, url != ""
+}
+
+// WithKey implements remote.Idempotent
+func (v *view) WithKey(key string) gipam.LeaserInterface {
+	return &keyed{view: v, key: key}
+}
+
+// keyed - calls of leaser of address space with idempotency key, empty key is for calls without it
+type keyed struct {
+	*view
+	key string
+}
+
+// GetBlock implements gipam.LeaserInterface
+func (k *keyed) GetBlock(ver uint8, prefix uint) (string, string, error) {
+	lsr, err := k.leaser(k.key)
+	if err != nil {
+		return "", "", err
+	}
+
+	id, pool, err := lsr.GetBlock(ver, prefix)
+	return id, pool, k.result(err)
+}
+
+// ReserveBlock implements gipam.LeaserInterface
+func (k *keyed) ReserveBlock(pool, subPool string) (string, string, error) {
+	lsr, err := k.leaser(k.key)
+	if err != nil {
+		return "", "", err
+	}
+
+	id, pool, err := lsr.ReserveBlock(pool, subPool)
+	return id, pool, k.result(err)
+}
+
+// ReturnBlock implements gipam.LeaserInterface
+func (k *keyed) ReturnBlock(id string) error {
+	lsr, err := k.leaser(k.key)
+	if err != nil {
+		return err
+	}
+
+	return k.result(lsr.ReturnBlock(id))
+}
+
+// GetAddress implements gipam.LeaserInterface
+func (k *keyed) GetAddress(id, mac string) (string, error) {
+	lsr, err := k.leaser(k.key)
+	if err != nil {
+		return "", err
+	}
+
+	addr, err := lsr.GetAddress(id, mac)
+	return addr, k.result(err)
+}
+
+// ReserveAddress implements gipam.LeaserInterface
+func (k *keyed) ReserveAddress(id, address, mac string) (string, error) {
+	lsr, err := k.leaser(k.key)
+	if err != nil {
+		return "", err
+	}
+
+	addr, err := lsr.ReserveAddress(id, address, mac)
+	return addr, k.result(err)
+}
+
+// GetGateway implements gipam.LeaserInterface
+func (k *keyed) GetGateway(id, address string) (string, error) {
+	lsr, err := k.leaser(k.key)
+	if err != nil {
+		return "", err
+	}
+
+	addr, err := lsr.GetGateway(id, address)
+	return addr, k.result(err)
+}
+
+// ReturnAddress implements gipam.LeaserInterface
+func (k *keyed) ReturnAddress(id, address string) error {
+	lsr, err := k.leaser(k.key)
+	if err != nil {
+		return err
+	}
+
+	return k.result(lsr.ReturnAddress(id, address))
+}
+
+// ExcludeAddresses implements gipam.LeaserInterface
+func (k *keyed) ExcludeAddresses(id string, list []string) error {
+	lsr, err := k.leaser(k.key)
+	if err != nil {
+		return err
+	}
+
+	return k.result(lsr.ExcludeAddresses(id, list))
+}
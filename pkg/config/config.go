@@ -3,17 +3,44 @@ package config
 import (
 	"errors"
 	"flag"
+	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
-// New - create new config from defaults, env and flags, after than check parameter on exists. No validate, only exists!
+// New - create new config from defaults, config file, env and flags, after than check parameter on exists. No validate, only exists!
 func New() (*Config, error) {
-	var cnf Config = Config{}
+	return load(os.Args[1:], flag.ExitOnError)
+}
+
+// Reload - read config file, env and the same flags again
+func (cnf *Config) Reload() (*Config, error) {
+	return load(cnf.args, flag.ContinueOnError)
+}
+
+func load(args []string, handling flag.ErrorHandling) (*Config, error) {
+	var cnf Config = Config{args: args}
 
 	cnf.setDefaults()
+	if cnf.Path = configPath(args); cnf.Path != "" {
+		f, err := LoadFile(cnf.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		cnf.applyFile(f)
+	}
+
 	cnf.parseEnv()
-	cnf.parceFlags()
+	if err := cnf.parceFlags(flag.NewFlagSet(os.Args[0], handling), args); err != nil {
+		return nil, err
+	}
+
+	if len(cnf.Cluster.Peers) == 0 {
+		cnf.Cluster.Peers = cnf.Cluster.filePeers
+	}
 
 	err := cnf.Check()
 	if err != nil {
@@ -23,68 +50,348 @@ func New() (*Config, error) {
 	return &cnf, nil
 }
 
+// Policies of conflict between configured main pools and restored state (-conflict)
+const (
+	PreferState  = "prefer-state"  // pools of state are used, config is only compared
+	PreferConfig = "prefer-config" // pools of config are used if allocated blocks fit them
+	Fail         = "fail"          // driver doesn't start
+)
+
 // Config - contains Server and Leases config
 type Config struct {
+	Path string // config file
+
 	Server struct {
-		Address string
+		Address  string
+		API      string
+		Token    string
+		Insecure bool // leaser API is served without token
+		TLSCert  string
+		TLSKey   string
+		Remote   string
+
+		Admin      string
+		AdminToken string
+
+		Metrics string
 	}
 
 	Lease struct {
-		File   string
-		IPv6   string
-		IPv6AB uint
-		IPv4   string
-		IPv4AB uint
+		File        string
+		Generations uint
+		Store       string
+		MigrateFrom string
+		IPv6        string
+		IPv6AB      uint
+		IPv4        string
+		IPv4AB      uint
+
+		Gateway      string
+		MACRetention time.Duration
+		AddressHold  time.Duration // period while returned address isn't given again
+		BlockHold    time.Duration // period while returned block isn't given again
+		Exclude      string
+		V6Anycast    bool
+
+		Conflict   string // policy of conflict between configured main pools and restored state
+		DropBlocks bool   // confirm release of allocated blocks which are out of configured pools
 	}
+
+	Space struct {
+		Local  string
+		Global string
+		List   Spaces  // spaces of flags
+		File   []Space // spaces of config file
+	}
+
+	Docker struct {
+		Host      string
+		Driver    string
+		Reconcile time.Duration
+		Fix       bool
+		Fresh     bool
+	}
+
+	Cluster struct {
+		ID    string
+		Bind  string
+		Dir   string
+		Peers Peers
+
+		filePeers Peers // peers of config file are used if env and flags have no peers
+	}
+
+	explicit map[string]bool // parameters which are set by env or flags
+	args     []string
 }
 
 func (cnf *Config) setDefaults() {
 	cnf.Lease.File = "lease.json"
+	cnf.Lease.Generations = 3
+	cnf.Lease.Store = "json"
 	cnf.Lease.IPv6 = ""
 	cnf.Lease.IPv6AB = 64
 	cnf.Lease.IPv4 = ""
 	cnf.Lease.IPv4AB = 24
+	cnf.Lease.Gateway = "first"
+	cnf.Lease.Conflict = PreferState
+
+	cnf.Space.Local = "local"
+	cnf.Space.Global = ""
+
+	cnf.Docker.Host = "unix:///var/run/docker.sock"
+	cnf.Docker.Driver = "gipam"
+
+	cnf.Cluster.Dir = "raft"
 }
 
 func (cnf *Config) parseEnv() {
+	for _, name := range []string{"v6ab", "v4ab"} {
+		if os.Getenv("GIPAM_"+strings.ToUpper(name)) != "" {
+			cnf.setExplicit(name)
+		}
+	}
+
 	// Server config
 	cnf.Server.Address = getEnvParam("GIPAM_ADDRESS", cnf.Server.Address).(string)
+	cnf.Server.API = getEnvParam("GIPAM_API", cnf.Server.API).(string)
+	cnf.Server.Token = getEnvParam("GIPAM_TOKEN", cnf.Server.Token).(string)
+	cnf.Server.Insecure = getEnvParam("GIPAM_INSECURE", cnf.Server.Insecure).(bool)
+	cnf.Server.TLSCert = getEnvParam("GIPAM_TLS_CERT", cnf.Server.TLSCert).(string)
+	cnf.Server.TLSKey = getEnvParam("GIPAM_TLS_KEY", cnf.Server.TLSKey).(string)
+	cnf.Server.Remote = getEnvParam("GIPAM_REMOTE", cnf.Server.Remote).(string)
+	cnf.Server.Admin = getEnvParam("GIPAM_ADMIN", cnf.Server.Admin).(string)
+	cnf.Server.AdminToken = getEnvParam("GIPAM_ADMIN_TOKEN", cnf.Server.AdminToken).(string)
+	cnf.Server.Metrics = getEnvParam("GIPAM_METRICS", cnf.Server.Metrics).(string)
 
 	// Lease config
 	cnf.Lease.File = getEnvParam("GIPAM_FILE", cnf.Lease.File).(string)
+	cnf.Lease.Generations = getEnvParam("GIPAM_FILE_GENERATIONS", cnf.Lease.Generations).(uint)
+	cnf.Lease.Store = getEnvParam("GIPAM_STORE", cnf.Lease.Store).(string)
 	cnf.Lease.IPv6 = getEnvParam("GIPAM_V6", cnf.Lease.IPv6).(string)
 	cnf.Lease.IPv6AB = getEnvParam("GIPAM_V6AB", cnf.Lease.IPv6AB).(uint)
 	cnf.Lease.IPv4 = getEnvParam("GIPAM_V4", cnf.Lease.IPv4).(string)
 	cnf.Lease.IPv4AB = getEnvParam("GIPAM_V4AB", cnf.Lease.IPv4AB).(uint)
+	cnf.Lease.Gateway = getEnvParam("GIPAM_GATEWAY", cnf.Lease.Gateway).(string)
+	cnf.Lease.MACRetention = getEnvParam("GIPAM_MAC_RETENTION", cnf.Lease.MACRetention).(time.Duration)
+	cnf.Lease.AddressHold = getEnvParam("GIPAM_ADDRESS_HOLD", cnf.Lease.AddressHold).(time.Duration)
+	cnf.Lease.BlockHold = getEnvParam("GIPAM_BLOCK_HOLD", cnf.Lease.BlockHold).(time.Duration)
+	cnf.Lease.Exclude = getEnvParam("GIPAM_EXCLUDE", cnf.Lease.Exclude).(string)
+	cnf.Lease.V6Anycast = getEnvParam("GIPAM_V6_ANYCAST", cnf.Lease.V6Anycast).(bool)
+	cnf.Lease.Conflict = getEnvParam("GIPAM_CONFLICT", cnf.Lease.Conflict).(string)
+	cnf.Lease.DropBlocks = getEnvParam("GIPAM_DROP_BLOCKS", cnf.Lease.DropBlocks).(bool)
+
+	// Address spaces config
+	cnf.Space.Local = getEnvParam("GIPAM_LOCAL", cnf.Space.Local).(string)
+	cnf.Space.Global = getEnvParam("GIPAM_GLOBAL", cnf.Space.Global).(string)
+	for _, s := range strings.Split(getEnvParam("GIPAM_SPACES", "").(string), ";") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+
+		if err := cnf.Space.List.Set(s); err != nil {
+			log.Println("GIPAM_SPACES:", err)
+		}
+	}
+
+	// Docker config
+	cnf.Docker.Host = getEnvParam("GIPAM_DOCKER", cnf.Docker.Host).(string)
+	cnf.Docker.Driver = getEnvParam("GIPAM_DRIVER", cnf.Docker.Driver).(string)
+	cnf.Docker.Reconcile = getEnvParam("GIPAM_RECONCILE", cnf.Docker.Reconcile).(time.Duration)
+	cnf.Docker.Fix = getEnvParam("GIPAM_RECONCILE_FIX", cnf.Docker.Fix).(bool)
+	cnf.Docker.Fresh = getEnvParam("GIPAM_FRESH", cnf.Docker.Fresh).(bool)
+
+	// Cluster config
+	cnf.Cluster.ID = getEnvParam("GIPAM_CLUSTER_ID", cnf.Cluster.ID).(string)
+	cnf.Cluster.Bind = getEnvParam("GIPAM_CLUSTER_BIND", cnf.Cluster.Bind).(string)
+	cnf.Cluster.Dir = getEnvParam("GIPAM_CLUSTER_DIR", cnf.Cluster.Dir).(string)
+	for _, p := range strings.Split(getEnvParam("GIPAM_CLUSTER_PEERS", "").(string), ";") {
+		if strings.TrimSpace(p) == "" {
+			continue
+		}
+
+		if err := cnf.Cluster.Peers.Set(p); err != nil {
+			log.Println("GIPAM_CLUSTER_PEERS:", err)
+		}
+	}
+}
+
+func (cnf *Config) parceFlags(fs *flag.FlagSet, args []string) error {
+	cnf.defineFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	fs.Visit(func(f *flag.Flag) { cnf.setExplicit(f.Name) })
+	return nil
 }
 
-func (cnf *Config) parceFlags() {
+// defineFlags - add flags of config to flag set, current values of config are defaults of flags
+func (cnf *Config) defineFlags(fs *flag.FlagSet) {
 	// Server config
-	flag.StringVar(&cnf.Server.Address, "address", cnf.Server.Address, "Server address and port to listen 'host:port' or ':port'. If empty used UNIX socket.")
+	fs.StringVar(&cnf.Server.Address, "address", cnf.Server.Address, "Server address and port to listen 'host:port' or ':port'. If empty used UNIX socket.")
+	fs.StringVar(&cnf.Server.API, "api", cnf.Server.API, "Address and port of leaser API in 'gipam server' mode. Example: :8443")
+	fs.StringVar(&cnf.Server.Token, "token", cnf.Server.Token, "Bearer token of leaser API, it is required by server and sent by driver with -remote")
+	fs.BoolVar(&cnf.Server.Insecure, "insecure", cnf.Server.Insecure, "Serve leaser API without token, every client can allocate and return blocks and addresses")
+	fs.StringVar(&cnf.Server.TLSCert, "tls-cert", cnf.Server.TLSCert, "TLS certificate file of leaser API, if empty API uses plain HTTP")
+	fs.StringVar(&cnf.Server.TLSKey, "tls-key", cnf.Server.TLSKey, "TLS key file of leaser API")
+	fs.StringVar(&cnf.Server.Remote, "remote", cnf.Server.Remote, "URL of gipam server, driver gets blocks and addresses from it instead of local leaser. Servers of cluster can be listed by comma, retry goes to next one. Example: https://ipam.example.com:8443")
+	fs.StringVar(&cnf.Server.Admin, "admin", cnf.Server.Admin, "Admin API address and port 'host:port' or path of UNIX socket. If empty admin API is disabled. Example: /run/gipam/admin.sock")
+	fs.StringVar(&cnf.Server.AdminToken, "admin-token", cnf.Server.AdminToken, "Bearer token of admin API, if empty admin API is available without authentication")
+	fs.StringVar(&cnf.Server.Metrics, "metrics", cnf.Server.Metrics, "Address and port of Prometheus /metrics endpoint. If empty metrics are disabled. Example: :9153")
 
 	// Lease config
-	flag.StringVar(&cnf.Lease.File, "file", cnf.Lease.File, "Lease file uses for save state to file and restore it after restart")
-	flag.StringVar(&cnf.Lease.IPv6, "v6", cnf.Lease.IPv6, "Main IPv6 address pool. Example: fe80::/56")
-	flag.UintVar(&cnf.Lease.IPv6AB, "v6ab", cnf.Lease.IPv6AB, "Mask of IPv6 allocated block. Example: 64")
-	flag.StringVar(&cnf.Lease.IPv4, "v4", cnf.Lease.IPv4, "Main IPv4 address pool. Example: 192.168.0.0/16")
-	flag.UintVar(&cnf.Lease.IPv4AB, "v4ab", cnf.Lease.IPv4AB, "Mask of IPv4 allocated block. Example: 24")
+	fs.StringVar(&cnf.Lease.File, "file", cnf.Lease.File, "Lease file uses for save state to file and restore it after restart")
+	fs.UintVar(&cnf.Lease.Generations, "file-generations", cnf.Lease.Generations, "Count of previous lease files (lease.json.1 ... lease.json.N), they are used if lease file is broken")
+	fs.StringVar(&cnf.Lease.Store, "store", cnf.Lease.Store, "State store: 'json' file, 'bolt' or 'sqlite' database, -file is path of database")
+	fs.StringVar(&cnf.Lease.MigrateFrom, "migrate-from", cnf.Lease.MigrateFrom, "Copy state of all address spaces from another store to -store and exit. Example: json:lease.json")
+	fs.StringVar(&cnf.Lease.IPv6, "v6", cnf.Lease.IPv6, "Main IPv6 address pool. Example: fe80::/56")
+	fs.UintVar(&cnf.Lease.IPv6AB, "v6ab", cnf.Lease.IPv6AB, "Mask of IPv6 allocated block. Example: 64")
+	fs.StringVar(&cnf.Lease.IPv4, "v4", cnf.Lease.IPv4, "Main IPv4 address pool. Example: 192.168.0.0/16")
+	fs.UintVar(&cnf.Lease.IPv4AB, "v4ab", cnf.Lease.IPv4AB, "Mask of IPv4 allocated block. Example: 24")
+	fs.StringVar(&cnf.Lease.Gateway, "gateway", cnf.Lease.Gateway, "Gateway address of allocated block: 'first', 'last' usable address or offset from network address. Example: 254")
+	fs.DurationVar(&cnf.Lease.MACRetention, "mac-retention", cnf.Lease.MACRetention, "Period while released address is kept for container with same MAC address, 0 disables it. Example: 24h")
+	fs.DurationVar(&cnf.Lease.AddressHold, "address-hold", cnf.Lease.AddressHold, "Period while returned address isn't given to other container, held addresses are reused in order of return. Example: 5m")
+	fs.DurationVar(&cnf.Lease.BlockHold, "block-hold", cnf.Lease.BlockHold, "Period while returned block isn't given to other network, held blocks are reused in order of return. Example: 1h")
+	fs.StringVar(&cnf.Lease.Exclude, "exclude", cnf.Lease.Exclude, "Addresses of main pools which are never given to containers: ip, network or range. Example: 192.168.0.1,192.168.0.10-192.168.0.20,fe80::/120")
+	fs.BoolVar(&cnf.Lease.V6Anycast, "v6-anycast", cnf.Lease.V6Anycast, "Give IPv6 subnet-router anycast address (network address of block) to containers, by default it is reserved")
+	fs.StringVar(&cnf.Lease.Conflict, "conflict", cnf.Lease.Conflict, "Policy if configured main pools differ from restored state: 'prefer-state', 'prefer-config' or 'fail'")
+	fs.BoolVar(&cnf.Lease.DropBlocks, "drop-blocks", cnf.Lease.DropBlocks, "Confirm that -conflict prefer-config releases allocated blocks which are out of configured pools")
 
-	flag.Parse()
+	// Address spaces config
+	fs.StringVar(&cnf.Space.Local, "local", cnf.Space.Local, "Name of local default address space, it uses main pools from -v6 and -v4")
+	fs.StringVar(&cnf.Space.Global, "global", cnf.Space.Global, "Name of global default address space. If empty local address space is used")
+	fs.Var(&cnf.Space.List, "space", "Additional address space, can be repeated. Example: global,v6=2001:db8::/48,v6ab=64,v4=203.0.113.0/24,v4ab=28")
+
+	// Docker config
+	fs.StringVar(&cnf.Docker.Host, "docker", cnf.Docker.Host, "Docker Engine API address: 'unix:///path', 'tcp://host:port' or URL")
+	fs.StringVar(&cnf.Docker.Driver, "driver", cnf.Docker.Driver, "Name of this IPAM driver in Docker networks")
+	fs.DurationVar(&cnf.Docker.Reconcile, "reconcile", cnf.Docker.Reconcile, "Period of reconciliation of leases with networks and containers of Docker, 0 disables it. Example: 10m")
+	fs.BoolVar(&cnf.Docker.Fix, "reconcile-fix", cnf.Docker.Fix, "Release orphan blocks and addresses and adopt missing ones, else drift is only logged")
+	fs.BoolVar(&cnf.Docker.Fresh, "fresh", cnf.Docker.Fresh, "Start with empty state if state of address space is lost, by default it is rebuilt from networks of Docker")
+
+	// Cluster config
+	fs.StringVar(&cnf.Cluster.ID, "cluster-id", cnf.Cluster.ID, "ID of this node in cluster of replicated leasers, it must be one of -peer. If empty cluster mode is disabled")
+	fs.StringVar(&cnf.Cluster.Bind, "cluster-bind", cnf.Cluster.Bind, "Address and port of raft transport to listen, if empty raft address of this node peer is used")
+	fs.StringVar(&cnf.Cluster.Dir, "cluster-dir", cnf.Cluster.Dir, "Directory of raft log and snapshots")
+	fs.Var(&cnf.Cluster.Peers, "peer", "Cluster member with this node, can be repeated. Example: node1,raft=10.0.0.1:7000,api=https://10.0.0.1:8443")
+
+	// config file is read before flags
+	fs.String("config", cnf.Path, "Config file (YAML) with main pools of address spaces, env and flags override it")
+}
+
+func (cnf *Config) setExplicit(name string) {
+	if cnf.explicit == nil {
+		cnf.explicit = map[string]bool{}
+	}
+
+	cnf.explicit[name] = true
 }
 
 // Check - check config parametrs
 func (cnf *Config) Check() error {
 	// no ip alocated blocks and no leases filename (or file must be Wipe)
-	if cnf.Lease.IPv6 == "" && cnf.Lease.IPv4 == "" && cnf.Lease.File == "" {
+	spaces := cnf.AddressSpaces()
+	if len(spaces[0].Pools) == 0 && cnf.Lease.File == "" {
 		return errors.New("No leases configuration")
 	}
 
+	if (cnf.Server.TLSCert == "") != (cnf.Server.TLSKey == "") {
+		return errors.New("TLS certificate and key must be set together")
+	}
+
+	switch cnf.Lease.Store {
+	case "json", "bolt", "sqlite":
+	default:
+		return errors.New("Unknown store '" + cnf.Lease.Store + "'")
+	}
+
+	switch cnf.Lease.Conflict {
+	case PreferState, PreferConfig, Fail:
+	default:
+		return errors.New("Unknown conflict policy '" + cnf.Lease.Conflict + "', it can be '" + PreferState + "', '" + PreferConfig + "' or '" + Fail + "'")
+	}
+
+	if cnf.Lease.MigrateFrom != "" {
+		if _, _, err := cnf.Migration(cnf.Space.Local); err != nil {
+			return err
+		}
+	}
+
+	names := map[string]bool{}
+	files := map[string]bool{}
+	for k, s := range spaces {
+		if !isSpaceName(s.Name) {
+			return errors.New("Wrong address space name '" + s.Name + "'")
+		}
+
+		if err := s.validate(); err != nil {
+			return err
+		}
+
+		// the same network in two address spaces is given twice
+		for _, other := range spaces[:k] {
+			for _, a := range s.Pools {
+				for _, b := range other.Pools {
+					if overlaps(a.CIDR, b.CIDR) {
+						return errors.New("Pool '" + a.Name + "' (" + a.CIDR + ") of address space '" + s.Name + "' overlaps with pool '" + b.Name + "' (" + b.CIDR + ") of address space '" + other.Name + "'")
+					}
+				}
+			}
+		}
+
+		if names[s.Name] {
+			return errors.New("Address space '" + s.Name + "' is defined twice")
+		}
+
+		if files[s.File] {
+			return errors.New("Lease file '" + s.File + "' of address space '" + s.Name + "' is used twice")
+		}
+
+		names[s.Name] = true
+		files[s.File] = true
+	}
+
+	if cnf.Space.Global != "" && !names[cnf.Space.Global] {
+		return errors.New("Global address space '" + cnf.Space.Global + "' is not defined")
+	}
+
+	if cnf.Cluster.ID != "" {
+		if cnf.Server.Remote != "" {
+			return errors.New("Cluster node can't use remote server")
+		}
+
+		if _, ok := cnf.Cluster.Peers.Find(cnf.Cluster.ID); !ok {
+			return errors.New("Cluster node '" + cnf.Cluster.ID + "' is not in peers")
+		}
+	}
+
 	return nil
 }
 
-// Help - print flag defaults
+// Migration - source store kind and file of address space for -migrate-from 'kind:file',
+// file of additional space is file with space name suffix like lease file
+func (cnf *Config) Migration(space string) (string, string, error) {
+	kv := strings.SplitN(cnf.Lease.MigrateFrom, ":", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return "", "", errors.New("Wrong migration source '" + cnf.Lease.MigrateFrom + "', it must be 'kind:file'")
+	}
+
+	if space == cnf.Space.Local {
+		return kv[0], kv[1], nil
+	}
+
+	return kv[0], spaceFile(kv[1], space), nil
+}
+
+// Help - print flag defaults, flag set is made for every call, so it isn't shared with loading of config
 func Help() {
-	flag.PrintDefaults()
+	var cnf Config
+	cnf.setDefaults()
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	cnf.defineFlags(fs)
+	fs.PrintDefaults()
 }
 
 // utils
@@ -106,7 +413,7 @@ func getEnvParam(name string, def interface{}) interface{} {
 
 	case uint:
 		if r, err := strconv.ParseUint(env, 10, 0); err == nil { // return uint with default of system bitsize 32 or 64
-			return r
+			return uint(r)
 		}
 		return def
 
@@ -115,6 +422,12 @@ func getEnvParam(name string, def interface{}) interface{} {
 			return r
 		}
 		return def
+
+	case time.Duration:
+		if r, err := time.ParseDuration(env); err == nil {
+			return r
+		}
+		return def
 	}
 
 	return def
@@ -1 +1,324 @@
 package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSpace(t *testing.T) {
+	s, err := ParseSpace("global,v6=2001:db8::/48,v6ab=56,v4=203.0.113.0/24,v4ab=28,file=global.json")
+	if err != nil || s.Name != "global" || s.IPv6 != "2001:db8::/48" || s.IPv6AB != 56 || s.IPv4 != "203.0.113.0/24" || s.IPv4AB != 28 || s.File != "global.json" {
+		t.Error("Expected success for parse full address space, got", s, err)
+	}
+
+	s, err = ParseSpace("edge,v4=203.0.113.0/24")
+	if err != nil || s.IPv4AB != 24 || s.IPv6AB != 64 {
+		t.Error("Expected default allocate blocks, got", s, err)
+	}
+
+	s, err = ParseSpace("edge,v4=203.0.113.0/24,exclude=203.0.113.1,exclude=203.0.113.10-203.0.113.20")
+	if err != nil || len(s.Exclude) != 2 || s.Exclude[1] != "203.0.113.10-203.0.113.20" {
+		t.Error("Expected excluded addresses, got", s, err)
+	}
+
+	_, err = ParseSpace("edge")
+	if err == nil {
+		t.Error("Expected fail for address space without pools")
+	}
+
+	_, err = ParseSpace("ed/ge,v4=203.0.113.0/24")
+	if err == nil {
+		t.Error("Expected fail for wrong address space name")
+	}
+
+	_, err = ParseSpace("edge,v4=203.0.113.0/24,v4ab=bla")
+	if err == nil {
+		t.Error("Expected fail for wrong allocate block")
+	}
+
+	_, err = ParseSpace("edge,v5=203.0.113.0/24")
+	if err == nil {
+		t.Error("Expected fail for unknown parameter")
+	}
+}
+
+func TestAddressSpaces(t *testing.T) {
+	var cnf Config
+	cnf.setDefaults()
+	cnf.Lease.IPv4 = "192.168.0.0/16"
+	cnf.Lease.Exclude = "192.168.0.1, 192.168.0.0/28"
+	cnf.Space.List.Set("global,v4=203.0.113.0/24")
+
+	ss := cnf.AddressSpaces()
+	if len(ss) != 2 || ss[0].Name != "local" || ss[0].File != "lease.json" || ss[1].File != "lease.global.json" {
+		t.Error("Expected local and global address spaces, got", ss)
+	}
+
+	if len(ss[0].Exclude) != 2 || ss[0].Exclude[1] != "192.168.0.0/28" || len(ss[1].Exclude) != 0 {
+		t.Error("Expected excluded addresses of local address space, got", ss)
+	}
+
+	if err := cnf.Check(); err != nil {
+		t.Error("Expected success for check, got", err)
+	}
+
+	cnf.Space.Global = "unknown"
+	if err := cnf.Check(); err == nil {
+		t.Error("Expected fail for unknown global address space")
+	}
+
+	cnf.Space.Global = ""
+	cnf.Lease.MigrateFrom = "json:old.json"
+	if kind, file, err := cnf.Migration("global"); err != nil || kind != "json" || file != "old.global.json" {
+		t.Error("Expected migration source of global address space, got", kind, file, err)
+	}
+
+	cnf.Lease.MigrateFrom = "old.json"
+	if err := cnf.Check(); err == nil {
+		t.Error("Expected fail for wrong migration source")
+	}
+
+	cnf.Lease.MigrateFrom = ""
+	cnf.Lease.Store = "bla"
+	if err := cnf.Check(); err == nil {
+		t.Error("Expected fail for unknown store")
+	}
+
+	cnf.Lease.Store = "json"
+	cnf.Space.List.Set("local,v4=10.0.0.0/8")
+	if err := cnf.Check(); err == nil {
+		t.Error("Expected fail for address space defined twice")
+	}
+}
+
+func TestParsePeer(t *testing.T) {
+	p, err := ParsePeer("node1,raft=10.0.0.1:7000,api=https://10.0.0.1:8443")
+	if err != nil || p.ID != "node1" || p.Raft != "10.0.0.1:7000" || p.API != "https://10.0.0.1:8443" {
+		t.Error("Expected success for parse peer, got", p, err)
+	}
+
+	_, err = ParsePeer("node1,raft=10.0.0.1:7000")
+	if err == nil {
+		t.Error("Expected fail for peer without API URL")
+	}
+
+	var cnf Config
+	cnf.setDefaults()
+	cnf.Lease.IPv4 = "192.168.0.0/16"
+	cnf.Cluster.Peers.Set("node1,raft=10.0.0.1:7000,api=http://10.0.0.1:8443")
+	if err := cnf.Cluster.Peers.Set("node1,raft=10.0.0.2:7000,api=http://10.0.0.2:8443"); err == nil {
+		t.Error("Expected fail for peer defined twice")
+	}
+
+	cnf.Cluster.ID = "node2"
+	if err := cnf.Check(); err == nil {
+		t.Error("Expected fail for cluster node which is not in peers")
+	}
+
+	cnf.Cluster.ID = "node1"
+	if err := cnf.Check(); err != nil {
+		t.Error("Expected success for check, got", err)
+	}
+}
+
+const testFile = `
+lease:
+  file: state.json
+  gateway: last
+  mac_retention: 1h
+  block_hold: 10m
+local: lan
+global: edge
+spaces:
+  - name: lan
+    exclude: [192.168.0.1]
+    pools:
+      - name: office
+        cidr: 192.168.0.0/16
+        block: 24
+        gateway: "10"
+        exclude: [192.168.0.10-192.168.0.20]
+      - name: ula
+        cidr: fd00::/48
+  - name: edge
+    pools:
+      - name: public
+        cidr: 203.0.113.0/24
+        block: 28
+      - name: old
+        cidr: 198.51.100.0/24
+        block: 28
+        drain: true
+`
+
+func TestLoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "gipam.yaml")
+	ioutil.WriteFile(path, []byte(testFile), 0600)
+
+	f, err := LoadFile(path)
+	if err != nil {
+		t.Fatal("Expected success for load config file, got", err)
+	}
+
+	var cnf Config
+	cnf.setDefaults()
+	cnf.applyFile(f)
+	if cnf.Lease.File != "state.json" || cnf.Lease.Gateway != "last" || cnf.Lease.MACRetention != time.Hour || cnf.Lease.BlockHold != 10*time.Minute || cnf.Space.Local != "lan" {
+		t.Error("Expected lease config of file, got", cnf.Lease, cnf.Space)
+	}
+
+	if err := cnf.Check(); err != nil {
+		t.Error("Expected success for check, got", err)
+	}
+
+	ss := cnf.AddressSpaces()
+	if len(ss) != 2 || ss[0].Name != "lan" || ss[0].File != "state.json" || ss[1].File != "state.edge.json" {
+		t.Fatal("Expected lan and edge address spaces, got", ss)
+	}
+
+	if ss[0].IPv4 != "192.168.0.0/16" || ss[0].IPv4AB != 24 || ss[0].IPv6 != "fd00::/48" || ss[0].IPv6AB != 64 || ss[1].IPv4AB != 28 {
+		t.Error("Expected pools of file with default block len, got", ss)
+	}
+
+	if pools := ss[1].Family(4); len(pools) != 2 || pools[0].Drain || !pools[1].Drain {
+		t.Error("Expected draining pool of file, got", pools)
+	}
+
+	if ex := ss[0].Excluded(); len(ex) != 2 || ex[1] != "192.168.0.10-192.168.0.20" {
+		t.Error("Expected excluded addresses of space and pool, got", ex)
+	}
+
+	// flags override pools of file
+	cnf.Lease.IPv4AB = 26
+	cnf.setExplicit("v4ab")
+	if ss = cnf.AddressSpaces(); ss[0].IPv4AB != 26 || ss[0].Pools[1].Name != "office" || ss[0].Pools[1].Gateway != "10" {
+		t.Error("Expected block len of flag, got", ss[0])
+	}
+
+	cnf.Lease.IPv4 = "10.0.0.0/8"
+	if ss = cnf.AddressSpaces(); ss[0].IPv4 != "10.0.0.0/8" || len(ss[0].Pools) != 2 || ss[0].Pools[1].Name != "v4" {
+		t.Error("Expected IPv4 pool of flag, got", ss[0])
+	}
+
+	cnf.Space.List.Set("edge,v4=198.51.100.0/24")
+	if ss = cnf.AddressSpaces(); len(ss) != 2 || ss[1].IPv4 != "198.51.100.0/24" {
+		t.Error("Expected address space of flag, got", ss)
+	}
+
+	if _, err := LoadFile(filepath.Join(dir, "none.yaml")); err == nil {
+		t.Error("Expected fail for missing config file")
+	}
+
+	ioutil.WriteFile(path, []byte("lease:\n  fiel: state.json\n"), 0600)
+	if _, err := LoadFile(path); err == nil || !strings.Contains(err.Error(), "fiel") {
+		t.Error("Expected fail for unknown key, got", err)
+	}
+
+	if p := configPath([]string{"-v4", "10.0.0.0/8", "--config", "a.yaml"}); p != "a.yaml" {
+		t.Error("Expected config path of flag, got", p)
+	}
+
+	if p := configPath([]string{"-config=b.yaml"}); p != "b.yaml" {
+		t.Error("Expected config path of flag, got", p)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, c := range []struct {
+		pools []Pool
+		err   string
+	}{
+		{[]Pool{{Name: "a", CIDR: "192.168.0/16", Block: 24}}, "Pool 'a' of address space 'x': wrong CIDR '192.168.0/16'"},
+		{[]Pool{{Name: "a", CIDR: "192.168.1.0/16", Block: 24}}, "Pool 'a' of address space 'x': 192.168.1.0/16 is not network address, it must be 192.168.0.0/16"},
+		{[]Pool{{Name: "a", CIDR: "192.168.0.0/16", Block: 8}}, "Pool 'a' of address space 'x': block /8 is bigger than pool 192.168.0.0/16"},
+		{[]Pool{{Name: "a", CIDR: "fd00::/48", Block: 128}}, "Pool 'a' of address space 'x': block /128 is too small, it must be /127 or bigger"},
+		{[]Pool{{Name: "a", CIDR: "fd00::/48", Block: 56}}, "Pool 'a' of address space 'x': IPv6 block /56 is too big, it must be /64 or smaller"},
+		{[]Pool{{Name: "a", CIDR: "192.168.0.0/16", Block: 24, Gateway: "255"}}, "Pool 'a' of address space 'x': gateway offset 255 is out of block /24"},
+		{[]Pool{{Name: "a", CIDR: "192.168.0.0/16", Block: 24, Gateway: "middle"}}, "Pool 'a' of address space 'x': wrong gateway policy 'middle', it can be 'first', 'last' or offset from network address"},
+		{[]Pool{{Name: "a", CIDR: "192.168.0.0/16", Block: 24, Exclude: []string{"10.0.0.1"}}}, "Pool 'a' of address space 'x': excluded addresses '10.0.0.1' are out of pool 192.168.0.0/16"},
+		{[]Pool{{Name: "a", CIDR: "192.168.0.0/16", Block: 24, Exclude: []string{"192.168.0.9-192.168.0.1"}}}, "Pool 'a' of address space 'x': wrong excluded range '192.168.0.9-192.168.0.1', first address is bigger than last"},
+		{[]Pool{{Name: "a", CIDR: "192.168.0.0/16", Block: 24}, {Name: "a", CIDR: "10.0.0.0/8", Block: 24}}, "Pool 'a' of address space 'x' is defined twice"},
+		{[]Pool{{Name: "a", CIDR: "192.168.0.0/16", Block: 24}, {Name: "b", CIDR: "192.168.4.0/22", Block: 24}}, "Pool 'b' (192.168.4.0/22) of address space 'x' overlaps with pool 'a' (192.168.0.0/16)"},
+		{[]Pool{{CIDR: "192.168.0.0/16", Block: 24}}, "Pool #1 (192.168.0.0/16) of address space 'x' has no name"},
+	} {
+		err := Space{Name: "x", Pools: c.pools}.validate()
+		if err == nil || err.Error() != c.err {
+			t.Error("Expected", c.err, "got", err)
+		}
+	}
+
+	var cnf Config
+	cnf.setDefaults()
+	cnf.Lease.IPv4 = "192.168.0.0/16"
+	cnf.Space.List.Set("edge,v4=192.168.10.0/24")
+	if err := cnf.Check(); err == nil || err.Error() != "Pool 'v4' (192.168.10.0/24) of address space 'edge' overlaps with pool 'v4' (192.168.0.0/16) of address space 'local'" {
+		t.Error("Expected fail for overlap of address spaces, got", err)
+	}
+
+	cnf.Space.List = nil
+	cnf.Space.File = []Space{{Name: "local", Pools: []Pool{{Name: "a", CIDR: "10.0.0.0/16"}, {Name: "b", CIDR: "10.1.0.0/16"}}}}
+	cnf.Lease.IPv4 = ""
+	if err := cnf.Check(); err != nil {
+		t.Error("Expected success for several pools of family, got", err)
+	}
+
+	if pools := cnf.AddressSpaces()[0].Family(4); len(pools) != 2 || pools[0].Name != "a" || pools[1].Name != "b" {
+		t.Error("Expected pools of family in configured order, got", pools)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "gipam.yaml")
+	ioutil.WriteFile(path, []byte("spaces:\n  - name: local\n    pools:\n      - {name: lan, cidr: 10.0.0.0/24, block: 26}\n"), 0600)
+
+	cnf, err := load([]string{"-config", path, "-file", filepath.Join(dir, "state.json")}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal("Expected success for load config, got", err)
+	}
+
+	ioutil.WriteFile(path, []byte("spaces:\n  - name: local\n    pools:\n      - {name: lan, cidr: 10.0.0.0/23, block: 26}\n"), 0600)
+	cnf, err = cnf.Reload()
+	if err != nil {
+		t.Fatal("Expected success for reload config, got", err)
+	}
+
+	if ss := cnf.AddressSpaces(); ss[0].IPv4 != "10.0.0.0/23" || cnf.Lease.File != filepath.Join(dir, "state.json") {
+		t.Error("Expected new pool of file and the same flags, got", ss, cnf.Lease.File)
+	}
+
+	ioutil.WriteFile(path, []byte("spaces:\n  - name: local\n    pools:\n      - {name: lan, cidr: 10.0.0.1/23, block: 26}\n"), 0600)
+	if _, err = cnf.Reload(); err == nil {
+		t.Error("Expected error for reload of wrong config")
+	}
+}
+
+func TestConflictPolicy(t *testing.T) {
+	var cnf Config
+	cnf.setDefaults()
+	cnf.Lease.IPv4 = "10.0.0.0/8"
+	if cnf.Lease.Conflict != PreferState || cnf.Check() != nil {
+		t.Error("Expected valid default conflict policy, got", cnf.Lease.Conflict)
+	}
+
+	cnf.Lease.Conflict = "prefer-file"
+	if err := cnf.Check(); err == nil || !strings.Contains(err.Error(), "Unknown conflict policy 'prefer-file'") {
+		t.Error("Expected error for unknown conflict policy, got", err)
+	}
+}
@@ -0,0 +1,177 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// File - config file (-config), YAML or JSON. Values of file are applied over defaults, env and flags override them.
+type File struct {
+	Server struct {
+		Address    string `yaml:"address"`
+		API        string `yaml:"api"`
+		Token      string `yaml:"token"`
+		Insecure   bool   `yaml:"insecure"`
+		TLSCert    string `yaml:"tls_cert"`
+		TLSKey     string `yaml:"tls_key"`
+		Remote     string `yaml:"remote"`
+		Admin      string `yaml:"admin"`
+		AdminToken string `yaml:"admin_token"`
+		Metrics    string `yaml:"metrics"`
+	} `yaml:"server"`
+
+	Lease struct {
+		File         string         `yaml:"file"`
+		Generations  *uint          `yaml:"generations"`
+		Store        string         `yaml:"store"`
+		V6AB         uint           `yaml:"v6ab"` // default block len of IPv6 pools
+		V4AB         uint           `yaml:"v4ab"` // default block len of IPv4 pools
+		Gateway      string         `yaml:"gateway"`
+		MACRetention *time.Duration `yaml:"mac_retention"`
+		AddressHold  time.Duration  `yaml:"address_hold"`
+		BlockHold    time.Duration  `yaml:"block_hold"`
+		V6Anycast    bool           `yaml:"v6_anycast"`
+		Conflict     string         `yaml:"conflict"` // drop_blocks isn't read from file, it is confirmed for one start
+	} `yaml:"lease"`
+
+	Docker struct {
+		Host      string        `yaml:"host"`
+		Driver    string        `yaml:"driver"`
+		Reconcile time.Duration `yaml:"reconcile"`
+		Fix       bool          `yaml:"reconcile_fix"`
+		Fresh     bool          `yaml:"fresh"`
+	} `yaml:"docker"`
+
+	Cluster struct {
+		ID    string `yaml:"id"`
+		Bind  string `yaml:"bind"`
+		Dir   string `yaml:"dir"`
+		Peers []Peer `yaml:"peers"`
+	} `yaml:"cluster"`
+
+	Local  string  `yaml:"local"`
+	Global string  `yaml:"global"`
+	Spaces []Space `yaml:"spaces"`
+}
+
+// LoadFile - read config file, unknown keys are errors
+func LoadFile(path string) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("Can't read config file: " + err.Error())
+	}
+
+	var f File
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil && err != io.EOF {
+		return nil, errors.New("Wrong config file " + path + ": " + err.Error())
+	}
+
+	for k, s := range f.Spaces {
+		if !isSpaceName(s.Name) {
+			return nil, errors.New("Wrong name '" + s.Name + "' of address space #" + strconv.Itoa(k+1) + " in config file " + path)
+		}
+	}
+
+	return &f, nil
+}
+
+// applyFile - set values of config file, empty values keep defaults
+func (cnf *Config) applyFile(f *File) {
+	set := func(dst *string, v string) {
+		if v != "" {
+			*dst = v
+		}
+	}
+
+	set(&cnf.Server.Address, f.Server.Address)
+	set(&cnf.Server.API, f.Server.API)
+	set(&cnf.Server.Token, f.Server.Token)
+	set(&cnf.Server.TLSCert, f.Server.TLSCert)
+	set(&cnf.Server.TLSKey, f.Server.TLSKey)
+	set(&cnf.Server.Remote, f.Server.Remote)
+	set(&cnf.Server.Admin, f.Server.Admin)
+	set(&cnf.Server.AdminToken, f.Server.AdminToken)
+	set(&cnf.Server.Metrics, f.Server.Metrics)
+
+	set(&cnf.Lease.File, f.Lease.File)
+	set(&cnf.Lease.Store, f.Lease.Store)
+	set(&cnf.Lease.Gateway, f.Lease.Gateway)
+	set(&cnf.Lease.Conflict, f.Lease.Conflict)
+	if f.Lease.Generations != nil {
+		cnf.Lease.Generations = *f.Lease.Generations
+	}
+
+	if f.Lease.V6AB != 0 {
+		cnf.Lease.IPv6AB = f.Lease.V6AB
+	}
+
+	if f.Lease.V4AB != 0 {
+		cnf.Lease.IPv4AB = f.Lease.V4AB
+	}
+
+	if f.Lease.MACRetention != nil {
+		cnf.Lease.MACRetention = *f.Lease.MACRetention
+	}
+
+	if f.Lease.AddressHold != 0 {
+		cnf.Lease.AddressHold = f.Lease.AddressHold
+	}
+
+	if f.Lease.BlockHold != 0 {
+		cnf.Lease.BlockHold = f.Lease.BlockHold
+	}
+
+	cnf.Lease.V6Anycast = cnf.Lease.V6Anycast || f.Lease.V6Anycast
+
+	set(&cnf.Docker.Host, f.Docker.Host)
+	set(&cnf.Docker.Driver, f.Docker.Driver)
+	if f.Docker.Reconcile != 0 {
+		cnf.Docker.Reconcile = f.Docker.Reconcile
+	}
+
+	cnf.Server.Insecure = cnf.Server.Insecure || f.Server.Insecure
+	cnf.Docker.Fix = cnf.Docker.Fix || f.Docker.Fix
+	cnf.Docker.Fresh = cnf.Docker.Fresh || f.Docker.Fresh
+
+	set(&cnf.Cluster.ID, f.Cluster.ID)
+	set(&cnf.Cluster.Bind, f.Cluster.Bind)
+	set(&cnf.Cluster.Dir, f.Cluster.Dir)
+	cnf.Cluster.filePeers = f.Cluster.Peers
+
+	set(&cnf.Space.Local, f.Local)
+	set(&cnf.Space.Global, f.Global)
+	cnf.Space.File = f.Spaces
+}
+
+// configPath - config file from -config flag or GIPAM_CONFIG, flags are not parsed yet
+func configPath(args []string) string {
+	path := os.Getenv("GIPAM_CONFIG")
+	for k, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		switch {
+		case arg == "--":
+			return path
+
+		case !strings.HasPrefix(arg, "-"):
+			continue
+
+		case strings.HasPrefix(name, "config="):
+			path = strings.TrimPrefix(name, "config=")
+
+		case name == "config" && k+1 < len(args):
+			path = args[k+1]
+		}
+	}
+
+	return path
+}
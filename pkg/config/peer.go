@@ -0,0 +1,92 @@
+package config
+
+import (
+	"errors"
+	"strings"
+)
+
+// Peer - member of cluster of replicated leasers
+type Peer struct {
+	ID   string `yaml:"id"`
+	Raft string `yaml:"raft"`
+	API  string `yaml:"api"`
+}
+
+// Peers - list of cluster members, implements flag.Value
+type Peers []Peer
+
+// String implements flag.Value
+func (ps *Peers) String() string {
+	var r []string
+	for _, p := range *ps {
+		r = append(r, p.String())
+	}
+
+	return strings.Join(r, ";")
+}
+
+// Set implements flag.Value, every flag adds one peer
+func (ps *Peers) Set(value string) error {
+	p, err := ParsePeer(value)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := ps.Find(p.ID); ok {
+		return errors.New("Cluster peer '" + p.ID + "' is defined twice")
+	}
+
+	*ps = append(*ps, p)
+	return nil
+}
+
+// Find - peer by ID
+func (ps Peers) Find(id string) (Peer, bool) {
+	for _, p := range ps {
+		if p.ID == id {
+			return p, true
+		}
+	}
+
+	return Peer{}, false
+}
+
+// String - peer in flag format
+func (p Peer) String() string {
+	return p.ID + ",raft=" + p.Raft + ",api=" + p.API
+}
+
+// ParsePeer - parse peer from string 'node1,raft=10.0.0.1:7000,api=https://10.0.0.1:8443'
+func ParsePeer(value string) (Peer, error) {
+	var p Peer
+
+	params := strings.Split(value, ",")
+	p.ID = strings.TrimSpace(params[0])
+	if !isSpaceName(p.ID) {
+		return p, errors.New("Wrong cluster peer ID '" + p.ID + "', it can contains only letters, digits, '-' and '_'")
+	}
+
+	for _, param := range params[1:] {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) != 2 {
+			return p, errors.New("Wrong cluster peer '" + p.ID + "' parameter '" + param + "'")
+		}
+
+		switch kv[0] {
+		case "raft":
+			p.Raft = kv[1]
+
+		case "api":
+			p.API = kv[1]
+
+		default:
+			return p, errors.New("Unknown cluster peer '" + p.ID + "' parameter '" + kv[0] + "'")
+		}
+	}
+
+	if p.Raft == "" || p.API == "" {
+		return p, errors.New("Cluster peer '" + p.ID + "' must have raft address and API URL")
+	}
+
+	return p, nil
+}
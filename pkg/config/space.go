@@ -0,0 +1,308 @@
+package config
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Space - named address space with own main pools and lease file.
+// Pools of config file are in Pools, IPv6 and IPv4 are the first pools of family.
+type Space struct {
+	Name   string `yaml:"name"`
+	File   string `yaml:"file,omitempty"`
+	IPv6   string `yaml:"-"`
+	IPv6AB uint   `yaml:"-"`
+	IPv4   string `yaml:"-"`
+	IPv4AB uint   `yaml:"-"`
+
+	Pools   []Pool   `yaml:"pools"`
+	Exclude []string `yaml:"exclude,omitempty"`
+}
+
+// Pool - main pool of address space
+type Pool struct {
+	Name    string   `yaml:"name"`
+	CIDR    string   `yaml:"cidr"`
+	Block   uint     `yaml:"block,omitempty"`   // prefix len of allocate block, if 0 -v6ab or -v4ab is used
+	Gateway string   `yaml:"gateway,omitempty"` // gateway policy of blocks, if empty -gateway is used
+	Exclude []string `yaml:"exclude,omitempty"` // addresses of pool which are never given to containers
+	Drain   bool     `yaml:"drain,omitempty"`   // pool gives no new blocks, it is retired when its last block is returned
+}
+
+// V - IP version of pool, 0 if CIDR is wrong
+func (p Pool) V() uint8 {
+	ip, _, err := net.ParseCIDR(p.CIDR)
+	switch {
+	case err != nil:
+		return 0
+	case ip.To4() != nil:
+		return 4
+	}
+
+	return 6
+}
+
+// Spaces - list of additional address spaces, implements flag.Value
+type Spaces []Space
+
+// String implements flag.Value
+func (ss *Spaces) String() string {
+	var r []string
+	for _, s := range *ss {
+		r = append(r, s.String())
+	}
+
+	return strings.Join(r, ";")
+}
+
+// Set implements flag.Value, every flag adds one space
+func (ss *Spaces) Set(value string) error {
+	s, err := ParseSpace(value)
+	if err != nil {
+		return err
+	}
+
+	*ss = append(*ss, s)
+	return nil
+}
+
+// String - space in flag format
+func (s Space) String() string {
+	r := []string{s.Name}
+	if s.IPv6 != "" {
+		r = append(r, "v6="+s.IPv6, "v6ab="+strconv.Itoa(int(s.IPv6AB)))
+	}
+
+	if s.IPv4 != "" {
+		r = append(r, "v4="+s.IPv4, "v4ab="+strconv.Itoa(int(s.IPv4AB)))
+	}
+
+	for _, e := range s.Exclude {
+		r = append(r, "exclude="+e)
+	}
+
+	if s.File != "" {
+		r = append(r, "file="+s.File)
+	}
+
+	return strings.Join(r, ",")
+}
+
+// ParseSpace - parse space from string 'name,v6=2001:db8::/56,v6ab=64,v4=192.168.0.0/16,v4ab=24,file=global.json'.
+// Excluded addresses are set by repeated parameter 'exclude=192.168.0.1,exclude=192.168.0.10-192.168.0.20'
+func ParseSpace(value string) (Space, error) {
+	var s Space = Space{IPv6AB: 64, IPv4AB: 24}
+
+	params := strings.Split(value, ",")
+	s.Name = strings.TrimSpace(params[0])
+	if !isSpaceName(s.Name) {
+		return s, errors.New("Wrong address space name '" + s.Name + "', it can contains only letters, digits, '-' and '_'")
+	}
+
+	for _, p := range params[1:] {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) != 2 {
+			return s, errors.New("Wrong address space '" + s.Name + "' parameter '" + p + "'")
+		}
+
+		switch kv[0] {
+		case "v6":
+			s.IPv6 = kv[1]
+
+		case "v4":
+			s.IPv4 = kv[1]
+
+		case "v6ab", "v4ab":
+			ab, err := strconv.ParseUint(kv[1], 10, 8)
+			if err != nil {
+				return s, errors.New("Wrong address space '" + s.Name + "' allocate block '" + kv[1] + "'")
+			}
+
+			if kv[0] == "v6ab" {
+				s.IPv6AB = uint(ab)
+			} else {
+				s.IPv4AB = uint(ab)
+			}
+
+		case "file":
+			s.File = kv[1]
+
+		case "exclude":
+			s.Exclude = append(s.Exclude, kv[1])
+
+		default:
+			return s, errors.New("Unknown address space '" + s.Name + "' parameter '" + kv[0] + "'")
+		}
+	}
+
+	if s.IPv6 == "" && s.IPv4 == "" {
+		return s, errors.New("Address space '" + s.Name + "' has no IPv4 and IPv6 pools")
+	}
+
+	return s, nil
+}
+
+// Excluded - addresses of space and all its pools which are never given to containers
+func (s Space) Excluded() []string {
+	r := append([]string{}, s.Exclude...)
+	for _, p := range s.Pools {
+		r = append(r, p.Exclude...)
+	}
+
+	return r
+}
+
+// Family - pools of space by IP version in configured order
+func (s Space) Family(v uint8) []Pool {
+	var r []Pool
+	for _, p := range s.Pools {
+		if p.V() == v {
+			r = append(r, p)
+		}
+	}
+
+	return r
+}
+
+// normalize - pools of flags are added to Pools, first pools of family are set to IPv6 and IPv4, default block lens are set
+func (s *Space) normalize(v6ab, v4ab uint) {
+	if len(s.Pools) == 0 {
+		if s.IPv6 != "" {
+			s.Pools = append(s.Pools, Pool{Name: "v6", CIDR: s.IPv6, Block: s.IPv6AB})
+		}
+
+		if s.IPv4 != "" {
+			s.Pools = append(s.Pools, Pool{Name: "v4", CIDR: s.IPv4, Block: s.IPv4AB})
+		}
+	}
+
+	s.Pools = append([]Pool{}, s.Pools...)
+	for k := range s.Pools {
+		if s.Pools[k].Block != 0 {
+			continue
+		}
+
+		s.Pools[k].Block = v4ab
+		if s.Pools[k].V() == 6 {
+			s.Pools[k].Block = v6ab
+		}
+	}
+
+	s.IPv6, s.IPv6AB, s.IPv4, s.IPv4AB = "", v6ab, "", v4ab
+	if pools := s.Family(6); len(pools) != 0 {
+		s.IPv6, s.IPv6AB = pools[0].CIDR, pools[0].Block
+	}
+
+	if pools := s.Family(4); len(pools) != 0 {
+		s.IPv4, s.IPv4AB = pools[0].CIDR, pools[0].Block
+	}
+}
+
+// AddressSpaces - all address spaces, first is local default space from lease config.
+// Spaces of config file are used if they are not set by flags: -v6 and -v4 replace pools of family of local space,
+// -v6ab and -v4ab set block len of its pools, -space replaces space of config file with the same name.
+// Lease file of additional space by default is lease file with space name suffix: lease.global.json
+func (cnf *Config) AddressSpaces() []Space {
+	local := Space{Name: cnf.Space.Local}
+	for _, s := range cnf.Space.File {
+		if s.Name == cnf.Space.Local {
+			local = s
+		}
+	}
+
+	local.File = cnf.Lease.File
+	local.Pools = cnf.localPools(local.Pools)
+	for _, e := range strings.Split(cnf.Lease.Exclude, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			local.Exclude = append(local.Exclude, e)
+		}
+	}
+
+	local.normalize(cnf.Lease.IPv6AB, cnf.Lease.IPv4AB)
+	r := []Space{local}
+
+	flags := map[string]bool{}
+	for _, s := range cnf.Space.List {
+		flags[s.Name] = true
+	}
+
+	for _, s := range cnf.Space.File {
+		if s.Name != cnf.Space.Local && !flags[s.Name] {
+			r = append(r, s)
+		}
+	}
+
+	r = append(r, cnf.Space.List...)
+	for k := range r[1:] {
+		s := &r[k+1]
+		if s.File == "" {
+			s.File = spaceFile(cnf.Lease.File, s.Name)
+		}
+
+		s.normalize(cnf.Lease.IPv6AB, cnf.Lease.IPv4AB)
+	}
+
+	return r
+}
+
+// localPools - pools of local space from config file with -v6, -v4, -v6ab and -v4ab
+func (cnf *Config) localPools(file []Pool) []Pool {
+	var r []Pool
+	for _, v := range []uint8{6, 4} {
+		cidr, ab, name := cnf.Lease.IPv4, cnf.Lease.IPv4AB, "v4"
+		if v == 6 {
+			cidr, ab, name = cnf.Lease.IPv6, cnf.Lease.IPv6AB, "v6"
+		}
+
+		if cidr != "" {
+			r = append(r, Pool{Name: name, CIDR: cidr, Block: ab})
+			continue
+		}
+
+		for _, p := range file {
+			if p.V() != v {
+				continue
+			}
+
+			if cnf.explicit[name+"ab"] {
+				p.Block = ab
+			}
+
+			r = append(r, p)
+		}
+	}
+
+	// pools with wrong CIDR are kept for validation
+	for _, p := range file {
+		if p.V() == 0 {
+			r = append(r, p)
+		}
+	}
+
+	return r
+}
+
+// utils
+
+// spaceFile - file name with space name suffix: lease.json -> lease.global.json
+func spaceFile(file, name string) string {
+	ext := filepath.Ext(file)
+	return strings.TrimSuffix(file, ext) + "." + name + ext
+}
+
+func isSpaceName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,150 @@
+package config
+
+import (
+	"errors"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// validate - check pools of address space: CIDR syntax, block lens, gateway policies, exclusions and overlaps of pools
+func (s Space) validate() error {
+	names := map[string]bool{}
+	for k, p := range s.Pools {
+		if p.Name == "" {
+			return errors.New("Pool #" + strconv.Itoa(k+1) + " (" + p.CIDR + ") of address space '" + s.Name + "' has no name")
+		}
+
+		if names[p.Name] {
+			return errors.New("Pool '" + p.Name + "' of address space '" + s.Name + "' is defined twice")
+		}
+
+		names[p.Name] = true
+		if err := p.validate(); err != nil {
+			return errors.New("Pool '" + p.Name + "' of address space '" + s.Name + "': " + err.Error())
+		}
+	}
+
+	for i, a := range s.Pools {
+		for _, b := range s.Pools[i+1:] {
+			if overlaps(a.CIDR, b.CIDR) {
+				return errors.New("Pool '" + b.Name + "' (" + b.CIDR + ") of address space '" + s.Name + "' overlaps with pool '" + a.Name + "' (" + a.CIDR + ")")
+			}
+		}
+	}
+
+	for _, e := range s.Exclude {
+		if _, _, err := parseRange(e); err != nil {
+			return errors.New("Excluded addresses of address space '" + s.Name + "': " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// validate - check CIDR, block len, gateway policy and exclusions of pool
+func (p Pool) validate() error {
+	ip, pn, err := net.ParseCIDR(p.CIDR)
+	if err != nil {
+		return errors.New("wrong CIDR '" + p.CIDR + "'")
+	}
+
+	if !ip.Equal(pn.IP) {
+		return errors.New(p.CIDR + " is not network address, it must be " + pn.String())
+	}
+
+	ones, bits := pn.Mask.Size()
+	switch {
+	case p.Block < uint(ones):
+		return errors.New("block /" + strconv.Itoa(int(p.Block)) + " is bigger than pool " + pn.String())
+
+	case p.Block >= uint(bits):
+		return errors.New("block /" + strconv.Itoa(int(p.Block)) + " is too small, it must be /" + strconv.Itoa(bits-1) + " or bigger")
+
+	// addresses of IPv6 block are counted by 64 bit offsets
+	case bits == 128 && p.Block < 64:
+		return errors.New("IPv6 block /" + strconv.Itoa(int(p.Block)) + " is too big, it must be /64 or smaller")
+	}
+
+	switch p.Gateway {
+	case "", "first", "last":
+	default:
+		off, err := strconv.ParseUint(p.Gateway, 10, 64)
+		if err != nil || off == 0 {
+			return errors.New("wrong gateway policy '" + p.Gateway + "', it can be 'first', 'last' or offset from network address")
+		}
+
+		// offset must be inside of block and not broadcast address of IPv4 block
+		size := new(big.Int).Lsh(big.NewInt(1), uint(bits)-p.Block)
+		if bits == 32 {
+			size.Sub(size, big.NewInt(1))
+		}
+
+		if new(big.Int).SetUint64(off).Cmp(size) >= 0 {
+			return errors.New("gateway offset " + p.Gateway + " is out of block /" + strconv.Itoa(int(p.Block)))
+		}
+	}
+
+	for _, e := range p.Exclude {
+		first, last, err := parseRange(e)
+		if err != nil {
+			return err
+		}
+
+		if !pn.Contains(first) || !pn.Contains(last) {
+			return errors.New("excluded addresses '" + e + "' are out of pool " + pn.String())
+		}
+	}
+
+	return nil
+}
+
+// parseRange - first and last address of excluded item: ip, network or range 'first-last'
+func parseRange(item string) (net.IP, net.IP, error) {
+	if strings.Contains(item, "/") {
+		_, pn, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, nil, errors.New("wrong excluded network '" + item + "'")
+		}
+
+		last := make(net.IP, len(pn.IP))
+		for k := range pn.IP {
+			last[k] = pn.IP[k] | ^pn.Mask[k]
+		}
+
+		return pn.IP, last, nil
+	}
+
+	s := strings.SplitN(item, "-", 2)
+	first := net.ParseIP(strings.TrimSpace(s[0]))
+	last := first
+	if len(s) == 2 {
+		last = net.ParseIP(strings.TrimSpace(s[1]))
+	}
+
+	if first == nil || last == nil || (first.To4() == nil) != (last.To4() == nil) {
+		return nil, nil, errors.New("wrong excluded address '" + item + "'")
+	}
+
+	if new(big.Int).SetBytes(first.To16()).Cmp(new(big.Int).SetBytes(last.To16())) > 0 {
+		return nil, nil, errors.New("wrong excluded range '" + item + "', first address is bigger than last")
+	}
+
+	return first, last, nil
+}
+
+// overlaps - true if one of networks contains another
+func overlaps(a, b string) bool {
+	_, na, err := net.ParseCIDR(a)
+	if err != nil {
+		return false
+	}
+
+	_, nb, err := net.ParseCIDR(b)
+	if err != nil {
+		return false
+	}
+
+	return na.Contains(nb.IP) || nb.Contains(na.IP)
+}
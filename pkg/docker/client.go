@@ -0,0 +1,155 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultHost - address of Docker Engine API
+const DefaultHost = "unix:///var/run/docker.sock"
+
+// NewClient - client of Docker Engine API, host is 'unix:///path', path of UNIX socket, 'tcp://host:port' or URL
+func NewClient(host string) (*Client, error) {
+	if host == "" {
+		return nil, errors.New("Docker API address is empty")
+	}
+
+	c := &Client{URL: strings.TrimRight(host, "/"), HTTP: &http.Client{Timeout: 30 * time.Second}}
+	switch {
+	case strings.HasPrefix(host, "unix://") || strings.HasPrefix(host, "/"):
+		socket := strings.TrimPrefix(host, "unix://")
+		c.URL = "http://docker"
+		c.HTTP.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+
+	case strings.HasPrefix(host, "tcp://"):
+		c.URL = "http://" + strings.TrimPrefix(c.URL, "tcp://")
+
+	case !strings.Contains(host, "://"):
+		c.URL = "http://" + c.URL
+	}
+
+	return c, nil
+}
+
+// Client - read only client of Docker Engine API, only networks are used
+type Client struct {
+	URL  string
+	HTTP *http.Client
+}
+
+// Network - Docker network, containers are filled only by Network
+type Network struct {
+	ID         string              `json:"Id"`
+	Name       string              `json:"Name"`
+	Scope      string              `json:"Scope"`
+	IPAM       IPAM                `json:"IPAM"`
+	Containers map[string]Endpoint `json:"Containers"`
+}
+
+// IPAM - IPAM driver and pools of network
+type IPAM struct {
+	Driver  string            `json:"Driver"`
+	Options map[string]string `json:"Options"`
+	Config  []IPAMConfig      `json:"Config"`
+}
+
+// IPAMConfig - pool of network
+type IPAMConfig struct {
+	Subnet  string `json:"Subnet"`
+	IPRange string `json:"IPRange,omitempty"`
+	Gateway string `json:"Gateway,omitempty"`
+}
+
+// Endpoint - container attached to network, addresses are with mask
+type Endpoint struct {
+	Name        string `json:"Name"`
+	EndpointID  string `json:"EndpointID"`
+	MacAddress  string `json:"MacAddress"`
+	IPv4Address string `json:"IPv4Address"`
+	IPv6Address string `json:"IPv6Address"`
+}
+
+// Networks - all networks without containers
+func (c *Client) Networks() ([]Network, error) {
+	var r []Network
+	return r, c.get("/networks", &r)
+}
+
+// Network - network with attached containers by ID
+func (c *Client) Network(id string) (*Network, error) {
+	var r Network
+	if err := c.get("/networks/"+url.PathEscape(id), &r); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// DriverNetworks - networks of IPAM driver with attached containers, driver name is compared without tag
+func (c *Client) DriverNetworks(driver string) ([]Network, error) {
+	list, err := c.Networks()
+	if err != nil {
+		return nil, err
+	}
+
+	var r []Network
+	for _, n := range list {
+		if !IsDriver(n.IPAM.Driver, driver) {
+			continue
+		}
+
+		nw, err := c.Network(n.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		r = append(r, *nw)
+	}
+
+	return r, nil
+}
+
+// IsDriver - true if name of IPAM driver of network is driver, plugin tag ':latest' is ignored
+func IsDriver(name, driver string) bool {
+	return strings.Split(name, ":")[0] == strings.Split(driver, ":")[0]
+}
+
+// get - read JSON of Docker API, API error is returned as error
+func (c *Client) get(path string, res interface{}) error {
+	resp, err := c.HTTP.Get(c.URL + path)
+	if err != nil {
+		return errors.New("Docker API is unavailable: " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Message string `json:"message"`
+		}
+
+		if json.Unmarshal(data, &e) != nil || e.Message == "" {
+			return errors.New("Docker API returns " + resp.Status)
+		}
+
+		return errors.New("Docker API Error: " + e.Message)
+	}
+
+	return json.Unmarshal(data, res)
+}
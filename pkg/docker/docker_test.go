@@ -0,0 +1,335 @@
+package docker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/archekb/gipam/pkg/gipam"
+	"github.com/archekb/gipam/pkg/leaser"
+
+	"github.com/docker/go-plugins-helpers/ipam"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDocker - Docker Engine API with networks only
+type fakeDocker struct {
+	sync.Mutex
+	networks []Network
+}
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path == "networks" {
+		list := []Network{}
+		for _, n := range f.networks {
+			n.Containers = nil
+			list = append(list, n)
+		}
+
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+
+	for _, n := range f.networks {
+		if path == "networks/"+n.ID {
+			json.NewEncoder(w).Encode(n)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]string{"message": "network " + path + " not found"})
+}
+
+func (f *fakeDocker) set(networks ...Network) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.networks = networks
+}
+
+// serveUnix - fake Docker API on UNIX socket like real daemon
+func serveUnix(t *testing.T, h http.Handler) (string, func()) {
+	dir, err := ioutil.TempDir("", "gipam")
+	require.NoError(t, err)
+
+	socket := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	ts := httptest.NewUnstartedServer(h)
+	ts.Listener = l
+	ts.Start()
+
+	return "unix://" + socket, func() {
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestClient(t *testing.T) {
+	f := &fakeDocker{}
+	f.set(
+		Network{ID: "n1", Name: "bridge", Scope: "local", IPAM: IPAM{Driver: "default", Config: []IPAMConfig{{Subnet: "172.17.0.0/16"}}}},
+		Network{ID: "n2", Name: "net2", Scope: "local", IPAM: IPAM{Driver: "gipam:latest", Config: []IPAMConfig{{Subnet: "192.168.0.0/24"}}},
+			Containers: map[string]Endpoint{"c1": {Name: "c1", IPv4Address: "192.168.0.2/24"}}},
+	)
+
+	host, stop := serveUnix(t, f)
+	defer stop()
+
+	c, err := NewClient(host)
+	require.NoError(t, err)
+
+	list, err := c.DriverNetworks("gipam")
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	require.Equal(t, "net2", list[0].Name)
+	require.Equal(t, "192.168.0.2/24", list[0].Containers["c1"].IPv4Address)
+
+	_, err = c.Network("none")
+	require.EqualError(t, err, "Docker API Error: network networks/none not found")
+
+	_, err = NewClient("")
+	require.Error(t, err)
+}
+
+func TestReconcile(t *testing.T) {
+	lsr, err := leaser.New("", "192.168.0.0/16", 0, 24)
+	require.NoError(t, err)
+
+	// block of removed network with address of removed container
+	orphan, _, err := lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+
+	// block of network with one stopped and one unknown container
+	used, pool, err := lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+	_, err = lsr.GetGateway(used, "")
+	require.NoError(t, err)
+	_, err = lsr.GetAddress(used, "02:42:c0:a8:01:02") // 192.168.1.2
+	require.NoError(t, err)
+	_, err = lsr.GetAddress(used, "02:42:c0:a8:01:03") // 192.168.1.3
+	require.NoError(t, err)
+
+	f := &fakeDocker{}
+	f.set(
+		Network{ID: "n1", Name: "used", Scope: "local", IPAM: IPAM{Driver: "gipam", Config: []IPAMConfig{{Subnet: pool, Gateway: "192.168.1.1"}}},
+			Containers: map[string]Endpoint{
+				"c1": {Name: "c1", MacAddress: "02:42:c0:a8:01:02", IPv4Address: "192.168.1.2/24"},
+				"c4": {Name: "c4", MacAddress: "02:42:c0:a8:01:04", IPv4Address: "192.168.1.4/24"},
+			}},
+		Network{ID: "n2", Name: "lost", Scope: "local", IPAM: IPAM{Driver: "gipam", Config: []IPAMConfig{{Subnet: "192.168.10.0/24", Gateway: "192.168.10.1"}}},
+			Containers: map[string]Endpoint{"c5": {Name: "c5", IPv4Address: "192.168.10.2/24"}}},
+		Network{ID: "n3", Name: "swarm", Scope: "swarm", IPAM: IPAM{Driver: "gipam", Config: []IPAMConfig{{Subnet: "10.0.0.0/24"}}}},
+	)
+
+	host, stop := serveUnix(t, f)
+	defer stop()
+
+	c, err := NewClient(host)
+	require.NoError(t, err)
+
+	kinds := func(drift []*Drift) map[string]int {
+		r := map[string]int{}
+		for _, d := range drift {
+			r[d.Kind]++
+		}
+		return r
+	}
+
+	// report only
+	r := NewReconciler(c, "gipam", map[string]Leaser{"local": lsr}, false)
+	drift, err := r.Reconcile()
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{OrphanBlock: 1, OrphanAddress: 1, MissingAddress: 1, MissingBlock: 1}, kinds(drift))
+	require.Len(t, lsr.Allocated, 2)
+
+	// missing entries are adopted at once, orphans are released because they are found by previous pass too
+	r.Fix = true
+	drift, err = r.Reconcile()
+	require.NoError(t, err)
+	for _, d := range drift {
+		require.Empty(t, d.Error)
+		require.True(t, d.Fixed)
+	}
+
+	_, err = lsr.Block(orphan)
+	require.Error(t, err)
+
+	b, err := lsr.Block(used)
+	require.NoError(t, err)
+	require.Equal(t, []string{"192.168.1.2", "192.168.1.4"}, b.Leases)
+
+	owner, err := lsr.Whois("192.168.10.2")
+	require.NoError(t, err)
+	adopted, err := lsr.Block(owner.Block)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.10.1", adopted.Gateway)
+
+	// container was started again and network was removed, new orphan is kept until next pass
+	f.set(
+		Network{ID: "n1", Name: "used", Scope: "local", IPAM: IPAM{Driver: "gipam", Config: []IPAMConfig{{Subnet: pool, Gateway: "192.168.1.1"}}},
+			Containers: map[string]Endpoint{
+				"c1": {Name: "c1", IPv4Address: "192.168.1.2/24"},
+				"c3": {Name: "c3", IPv4Address: "192.168.1.3/24"},
+				"c4": {Name: "c4", IPv4Address: "192.168.1.4/24"},
+			}},
+		Network{ID: "n3", Name: "swarm", Scope: "swarm", IPAM: IPAM{Driver: "gipam", Config: []IPAMConfig{{Subnet: "10.0.0.0/24"}}}},
+	)
+
+	drift, err = r.Reconcile()
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{OrphanBlock: 1, MissingAddress: 1}, kinds(drift))
+	require.Len(t, lsr.Allocated, 2)
+
+	b, err = lsr.Block(used)
+	require.NoError(t, err)
+	require.Equal(t, []string{"192.168.1.2-192.168.1.4"}, b.Leases)
+
+	// adopted block of removed network is released by next pass
+	drift, err = r.Reconcile()
+	require.NoError(t, err)
+	require.Len(t, drift, 1)
+	require.True(t, drift[0].Fixed)
+	require.Len(t, lsr.Allocated, 1)
+
+	drift, err = r.Reconcile()
+	require.NoError(t, err)
+	require.Empty(t, drift)
+
+	// block and address reserved by operator are kept without network and container, address reserved by Docker isn't
+	pinned, _, err := lsr.PinBlock("192.168.20.0/24", "")
+	require.NoError(t, err)
+	_, err = lsr.PinAddress(used, "192.168.1.20", "")
+	require.NoError(t, err)
+	_, err = lsr.ReserveAddress(used, "192.168.1.21", "")
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		drift, err = r.Reconcile()
+		require.NoError(t, err)
+		require.Equal(t, map[string]int{OrphanAddress: 1}, kinds(drift))
+		require.Equal(t, "192.168.1.21", drift[0].Address)
+	}
+
+	_, err = lsr.Block(pinned)
+	require.NoError(t, err)
+
+	b, err = lsr.Block(used)
+	require.NoError(t, err)
+	require.Equal(t, []string{"192.168.1.2-192.168.1.4", "192.168.1.20"}, b.Leases)
+	require.Equal(t, []string{"192.168.1.20"}, b.PinnedIPs)
+}
+
+func TestRecover(t *testing.T) {
+	f := &fakeDocker{}
+	f.set(
+		Network{ID: "n1", Name: "net1", Scope: "local", IPAM: IPAM{Driver: "gipam", Config: []IPAMConfig{
+			{Subnet: "192.168.0.0/24", Gateway: "192.168.0.1"},
+			{Subnet: "fe80::/64", Gateway: "fe80::1"},
+		}}, Containers: map[string]Endpoint{
+			"c1": {Name: "c1", MacAddress: "02:42:c0:a8:00:02", IPv4Address: "192.168.0.2/24", IPv6Address: "fe80::2/64"},
+			"c2": {Name: "c2", MacAddress: "02:42:c0:a8:00:05", IPv4Address: "192.168.0.5/24"},
+		}},
+		Network{ID: "n2", Name: "net2", Scope: "swarm", IPAM: IPAM{Driver: "gipam", Config: []IPAMConfig{{Subnet: "192.168.4.0/22", IPRange: "192.168.5.0/24"}}}},
+		Network{ID: "n3", Name: "other", Scope: "local", IPAM: IPAM{Driver: "gipam", Config: []IPAMConfig{{Subnet: "10.0.0.0/24"}}}},
+		Network{ID: "n4", Name: "bridge", Scope: "local", IPAM: IPAM{Driver: "default", Config: []IPAMConfig{{Subnet: "192.168.1.0/24"}}}},
+	)
+
+	host, stop := serveUnix(t, f)
+
+	c, err := NewClient(host)
+	require.NoError(t, err)
+
+	lsr, err := leaser.New("fe80::/48", "192.168.0.0/16", 64, 24)
+	require.NoError(t, err)
+
+	n, err := Recover(c, "gipam", lsr)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.Len(t, lsr.Allocated, 3)
+
+	o, err := lsr.Whois("192.168.0.5")
+	require.NoError(t, err)
+	require.Equal(t, "02:42:c0:a8:00:05", o.MAC)
+
+	b, err := lsr.Block(o.Block)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.1", b.Gateway)
+	require.Equal(t, []string{"192.168.0.2", "192.168.0.5"}, b.Leases)
+
+	o, err = lsr.Whois("fe80::2")
+	require.NoError(t, err)
+	require.NotEmpty(t, o.Block)
+
+	// pools of existing networks are never given again, pool of default driver is free
+	pool, _, err := lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+	b, err = lsr.Block(pool)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.1.0/24", b.Pool)
+
+	_, _, err = lsr.ReserveBlock("192.168.5.0/24", "")
+	require.Error(t, err)
+
+	// driver refuses to serve while Docker is unavailable
+	stop()
+	lsr, err = leaser.New("fe80::/48", "192.168.0.0/16", 64, 24)
+	require.NoError(t, err)
+
+	_, err = Recover(c, "gipam", lsr)
+	require.Error(t, err)
+}
+
+// TestRecoverPoolID - Docker uses pool ID of lost block after recovery
+func TestRecoverPoolID(t *testing.T) {
+	lsr, err := leaser.New("fe80::/48", "192.168.0.0/16", 64, 24)
+	require.NoError(t, err)
+
+	driver, err := gipam.New(lsr)
+	require.NoError(t, err)
+
+	pool, err := driver.RequestPool(&ipam.RequestPoolRequest{})
+	require.NoError(t, err)
+
+	f := &fakeDocker{}
+	f.set(Network{ID: "n1", Name: "net1", Scope: "local", IPAM: IPAM{Driver: "gipam", Config: []IPAMConfig{{Subnet: pool.Pool, Gateway: "192.168.0.1"}}},
+		Containers: map[string]Endpoint{"c1": {Name: "c1", IPv4Address: "192.168.0.2/24"}}})
+
+	host, stop := serveUnix(t, f)
+	defer stop()
+
+	c, err := NewClient(host)
+	require.NoError(t, err)
+
+	// state is lost
+	lsr, err = leaser.New("fe80::/48", "192.168.0.0/16", 64, 24)
+	require.NoError(t, err)
+
+	_, err = Recover(c, "gipam", lsr)
+	require.NoError(t, err)
+
+	driver, err = gipam.New(lsr)
+	require.NoError(t, err)
+
+	addr, err := driver.RequestAddress(&ipam.RequestAddressRequest{PoolID: pool.PoolID})
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.3/24", addr.Address)
+
+	require.NoError(t, driver.ReleaseAddress(&ipam.ReleaseAddressRequest{PoolID: pool.PoolID, Address: "192.168.0.2"}))
+	require.NoError(t, driver.ReleasePool(&ipam.ReleasePoolRequest{PoolID: pool.PoolID}))
+	require.Empty(t, lsr.Allocated)
+}
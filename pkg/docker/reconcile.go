@@ -0,0 +1,458 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/archekb/gipam/pkg/leaser"
+)
+
+// Kinds of drift between leasers and Docker
+const (
+	OrphanBlock    = "orphan-block"    // block is allocated, but no network uses it
+	MissingBlock   = "missing-block"   // network uses block which is not allocated
+	OrphanAddress  = "orphan-address"  // address is leased, but no container uses it
+	MissingAddress = "missing-address" // container uses address which is not leased
+)
+
+// Leaser - leaser which blocks can be reconciled, leaser.Leaser implements it
+type Leaser interface {
+	Pools() []leaser.PoolInfo
+	Blocks() []leaser.BlockInfo
+	ReserveBlock(string, string) (string, string, error)
+	ReturnBlock(string) error
+	ReserveAddress(string, string, string) (string, error)
+	GetGateway(string, string) (string, error)
+	ReturnAddress(string, string) error
+}
+
+// Drift - difference between leaser and Docker
+type Drift struct {
+	Kind    string `json:"kind"`
+	Space   string `json:"space,omitempty"`
+	Network string `json:"network,omitempty"`
+	Block   string `json:"block,omitempty"`
+	Pool    string `json:"pool"`
+	Address string `json:"address,omitempty"`
+	MAC     string `json:"mac,omitempty"`
+	Fixed   bool   `json:"fixed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// String - drift for log
+func (d *Drift) String() string {
+	s := "[" + d.Space + "] " + d.Kind + " " + d.Pool
+	if d.Block != "" {
+		s += " block " + d.Block
+	}
+
+	if d.Network != "" {
+		s += " network " + d.Network
+	}
+
+	if d.Address != "" {
+		s += " address " + d.Address
+	}
+
+	switch {
+	case d.Error != "":
+		s += ": " + d.Error
+	case d.Fixed:
+		s += ": fixed"
+	}
+
+	return s
+}
+
+// key - identity of drift between passes
+func (d *Drift) key() string {
+	return d.Kind + " " + d.Space + " " + d.Pool + " " + d.Address
+}
+
+// NewReconciler - reconciler of leasers of address spaces with networks of IPAM driver
+func NewReconciler(docker *Client, driver string, spaces map[string]Leaser, fix bool) *Reconciler {
+	return &Reconciler{Docker: docker, Driver: driver, Spaces: spaces, Fix: fix}
+}
+
+// Reconciler - compares allocated blocks and leased addresses with networks and containers of Docker.
+// Missing blocks and addresses are adopted at once. Orphans are released only if they are found by two passes one after another,
+// so block or address which is given while Docker creates network or starts container is not released.
+// Only networks with local scope are checked for addresses, containers of swarm networks on other hosts are unknown.
+type Reconciler struct {
+	sync.Mutex
+
+	Docker *Client
+	Driver string
+	Spaces map[string]Leaser
+	Fix    bool // release orphans and adopt missing entries, else drift is only reported
+
+	suspects map[string]bool // orphans found by previous pass
+}
+
+// Reconcile - one pass, it returns found drift
+func (r *Reconciler) Reconcile() ([]*Drift, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	// state of leasers is read before Docker, so blocks and addresses given after it are not seen as orphans
+	blocks := map[string][]leaser.BlockInfo{}
+	for name, lsr := range r.Spaces {
+		blocks[name] = lsr.Blocks()
+	}
+
+	networks, err := r.Docker.DriverNetworks(r.Driver)
+	if err != nil {
+		return nil, err
+	}
+
+	byPool := map[string]*Network{}
+	configs := map[string]IPAMConfig{}
+	for k := range networks {
+		for _, c := range networks[k].IPAM.Config {
+			pool := canonical(c.Subnet)
+			byPool[pool] = &networks[k]
+			configs[pool] = c
+		}
+	}
+
+	var drift []*Drift
+	known := map[string]bool{}
+	for _, name := range r.names() {
+		for _, b := range blocks[name] {
+			pool := canonical(b.Pool)
+			known[pool] = true
+
+			nw, ok := byPool[pool]
+			if !ok {
+				// block reserved by operator can be used without network
+				if !b.Pinned {
+					drift = append(drift, &Drift{Kind: OrphanBlock, Space: name, Block: b.ID, Pool: b.Pool})
+				}
+				continue
+			}
+
+			if nw.Scope == "local" {
+				drift = append(drift, r.addresses(name, b, nw)...)
+			}
+		}
+	}
+
+	var pools []string
+	for pool := range byPool {
+		if !known[pool] {
+			pools = append(pools, pool)
+		}
+	}
+
+	sort.Strings(pools)
+	for _, pool := range pools {
+		nw := byPool[pool]
+		if nw.Scope != "local" {
+			continue
+		}
+
+		drift = append(drift, &Drift{Kind: MissingBlock, Space: r.space(pool), Network: nw.Name, Pool: pool})
+	}
+
+	suspects := map[string]bool{}
+	for _, d := range drift {
+		if d.Kind == OrphanBlock || d.Kind == OrphanAddress {
+			suspects[d.key()] = true
+		}
+
+		if r.Fix {
+			r.fix(d, configs[canonical(d.Pool)], byPool[canonical(d.Pool)])
+		}
+	}
+
+	r.suspects = suspects
+	return drift, nil
+}
+
+// addresses - drift of leased addresses of block and containers of network
+func (r *Reconciler) addresses(space string, b leaser.BlockInfo, nw *Network) []*Drift {
+	leased := map[string]bool{}
+	for _, l := range b.Leases {
+		for _, ip := range expand(l) {
+			leased[ip] = true
+		}
+	}
+
+	_, pn, _ := net.ParseCIDR(b.Pool)
+	used := map[string]bool{}
+
+	var drift []*Drift
+	for _, id := range sortedKeys(nw.Containers) {
+		ep := nw.Containers[id]
+		for _, addr := range []string{ep.IPv4Address, ep.IPv6Address} {
+			ip := net.ParseIP(strings.Split(addr, "/")[0])
+			if ip == nil || pn == nil || !pn.Contains(ip) {
+				continue
+			}
+
+			used[ip.String()] = true
+			if !leased[ip.String()] && ip.String() != b.Gateway {
+				drift = append(drift, &Drift{Kind: MissingAddress, Space: space, Network: nw.Name, Block: b.ID, Pool: b.Pool, Address: ip.String(), MAC: ep.MacAddress})
+			}
+		}
+	}
+
+	// addresses reserved by operator can be kept without container
+	for _, p := range b.PinnedIPs {
+		if ip := net.ParseIP(p); ip != nil {
+			used[ip.String()] = true
+		}
+	}
+
+	var orphans []string
+	for ip := range leased {
+		if !used[ip] {
+			orphans = append(orphans, ip)
+		}
+	}
+
+	sort.Strings(orphans)
+	for _, ip := range orphans {
+		drift = append(drift, &Drift{Kind: OrphanAddress, Space: space, Network: nw.Name, Block: b.ID, Pool: b.Pool, Address: ip})
+	}
+
+	return drift
+}
+
+// fix - release orphan found by previous pass or adopt missing entry
+func (r *Reconciler) fix(d *Drift, c IPAMConfig, nw *Network) {
+	lsr, ok := r.Spaces[d.Space]
+	if !ok {
+		d.Error = "No address space with main pool of block"
+		return
+	}
+
+	if (d.Kind == OrphanBlock || d.Kind == OrphanAddress) && !r.suspects[d.key()] {
+		return
+	}
+
+	var err error
+	switch d.Kind {
+	case OrphanBlock:
+		err = lsr.ReturnBlock(d.Block)
+
+	case OrphanAddress:
+		err = lsr.ReturnAddress(d.Block, d.Address)
+
+	case MissingAddress:
+		_, err = lsr.ReserveAddress(d.Block, d.Address, d.MAC)
+
+	case MissingBlock:
+		// block ID is derived from subnet, so Docker uses adopted block by pool ID of lost block,
+		// only blocks of old lease files with random IDs can't be used for new containers until network is recreated
+		d.Block, err = adopt(lsr, nw, c)
+	}
+
+	if err != nil {
+		d.Error = err.Error()
+		return
+	}
+
+	d.Fixed = true
+}
+
+// adopt - reserve block of network pool with gateway and addresses of containers, block ID is returned
+func adopt(lsr Leaser, nw *Network, c IPAMConfig) (string, error) {
+	id, _, err := lsr.ReserveBlock(c.Subnet, c.IPRange)
+	if err != nil {
+		return "", err
+	}
+
+	if c.Gateway != "" {
+		if _, err := lsr.GetGateway(id, c.Gateway); err != nil {
+			return id, err
+		}
+	}
+
+	for _, key := range sortedKeys(nw.Containers) {
+		ep := nw.Containers[key]
+		for _, addr := range []string{ep.IPv4Address, ep.IPv6Address} {
+			if addr != "" && isIn(addr, c.Subnet) {
+				if _, err := lsr.ReserveAddress(id, addr, ep.MacAddress); err != nil {
+					log.Println("Adopt address", addr, "of network", nw.Name, "Error:", err)
+				}
+			}
+		}
+	}
+
+	return id, nil
+}
+
+// Run - reconcile every interval until ctx is done, drift is written to log
+func (r *Reconciler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		drift, err := r.Reconcile()
+		if err != nil {
+			log.Println("Reconcile Error:", err)
+		}
+
+		for _, d := range drift {
+			log.Println("Reconcile:", d)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// space - address space which main pool contains pool, the first by name if there are many
+func (r *Reconciler) space(pool string) string {
+	for _, name := range r.names() {
+		if inPools(r.Spaces[name], pool) {
+			return name
+		}
+	}
+
+	return ""
+}
+
+func (r *Reconciler) names() []string {
+	var names []string
+	for name := range r.Spaces {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// canonical - network in the same form for Docker and leaser, IPv6 can be written differently
+func canonical(pool string) string {
+	_, pn, err := net.ParseCIDR(pool)
+	if err != nil {
+		return pool
+	}
+
+	return pn.String()
+}
+
+// isIn - true if address 'ip' or 'ip/mask' or network is inside of network
+func isIn(addr, network string) bool {
+	_, pn, err := net.ParseCIDR(network)
+	if err != nil {
+		return false
+	}
+
+	if ip := net.ParseIP(addr); ip != nil {
+		return pn.Contains(ip)
+	}
+
+	ip, an, err := net.ParseCIDR(addr)
+	if err != nil || !pn.Contains(ip) {
+		return false
+	}
+
+	// endpoint address has mask of its network, network must not be bigger than main pool
+	ones, bits := an.Mask.Size()
+	pones, pbits := pn.Mask.Size()
+	return bits == pbits && ones >= pones
+}
+
+// expand - addresses of lease 'ip' or range 'first-last'
+func expand(lease string) []string {
+	s := strings.SplitN(lease, "-", 2)
+	first := net.ParseIP(s[0])
+	if first == nil {
+		return nil
+	}
+
+	if len(s) == 1 {
+		return []string{first.String()}
+	}
+
+	last := net.ParseIP(s[1])
+	if last == nil {
+		return nil
+	}
+
+	var r []string
+	for ip := first; ; ip = next(ip) {
+		r = append(r, ip.String())
+		if ip.Equal(last) || ip.Equal(net.IPv6zero) {
+			break
+		}
+	}
+
+	return r
+}
+
+// next - following address
+func next(ip net.IP) net.IP {
+	r := make(net.IP, len(ip))
+	copy(r, ip)
+	for i := len(r) - 1; i >= 0; i-- {
+		r[i]++
+		if r[i] != 0 {
+			break
+		}
+	}
+
+	return r
+}
+
+func sortedKeys(m map[string]Endpoint) []string {
+	var r []string
+	for k := range m {
+		r = append(r, k)
+	}
+
+	sort.Strings(r)
+	return r
+}
+
+// Recover - rebuild state of new leaser from networks of IPAM driver: blocks of networks inside its main pools are reserved
+// with gateways and addresses of containers. Count of adopted blocks is returned, error if Docker API is unavailable
+// or block can't be adopted, then leaser must not be used, it can give addresses of existing networks.
+func Recover(docker *Client, driver string, lsr Leaser) (int, error) {
+	networks, err := docker.DriverNetworks(driver)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for k := range networks {
+		nw := &networks[k]
+		for _, c := range nw.IPAM.Config {
+			if !inPools(lsr, c.Subnet) {
+				log.Println("Network", nw.Name, "pool", c.Subnet, "is out of main pools, it is skipped")
+				continue
+			}
+
+			if _, err := adopt(lsr, nw, c); err != nil {
+				return n, errors.New("Can't adopt pool " + c.Subnet + " of network " + nw.Name + ": " + err.Error())
+			}
+
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// inPools - true if pool is inside of main pool of leaser
+func inPools(lsr Leaser, pool string) bool {
+	for _, p := range lsr.Pools() {
+		if isIn(pool, p.Pool) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -3,30 +3,81 @@ package gipam
 import (
 	"errors"
 	"log"
+	"strconv"
+	"strings"
+
+	"github.com/archekb/gipam/pkg/leaser"
 
 	"github.com/docker/go-plugins-helpers/ipam"
 )
 
-// New - create new instance of GIpam
+// DefaultSpace - name of address space used if no spaces are configured
+const DefaultSpace = "local"
+
+// New - create new instance of GIpam with one default address space
 func New(leaser LeaserInterface) (*GIpam, error) {
 	if leaser == nil {
 		return nil, errors.New("Leaser interface is empty")
 	}
 
-	return &GIpam{Leaser: leaser}, nil
+	return NewSpaces(DefaultSpace, DefaultSpace, map[string]LeaserInterface{DefaultSpace: leaser})
 }
 
-// LeaserInterface - interface implements internal logic
-type LeaserInterface interface {
-	GetBlock(uint8) (string, string, error)
-	ReturnBlock(string) error
-	GetAddress(string) (string, error)
-	ReturnAddress(string, string) error
+// NewSpaces - create new instance of GIpam with named address spaces, every space has own leaser
+func NewSpaces(local, global string, spaces map[string]LeaserInterface) (*GIpam, error) {
+	for name, leaser := range spaces {
+		if leaser == nil {
+			return nil, errors.New("Leaser interface of address space '" + name + "' is empty")
+		}
+
+		if strings.Contains(name, "/") {
+			return nil, errors.New("Address space name '" + name + "' can't contains '/'")
+		}
+	}
+
+	if _, ok := spaces[local]; !ok {
+		return nil, errors.New("Local address space '" + local + "' is not defined")
+	}
+
+	if _, ok := spaces[global]; !ok {
+		return nil, errors.New("Global address space '" + global + "' is not defined")
+	}
+
+	return &GIpam{Spaces: spaces, Local: local, Global: global}, nil
 }
 
+// LeaserInterface - interface implements internal logic, it is defined by leaser
+type LeaserInterface = leaser.Interface
+
 // GIpam - implement Docker IPAM Interface
 type GIpam struct {
-	Leaser LeaserInterface
+	Spaces map[string]LeaserInterface
+	Local  string
+	Global string
+}
+
+// poolID - pool id of block in address space, blocks of local space has no prefix
+func (i *GIpam) poolID(space, id string) string {
+	if space == i.Local {
+		return id
+	}
+
+	return space + "/" + id
+}
+
+// route - leaser of address space and block id by pool id
+func (i *GIpam) route(poolID string) (LeaserInterface, string, error) {
+	space, id := i.Local, poolID
+	if s := strings.SplitN(poolID, "/", 2); len(s) == 2 {
+		space, id = s[0], s[1]
+	}
+
+	leaser, ok := i.Spaces[space]
+	if !ok {
+		return nil, "", errors.New("Unknown address space '" + space + "' of pool " + poolID)
+	}
+
+	return leaser, id, nil
 }
 
 // GetCapabilities - returns driver capabilities [ whether or not this IPAM required pre-made MAC ]
@@ -36,43 +87,101 @@ func (i *GIpam) GetCapabilities() (*ipam.CapabilitiesResponse, error) {
 
 // GetDefaultAddressSpaces - returns the default local and global address space names for this IPAM
 func (i *GIpam) GetDefaultAddressSpaces() (*ipam.AddressSpacesResponse, error) {
-	return &ipam.AddressSpacesResponse{}, nil
+	return &ipam.AddressSpacesResponse{LocalDefaultAddressSpace: i.Local, GlobalDefaultAddressSpace: i.Global}, nil
 }
 
-// RequestPool - get one allocated block of IP addresses for lease it to containers
+// RequestPool - get one allocated block of IP addresses for lease it to containers from requested address space.
+// Block size can be requested by --ipam-opt gipam.v4.prefix=26 or gipam.v6.prefix=112.
+// If pool is requested (--subnet), reserve exactly this block, sub pool (--ip-range) restricts addresses inside it.
+// Addresses which are never given to containers can be set by --ipam-opt gipam.exclude=192.168.0.1,192.168.0.10-192.168.0.20
 func (i *GIpam) RequestPool(request *ipam.RequestPoolRequest) (*ipam.RequestPoolResponse, error) {
-	if request.V6 {
-		id, ip, err := i.Leaser.GetBlock(6)
+	space := request.AddressSpace
+	if space == "" {
+		space = i.Local
+	}
+
+	leaser, ok := i.Spaces[space]
+	if !ok {
+		return nil, errors.New("Unknown address space '" + space + "'")
+	}
+
+	var id, ip string
+	var err error
+	switch {
+	case request.Pool != "":
+		id, ip, err = leaser.ReserveBlock(request.Pool, request.SubPool)
+		if err != nil {
+			log.Println("RequestPool: Error", err)
+			return nil, err
+		}
+
+		log.Println("RequestPool [Reserved]:", space, id, ip, request.SubPool)
+
+	case request.SubPool != "":
+		return nil, errors.New("Sub pool " + request.SubPool + " can't be requested without pool")
+
+	default:
+		v, name := uint8(4), "gipam.v4.prefix"
+		if request.V6 {
+			v, name = 6, "gipam.v6.prefix"
+		}
+
+		prefix, err := optionPrefix(request.Options, name)
+		if err != nil {
+			return nil, err
+		}
+
+		id, ip, err = leaser.GetBlock(v, prefix)
 		if err != nil {
 			return nil, err
 		}
 
-		log.Println("RequestPool:", id, ip)
-		return &ipam.RequestPoolResponse{PoolID: id, Pool: ip, Data: nil}, err
+		log.Println("RequestPool:", space, id, ip)
 	}
 
-	id, ip, err := i.Leaser.GetBlock(4)
-	if err != nil {
-		return nil, err
+	if exclude := optionList(request.Options, "gipam.exclude"); len(exclude) != 0 {
+		err = leaser.ExcludeAddresses(id, exclude)
+		if err != nil {
+			log.Println("RequestPool: Error", err)
+			if rerr := leaser.ReturnBlock(id); rerr != nil {
+				log.Println("RequestPool: Error", rerr)
+			}
+
+			return nil, err
+		}
 	}
 
-	log.Println("RequestPool:", id, ip)
-	return &ipam.RequestPoolResponse{PoolID: id, Pool: ip, Data: nil}, err
+	return &ipam.RequestPoolResponse{PoolID: i.poolID(space, id), Pool: ip, Data: nil}, nil
 }
 
 // ReleasePool - return allocated block of IP addresses
 func (i *GIpam) ReleasePool(request *ipam.ReleasePoolRequest) error {
 	log.Println("ReleasePool:", request.PoolID)
-	return i.Leaser.ReturnBlock(request.PoolID)
+
+	leaser, id, err := i.route(request.PoolID)
+	if err != nil {
+		return err
+	}
+
+	return leaser.ReturnBlock(id)
 }
 
-// RequestAddress - get one address from allocated block
+// RequestAddress - get one address from allocated block.
+// If address is requested (--ip), reserve exactly this address.
+// Container with same MAC address gets same address while it is retained.
+// Gateway (--gateway or by policy) is stored separately from container addresses.
 func (i *GIpam) RequestAddress(request *ipam.RequestAddressRequest) (*ipam.RequestAddressResponse, error) {
+	leaser, id, err := i.route(request.PoolID)
+	if err != nil {
+		return nil, err
+	}
+
 	// check request for gateway address and return gateway address if true
 	gw, ok := request.Options["RequestAddressType"]
 	if ok && gw == "com.docker.network.gateway" {
-		ip, err := i.Leaser.GetAddress(request.PoolID)
+		ip, err := leaser.GetGateway(id, request.Address)
 		if err != nil {
+			log.Println("RequestAddress [Gateway]: Error", err)
 			return nil, err
 		}
 
@@ -80,18 +189,65 @@ func (i *GIpam) RequestAddress(request *ipam.RequestAddressRequest) (*ipam.Reque
 		return &ipam.RequestAddressResponse{Address: ip, Data: nil}, err
 	}
 
-	ip, err := i.Leaser.GetAddress(request.PoolID)
+	// container MAC address for sticky leases
+	mac := request.Options["com.docker.network.endpoint.macaddress"]
+
+	if request.Address != "" {
+		ip, err := leaser.ReserveAddress(id, request.Address, mac)
+		if err != nil {
+			log.Println("RequestAddress [Reserved]: Error", err)
+			return nil, err
+		}
+
+		log.Println("RequestAddress [Reserved]:", ip, mac)
+		return &ipam.RequestAddressResponse{Address: ip, Data: nil}, err
+	}
+
+	ip, err := leaser.GetAddress(id, mac)
 	if err != nil {
 		log.Println("RequestAddress: Error", err)
 		return nil, err
 	}
 
-	log.Println("RequestAddress:", ip)
+	log.Println("RequestAddress:", ip, mac)
 	return &ipam.RequestAddressResponse{Address: ip, Data: nil}, err
 }
 
 // ReleaseAddress - return address to block
 func (i *GIpam) ReleaseAddress(request *ipam.ReleaseAddressRequest) error {
 	log.Println("ReleaseAddress:", request.PoolID, request.Address)
-	return i.Leaser.ReturnAddress(request.PoolID, request.Address)
+
+	leaser, id, err := i.route(request.PoolID)
+	if err != nil {
+		return err
+	}
+
+	return leaser.ReturnAddress(id, request.Address)
+}
+
+// optionPrefix - prefix len of block from IPAM driver option, 0 if option is not set
+func optionPrefix(options map[string]string, name string) (uint, error) {
+	opt, ok := options[name]
+	if !ok || opt == "" {
+		return 0, nil
+	}
+
+	prefix, err := strconv.ParseUint(strings.TrimPrefix(opt, "/"), 10, 8)
+	if err != nil || prefix == 0 {
+		return 0, errors.New("Wrong IPAM option " + name + "=" + opt)
+	}
+
+	return uint(prefix), nil
+}
+
+// optionList - comma separated list from IPAM driver option, nil if option is not set
+func optionList(options map[string]string, name string) []string {
+	var r []string
+	for _, item := range strings.Split(options[name], ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			r = append(r, item)
+		}
+	}
+
+	return r
 }
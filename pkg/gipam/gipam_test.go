@@ -1,27 +1,56 @@
 package gipam
 
 import (
+	"errors"
+	"strconv"
 	"testing"
+
+	"github.com/docker/go-plugins-helpers/ipam"
 )
 
 type testLeaser struct{}
 
-func (t *testLeaser) GetBlock(v uint8) (string, string, error) {
+func (t *testLeaser) GetBlock(v uint8, prefix uint) (string, string, error) {
+	if prefix != 0 {
+		return "ccc", "192.168.1.0/" + strconv.Itoa(int(prefix)), nil
+	}
 	return "aaa", "192.168.1.0/16", nil
 }
 
+func (t *testLeaser) ReserveBlock(pool, subPool string) (string, string, error) {
+	return "bbb", pool, nil
+}
+
 func (t *testLeaser) ReturnBlock(string) error {
 	return nil
 }
 
-func (t *testLeaser) GetAddress(string) (string, error) {
+func (t *testLeaser) GetAddress(string, string) (string, error) {
 	return "", nil
 }
 
+func (t *testLeaser) ReserveAddress(id, address, mac string) (string, error) {
+	return address + "/24", nil
+}
+
+func (t *testLeaser) GetGateway(id, address string) (string, error) {
+	if address == "" {
+		return "192.168.3.1/24", nil
+	}
+	return address + "/24", nil
+}
+
 func (t *testLeaser) ReturnAddress(string, string) error {
 	return nil
 }
 
+func (t *testLeaser) ExcludeAddresses(id string, list []string) error {
+	if len(list) != 2 {
+		return errors.New("Wrong excluded addresses")
+	}
+	return nil
+}
+
 // fail make GIpam new leaser is nil
 func TestNewGIpam1(t *testing.T) {
 	gipam, err := New(nil)
@@ -42,12 +71,98 @@ func TestGetCapabilities(t *testing.T) {
 	t.Skip()
 }
 
+// address spaces
+func TestNewSpaces(t *testing.T) {
+	_, err := NewSpaces("local", "global", map[string]LeaserInterface{"local": &testLeaser{}})
+	if err == nil {
+		t.Error("Expected fail for not defined global address space")
+	}
+
+	_, err = NewSpaces("local", "local", map[string]LeaserInterface{"local": &testLeaser{}, "glo/bal": &testLeaser{}})
+	if err == nil {
+		t.Error("Expected fail for wrong address space name")
+	}
+
+	_, err = NewSpaces("local", "local", map[string]LeaserInterface{"local": nil})
+	if err == nil {
+		t.Error("Expected fail for empty leaser of address space")
+	}
+}
+
 func TestGetDefaultAddressSpaces(t *testing.T) {
-	t.Skip()
+	gipam, err := NewSpaces("local", "global", map[string]LeaserInterface{"local": &testLeaser{}, "global": &testLeaser{}})
+	if gipam == nil || err != nil {
+		t.Error("Expected success for init with address spaces")
+	}
+
+	res, err := gipam.GetDefaultAddressSpaces()
+	if err != nil || res.LocalDefaultAddressSpace != "local" || res.GlobalDefaultAddressSpace != "global" {
+		t.Error("Expected local and global address spaces")
+	}
+
+	res2, err := gipam.RequestPool(&ipam.RequestPoolRequest{AddressSpace: "global"})
+	if err != nil || res2.PoolID != "global/aaa" {
+		t.Error("Expected pool id with address space prefix")
+	}
+
+	res2, err = gipam.RequestPool(&ipam.RequestPoolRequest{AddressSpace: "local"})
+	if err != nil || res2.PoolID != "aaa" {
+		t.Error("Expected pool id without prefix in local address space")
+	}
+
+	_, err = gipam.RequestPool(&ipam.RequestPoolRequest{AddressSpace: "unknown"})
+	if err == nil {
+		t.Error("Expected fail for request pool from unknown address space")
+	}
+
+	err = gipam.ReleasePool(&ipam.ReleasePoolRequest{PoolID: "global/aaa"})
+	if err != nil {
+		t.Error("Expected success for release pool of global address space")
+	}
+
+	err = gipam.ReleasePool(&ipam.ReleasePoolRequest{PoolID: "unknown/aaa"})
+	if err == nil {
+		t.Error("Expected fail for release pool of unknown address space")
+	}
 }
 
 func TestRequestPool(t *testing.T) {
-	t.Skip()
+	gipam, _ := New(&testLeaser{})
+
+	res, err := gipam.RequestPool(&ipam.RequestPoolRequest{})
+	if err != nil || res.PoolID != "aaa" {
+		t.Error("Expected success for request next pool")
+	}
+
+	res, err = gipam.RequestPool(&ipam.RequestPoolRequest{Pool: "192.168.3.0/24", SubPool: "192.168.3.0/25"})
+	if err != nil || res.PoolID != "bbb" || res.Pool != "192.168.3.0/24" {
+		t.Error("Expected success for request user-specified pool")
+	}
+
+	_, err = gipam.RequestPool(&ipam.RequestPoolRequest{SubPool: "192.168.3.0/25"})
+	if err == nil {
+		t.Error("Expected fail for request sub pool without pool")
+	}
+
+	res, err = gipam.RequestPool(&ipam.RequestPoolRequest{Options: map[string]string{"gipam.v4.prefix": "26"}})
+	if err != nil || res.PoolID != "ccc" || res.Pool != "192.168.1.0/26" {
+		t.Error("Expected success for request pool with prefix option")
+	}
+
+	_, err = gipam.RequestPool(&ipam.RequestPoolRequest{V6: true, Options: map[string]string{"gipam.v6.prefix": "bla"}})
+	if err == nil {
+		t.Error("Expected fail for request pool with wrong prefix option")
+	}
+
+	res, err = gipam.RequestPool(&ipam.RequestPoolRequest{Options: map[string]string{"gipam.exclude": "192.168.1.1, 192.168.1.10-192.168.1.20"}})
+	if err != nil || res.PoolID != "aaa" {
+		t.Error("Expected success for request pool with excluded addresses")
+	}
+
+	_, err = gipam.RequestPool(&ipam.RequestPoolRequest{Options: map[string]string{"gipam.exclude": "bla"}})
+	if err == nil {
+		t.Error("Expected fail for request pool with wrong excluded addresses")
+	}
 }
 
 func TestReleasePool(t *testing.T) {
@@ -55,7 +170,23 @@ func TestReleasePool(t *testing.T) {
 }
 
 func TestRequestAddress(t *testing.T) {
-	t.Skip()
+	gipam, _ := New(&testLeaser{})
+
+	res, err := gipam.RequestAddress(&ipam.RequestAddressRequest{PoolID: "aaa", Address: "192.168.3.50"})
+	if err != nil || res.Address != "192.168.3.50/24" {
+		t.Error("Expected success for request static address")
+	}
+
+	gw := map[string]string{"RequestAddressType": "com.docker.network.gateway"}
+	res, err = gipam.RequestAddress(&ipam.RequestAddressRequest{PoolID: "aaa", Options: gw})
+	if err != nil || res.Address != "192.168.3.1/24" {
+		t.Error("Expected success for request gateway by policy")
+	}
+
+	res, err = gipam.RequestAddress(&ipam.RequestAddressRequest{PoolID: "aaa", Address: "192.168.3.254", Options: gw})
+	if err != nil || res.Address != "192.168.3.254/24" {
+		t.Error("Expected success for request explicit gateway")
+	}
 }
 
 func TestReleaseAddress(t *testing.T) {
@@ -1,84 +1,388 @@
 package leaser
 
 import (
+	"bufio"
 	"bytes"
-	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"time"
+	"path/filepath"
+	"strconv"
 )
 
-// NewBackup makes new leaser backup.
-// It will save leser structure to file and restore it.
-func NewBackup(file string) (*Backup, error) {
+// leaseHeader - first line of lease file: format version, generation, journal sequence number and checksum of JSON state after it.
+// Lease file without header (written by hand) is read as plain JSON.
+const leaseHeader = "# gipam lease v1 gen=%d seq=%d sha256=%s\n"
+
+// NewBackup makes new leaser backup, it is JSON file store.
+// It will save leser structure to file and restore it, generations is count of kept previous files.
+// Mutations between saves are written to journal file (lease.json.journal).
+func NewBackup(file string, generations uint) (*Backup, error) {
 	if file == "" {
 		return nil, errors.New("file name is empty")
 	}
 
-	return &Backup{LeaseFile: file, previousState: &[]byte{}}, nil
+	return &Backup{LeaseFile: file, Generations: generations, previousState: &[]byte{}}, nil
+}
+
+// NewReadOnlyBackup - JSON file store which is only loaded, journal isn't opened for write and state isn't saved.
+// Other processes can read lease file too, but driver which writes it can't run at the same time.
+func NewReadOnlyBackup(file string, generations uint) (*Backup, error) {
+	lb, err := NewBackup(file, generations)
+	if err != nil {
+		return nil, err
+	}
+
+	lb.readOnly = true
+	return lb, nil
 }
 
 // Backup contains methods for save and restore leaser
 type Backup struct {
-	LeaseFile     string
+	LeaseFile   string
+	Generations uint // previous lease files: lease.json.1 (newest) ... lease.json.N (oldest)
+
+	generation    uint64
 	previousState *[]byte
+
+	journal  *Journal
+	seqs     []uint64 // journal sequence numbers of lease file generations, oldest first
+	lockFile *os.File
+	readOnly bool
 }
 
-// Saver - background save every 30 seconds
-func (lb *Backup) Saver(ctx context.Context, lsr *Leaser) {
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("Saver canseled")
-			return
+// lock - take lock of lease file once, it is held until Close. Lease file is replaced by rename on every save,
+// so lock is taken on lease.json.lock beside it. Store which writes has exclusive lock, read-only stores share lock.
+func (lb *Backup) lock() error {
+	if lb.lockFile != nil {
+		return nil
+	}
+
+	f, err := lockFile(lb.LeaseFile+".lock", !lb.readOnly)
+	if err != nil {
+		return errors.New("Can't lock lease file " + lb.LeaseFile + ": " + err.Error())
+	}
+
+	lb.lockFile = f
+	return nil
+}
+
+// Load - restore state from lease file and replay journal to it
+func (lb *Backup) Load() (*Leaser, error) {
+	if err := lb.lock(); err != nil {
+		return nil, err
+	}
 
-		case <-time.NewTicker(30 * time.Second).C:
-			lb.Save(lsr)
+	j, err := lb.openJournal()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := j.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	lsr, err := lb.Restore()
+	if err == ErrNoState && len(entries) != 0 {
+		return nil, errors.New("Journal " + j.File + " exists without lease file")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = lsr.Replay(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) != 0 {
+		log.Println("Journal", j.File, "is replayed, state sequence:", lsr.Seq)
+	}
+
+	lb.seqs = lb.generationSeqs()
+	return lsr, nil
+}
+
+// generationSeqs - journal sequence numbers of lease file generations which are on disk, oldest first.
+// Sequence number of broken file or file without header is unknown, it is 0, so journal isn't compacted while the file is kept.
+func (lb *Backup) generationSeqs() []uint64 {
+	var seqs []uint64
+	for g := int(lb.Generations); g >= 0; g-- {
+		data, err := ioutil.ReadFile(lb.generationFile(uint(g)))
+		if err != nil {
+			continue
 		}
+
+		_, seq, _, _ := readHeader(data)
+		seqs = append(seqs, seq)
 	}
+
+	return seqs
 }
 
-// Save - save state of leases to file
-func (lb *Backup) Save(lsr *Leaser) {
-	ml, err := lsr.MarshalJSON()
+// Update - write mutation to journal
+func (lb *Backup) Update(e *JournalEntry) error {
+	if lb.readOnly {
+		return errors.New("Lease file " + lb.LeaseFile + " is opened read-only")
+	}
+
+	if err := lb.lock(); err != nil {
+		return err
+	}
+
+	j, err := lb.openJournal()
 	if err != nil {
-		log.Println("Create json with leases error:", err)
-		return
+		return err
+	}
+
+	return j.Append(e)
+}
+
+// Close - close journal and release lock of lease file, next mutations of leaser will fail
+func (lb *Backup) Close() error {
+	var err error
+	if lb.journal != nil {
+		err = lb.journal.Close()
+	}
+
+	if lb.lockFile != nil {
+		lb.lockFile.Close()
+		lb.lockFile = nil
+	}
+
+	return err
+}
+
+// openJournal - journal file, it is opened once. Read-only store reads journal without opening it for append.
+func (lb *Backup) openJournal() (*Journal, error) {
+	if lb.journal != nil {
+		return lb.journal, nil
+	}
+
+	if lb.readOnly {
+		return &Journal{File: lb.LeaseFile + ".journal"}, nil
+	}
+
+	j, err := OpenJournal(lb.LeaseFile + ".journal")
+	if err != nil {
+		return nil, err
+	}
+
+	lb.journal = j
+	return j, nil
+}
+
+// Save - save state of leases to file.
+// State is written to temporary file and synced, previous files are rotated, then temporary file is renamed to lease file,
+// so lease file is always complete. Journal entries which are saved in all kept lease files are removed.
+func (lb *Backup) Save(lsr *Leaser) error {
+	if lb.readOnly {
+		return errors.New("Lease file " + lb.LeaseFile + " is opened read-only")
+	}
+
+	if err := lb.lock(); err != nil {
+		return err
+	}
+
+	ml, seq, err := lsr.Snapshot()
+	if err != nil {
+		return errors.New("Create json with leases error: " + err.Error())
 	}
 
 	if bytes.Equal(*lb.previousState, ml) {
-		return
+		return nil
 	}
 
-	file, err := os.Create(lb.LeaseFile)
+	err = lb.write(ml, seq)
 	if err != nil {
-		log.Println("Open leases file error:", err)
+		return errors.New("Write leases file error: " + err.Error())
+	}
+
+	lb.previousState = &ml
+	lb.compact(seq)
+	return nil
+}
+
+// compact - remove journal entries which are saved in all kept lease file generations, so state can be restored
+// from the oldest generation and journal
+func (lb *Backup) compact(seq uint64) {
+	if lb.journal == nil {
 		return
 	}
-	defer file.Close()
 
-	_, err = file.Write(ml)
+	lb.seqs = append(lb.seqs, seq)
+	if n := int(lb.Generations) + 1; len(lb.seqs) > n {
+		lb.seqs = lb.seqs[len(lb.seqs)-n:]
+	}
+
+	if err := lb.journal.Compact(lb.seqs[0]); err != nil {
+		log.Println("Compact journal error:", err)
+	}
+}
+
+// write - write state with header to temporary file, rotate generations and replace lease file
+func (lb *Backup) write(state []byte, seq uint64) error {
+	sum := sha256.Sum256(state)
+	data := append([]byte(fmt.Sprintf(leaseHeader, lb.generation+1, seq, hex.EncodeToString(sum[:]))), state...)
+
+	tmp := lb.LeaseFile + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+
 	if err != nil {
-		log.Println("Write leases file error:", err)
-	} else {
-		lb.previousState = &ml
+		os.Remove(tmp)
+		return err
+	}
+
+	lb.rotate()
+
+	err = os.Rename(tmp, lb.LeaseFile)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	syncDir(filepath.Dir(lb.LeaseFile))
+	lb.generation++
+	return nil
+}
+
+// rotate - shift previous lease files by one generation, current lease file becomes first generation.
+// Current lease file is copied by hard link, so lease file exists all the time.
+func (lb *Backup) rotate() {
+	if lb.Generations == 0 {
+		return
+	}
+
+	for g := lb.Generations - 1; g > 0; g-- {
+		os.Rename(lb.generationFile(g), lb.generationFile(g+1))
+	}
+
+	first := lb.generationFile(1)
+	os.Remove(first)
+	if err := os.Link(lb.LeaseFile, first); err != nil && !os.IsNotExist(err) {
+		log.Println("Rotate leases file error:", err)
 	}
 }
 
-// Restore - restore previous state from file
+// generationFile - file name of previous generation, 0 is current lease file
+func (lb *Backup) generationFile(g uint) string {
+	if g == 0 {
+		return lb.LeaseFile
+	}
+
+	return lb.LeaseFile + "." + strconv.Itoa(int(g))
+}
+
+// Restore - restore previous state from file.
+// If lease file is broken (checksum mismatch or wrong JSON), the newest valid previous generation is used.
 func (lb *Backup) Restore() (*Leaser, error) {
-	lf, err := ioutil.ReadFile(lb.LeaseFile)
+	var found bool
+	var lastErr error
+	for g := uint(0); g <= lb.Generations; g++ {
+		name := lb.generationFile(g)
+		lf, err := ioutil.ReadFile(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		found = true
+
+		if err == nil {
+			var lsr *Leaser
+			var gen uint64
+			var state []byte
+			lsr, gen, state, err = readLease(lf)
+			if err == nil {
+				// state of lease file isn't written again until it is changed, broken lease file is replaced on next save
+				if g == 0 {
+					lb.previousState = &state
+				} else {
+					log.Println("Leases restored from previous generation file", name)
+				}
+
+				lb.generation = gen
+				return lsr, nil
+			}
+		}
+
+		log.Println("Restore leases file", name, "error:", err)
+		lastErr = err
+	}
+
+	if !found {
+		return nil, ErrNoState
+	}
+
+	return nil, errors.New("No valid lease file, last error: " + lastErr.Error())
+}
+
+// readLease - check header and restore leaser from lease file data, generation and JSON state are returned too
+func readLease(data []byte) (*Leaser, uint64, []byte, error) {
+	gen, _, state, err := readHeader(data)
 	if err != nil {
-		return nil, err
+		return nil, 0, nil, err
 	}
 
 	var lsr Leaser
-	err = lsr.UnmarshalJSON(lf)
+	err = lsr.UnmarshalJSON(state)
 	if err != nil {
-		return nil, err
+		return nil, 0, nil, err
+	}
+
+	return &lsr, gen, state, nil
+}
+
+// readHeader - check header of lease file data, generation, journal sequence number and JSON state after header.
+// Data without header is JSON state of 0 generation.
+func readHeader(data []byte) (uint64, uint64, []byte, error) {
+	if !bytes.HasPrefix(data, []byte("#")) {
+		return 0, 0, data, nil
+	}
+
+	line, err := bufio.NewReader(bytes.NewReader(data)).ReadBytes('\n')
+	if err != nil {
+		return 0, 0, nil, errors.New("Lease file header is truncated")
+	}
+
+	var gen, seq uint64
+	var sum string
+	if _, err := fmt.Sscanf(string(line), leaseHeader, &gen, &seq, &sum); err != nil {
+		return 0, 0, nil, errors.New("Wrong lease file header")
+	}
+
+	data = data[len(line):]
+	actual := sha256.Sum256(data)
+	if hex.EncodeToString(actual[:]) != sum {
+		return 0, 0, nil, errors.New("Lease file checksum mismatch")
+	}
+
+	return gen, seq, data, nil
+}
+
+// syncDir - flush directory entry changes (rename) to disk
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
 	}
+	defer d.Close()
 
-	return &lsr, nil
+	d.Sync()
 }
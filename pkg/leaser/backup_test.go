@@ -0,0 +1,205 @@
+package leaser
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupSaveRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gipam")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "lease.json")
+	lb, err := NewBackup(file, 2)
+	require.NoError(t, err)
+
+	_, err = lb.Restore()
+	require.Equal(t, ErrNoState, err)
+
+	lsr, err := New("fe80::/48", "192.168.0.0/16", 64, 24)
+	require.NoError(t, err)
+
+	// every save makes new generation
+	var blocks []string
+	for i := 0; i < 3; i++ {
+		_, pool, err := lsr.GetBlock(4, 0)
+		require.NoError(t, err)
+		blocks = append(blocks, pool)
+		lb.Save(lsr)
+	}
+
+	data, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(data), "# gipam lease v1 gen=3 seq=0 sha256="))
+
+	_, err = os.Stat(file + ".2")
+	require.NoError(t, err)
+	_, err = os.Stat(file + ".3")
+	require.True(t, os.IsNotExist(err))
+
+	_, err = os.Stat(file + ".tmp")
+	require.True(t, os.IsNotExist(err))
+
+	restored, err := lb.Restore()
+	require.NoError(t, err)
+	require.Len(t, restored.Allocated, 3)
+
+	// truncated lease file, newest valid generation is used
+	require.NoError(t, ioutil.WriteFile(file, data[:len(data)/2], 0644))
+	restored, err = lb.Restore()
+	require.NoError(t, err)
+	require.Len(t, restored.Allocated, 2)
+
+	// checksum mismatch
+	require.NoError(t, ioutil.WriteFile(file, []byte(strings.Replace(string(data), blocks[2], "192.168.9.0/24", 1)), 0644))
+	restored, err = lb.Restore()
+	require.NoError(t, err)
+	require.Len(t, restored.Allocated, 2)
+
+	// all generations are broken
+	for _, f := range []string{file, file + ".1", file + ".2"} {
+		require.NoError(t, ioutil.WriteFile(f, []byte("{"), 0644))
+	}
+
+	_, err = lb.Restore()
+	require.Error(t, err)
+	require.NotEqual(t, ErrNoState, err)
+}
+
+// TestBackupJournalGenerations - journal keeps entries which are needed by previous generations after restart
+func TestBackupJournalGenerations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gipam")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "lease.json")
+	lb, err := NewBackup(file, 2)
+	require.NoError(t, err)
+
+	lsr, err := New("fe80::/48", "192.168.0.0/16", 64, 24)
+	require.NoError(t, err)
+	require.NoError(t, lb.Save(lsr))
+	lsr.SetStore(lb)
+
+	_, _, err = lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+	require.NoError(t, lb.Save(lsr))
+
+	// second block is only in journal at restart
+	_, _, err = lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+	require.NoError(t, lb.Close())
+
+	lb, err = NewBackup(file, 2)
+	require.NoError(t, err)
+	lsr, err = lb.Load()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lsr.Seq)
+	lsr.SetStore(lb)
+
+	_, _, err = lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+	require.NoError(t, lb.Save(lsr))
+	require.NoError(t, lb.Close())
+
+	// newest file is broken, previous generation and journal give the same state
+	require.NoError(t, ioutil.WriteFile(file, []byte("{"), 0644))
+
+	lb, err = NewBackup(file, 2)
+	require.NoError(t, err)
+	defer lb.Close()
+
+	restored, err := lb.Load()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), restored.Seq)
+	require.Len(t, restored.Allocated, 3)
+}
+
+func TestBackupRestorePlainJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gipam")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// lease file written by hand has no header
+	file := filepath.Join(dir, "lease.json")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`{"v4": "192.168.0.0/16", "v4ab": 24}`), 0644))
+
+	lb, err := NewBackup(file, 3)
+	require.NoError(t, err)
+
+	lsr, err := lb.Restore()
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.0/16", lsr.V4Pool.String())
+}
+
+// TestBackupLoadUnchanged - state which is the same as lease file isn't saved again after restart, so generations are kept
+func TestBackupLoadUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gipam")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "lease.json")
+	lb, err := NewBackup(file, 2)
+	require.NoError(t, err)
+
+	lsr, err := New("fe80::/48", "192.168.0.0/16", 64, 24)
+	require.NoError(t, err)
+	require.NoError(t, lb.Save(lsr))
+	lsr.SetStore(lb)
+
+	_, _, err = lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+	require.NoError(t, lb.Save(lsr))
+	require.NoError(t, lb.Close())
+
+	read := func() []string {
+		var files []string
+		for _, name := range []string{file, file + ".1", file + ".2"} {
+			data, _ := ioutil.ReadFile(name)
+			files = append(files, string(data))
+		}
+
+		return files
+	}
+
+	before := read()
+	for i := 0; i < 3; i++ {
+		lb, err = NewBackup(file, 2)
+		require.NoError(t, err)
+		lsr, err = lb.Load()
+		require.NoError(t, err)
+		require.NoError(t, lb.Save(lsr))
+		require.NoError(t, lb.Close())
+	}
+
+	require.Equal(t, before, read())
+
+	// replayed journal is saved
+	lb, err = NewBackup(file, 2)
+	require.NoError(t, err)
+	lsr, err = lb.Load()
+	require.NoError(t, err)
+	lsr.SetStore(lb)
+
+	_, _, err = lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+	require.NoError(t, lb.Close())
+
+	lb, err = NewBackup(file, 2)
+	require.NoError(t, err)
+	defer lb.Close()
+
+	lsr, err = lb.Load()
+	require.NoError(t, err)
+	require.NoError(t, lb.Save(lsr))
+
+	after := read()
+	require.NotEqual(t, before[0], after[0])
+	require.Equal(t, before[0], after[1])
+}
@@ -0,0 +1,155 @@
+package leaser
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltState   = []byte("state")
+	boltJournal = []byte("journal")
+	boltLeaser  = []byte("leaser")
+)
+
+// NewBoltStore - open or create embedded bbolt database
+func NewBoltStore(file string) (*BoltStore, error) {
+	return openBolt(file, false)
+}
+
+// openBolt - open database, read-only database shares lock with other readers and it must exist
+func openBolt(file string, readOnly bool) (*BoltStore, error) {
+	if file == "" {
+		return nil, errors.New("Database file name is empty")
+	}
+
+	db, err := bolt.Open(file, 0644, &bolt.Options{Timeout: time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return nil, errors.New("Can't open database " + file + ": " + err.Error())
+	}
+
+	if readOnly {
+		return &BoltStore{File: file, db: db}, nil
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{boltState, boltJournal} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{File: file, db: db}, nil
+}
+
+// BoltStore - state in embedded bbolt database: bucket 'state' keeps whole leaser, bucket 'journal' keeps mutations by sequence number
+type BoltStore struct {
+	File string
+
+	db *bolt.DB
+}
+
+// Load - saved state with journal replayed to it
+func (bs *BoltStore) Load() (*Leaser, error) {
+	var state []byte
+	var entries []*JournalEntry
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		// read-only database doesn't create buckets
+		if tx.Bucket(boltState) == nil || tx.Bucket(boltJournal) == nil {
+			return nil
+		}
+
+		if v := tx.Bucket(boltState).Get(boltLeaser); v != nil {
+			state = append([]byte{}, v...)
+		}
+
+		return tx.Bucket(boltJournal).ForEach(func(k, v []byte) error {
+			var e JournalEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+
+			entries = append(entries, &e)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if state == nil {
+		if len(entries) != 0 {
+			return nil, errors.New("Journal exists without state in database " + bs.File)
+		}
+
+		return nil, ErrNoState
+	}
+
+	var lsr Leaser
+	err = lsr.UnmarshalJSON(state)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lsr.Replay(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lsr, nil
+}
+
+// Save - save state and remove journal entries which are in it
+func (bs *BoltStore) Save(lsr *Leaser) error {
+	state, seq, err := lsr.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(boltState).Put(boltLeaser, state); err != nil {
+			return err
+		}
+
+		c := tx.Bucket(boltJournal).Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= seq; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Update - write mutation to journal, it is synced on commit
+func (bs *BoltStore) Update(e *JournalEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, e.Seq)
+
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltJournal).Put(key, data)
+	})
+}
+
+// Close - close database
+func (bs *BoltStore) Close() error {
+	return bs.db.Close()
+}
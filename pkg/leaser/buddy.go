@@ -0,0 +1,376 @@
+package leaser
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	iplib "github.com/dspinhirne/netaddr-go"
+)
+
+// NewBuddy creates binary prefix tree (buddy) allocator of main pool, all pool is free
+func NewBuddy(pool string) (*Buddy, error) {
+	base, prefix, bits, err := parseBlock(pool)
+	if err != nil {
+		return nil, err
+	}
+
+	bd := &Buddy{Pool: pool, base: base, prefix: prefix, bits: bits, free: map[uint][]u128{}}
+	bd.insert(base, prefix)
+
+	return bd, nil
+}
+
+// Buddy - allocator of blocks with mixed prefix len from main pool.
+// Free space is kept as lists of free blocks by prefix len, released block is joined with free neighbor (buddy) back into larger block.
+type Buddy struct {
+	Pool string
+
+	base   u128
+	prefix uint
+	bits   uint
+	free   map[uint][]u128 // sorted free blocks by prefix len
+}
+
+// BuddyStats - free space of main pool
+type BuddyStats struct {
+	Pool          string       `json:"pool"`
+	Free          map[uint]int `json:"free"`          // count of free blocks by prefix len
+	Largest       uint         `json:"largest"`       // prefix len of largest free block, 0 if pool is full
+	Fragmentation float64      `json:"fragmentation"` // 0 - free space is one block, close to 1 - free space is split to many small blocks
+	Used          float64      `json:"used"`          // allocated part of main pool, from 0 to 1
+}
+
+// Allocate - cut block with prefix len from the smallest free block which fits, lowest address first
+func (bd *Buddy) Allocate(prefix uint) (string, error) {
+	if prefix <= bd.prefix || prefix >= bd.bits {
+		return "", errors.New("Wrong block len /" + strconv.Itoa(int(prefix)) + " for main pool " + bd.Pool)
+	}
+
+	// smallest free block which can contain requested one
+	p := prefix
+	for len(bd.free[p]) == 0 {
+		if p == bd.prefix {
+			return "", errors.New("No free /" + strconv.Itoa(int(prefix)) + " block in main pool " + bd.Pool)
+		}
+		p--
+	}
+
+	base := bd.free[p][0]
+	bd.free[p] = bd.free[p][1:]
+
+	// split it, upper halves are free
+	for ; p < prefix; p++ {
+		bd.insert(base.or(bd.size(p+1)), p+1)
+	}
+
+	return formatBlock(base, prefix, bd.bits), nil
+}
+
+// Reserve - cut exactly requested block, error if it is not free
+func (bd *Buddy) Reserve(block string) error {
+	base, prefix, err := bd.parse(block)
+	if err != nil {
+		return err
+	}
+
+	// free block which contains requested one
+	p := prefix
+	for !bd.remove(base.mask(p, bd.bits), p) {
+		if p == bd.prefix {
+			return errors.New("Block " + block + " is not free in main pool " + bd.Pool)
+		}
+		p--
+	}
+
+	// split it, halves without requested block are free
+	for ; p < prefix; p++ {
+		half := base.mask(p+1, bd.bits)
+		bd.insert(half.xor(bd.size(p+1)), p+1)
+	}
+
+	return nil
+}
+
+// Release - return block to free and join it with free buddies
+func (bd *Buddy) Release(block string) error {
+	base, prefix, err := bd.parse(block)
+	if err != nil {
+		return err
+	}
+
+	if bd.isFree(base, prefix) {
+		return errors.New("Block " + block + " is already free in main pool " + bd.Pool)
+	}
+
+	if bd.hasFree(base, prefix) {
+		return errors.New("Block " + block + " contains free block in main pool " + bd.Pool)
+	}
+
+	for p := prefix; p > bd.prefix; p-- {
+		buddy := base.xor(bd.size(p))
+		if !bd.remove(buddy, p) {
+			bd.insert(base, p)
+			return nil
+		}
+
+		base = base.mask(p-1, bd.bits)
+	}
+
+	bd.insert(base, bd.prefix)
+	return nil
+}
+
+// Stats - free space and fragmentation of main pool
+func (bd *Buddy) Stats() BuddyStats {
+	st := BuddyStats{Pool: bd.Pool, Free: map[uint]int{}}
+
+	var total, largest float64
+	for p, blocks := range bd.free {
+		if len(blocks) == 0 {
+			continue
+		}
+
+		st.Free[p] = len(blocks)
+
+		size := math.Pow(2, float64(bd.bits-p))
+		total += size * float64(len(blocks))
+		if size > largest {
+			largest = size
+			st.Largest = p
+		}
+	}
+
+	if total > 0 {
+		st.Fragmentation = 1 - largest/total
+	}
+
+	st.Used = 1 - total/math.Pow(2, float64(bd.bits-bd.prefix))
+	return st
+}
+
+// Capacity - count of blocks with prefix len in main pool
+func (bd *Buddy) Capacity(prefix uint) float64 {
+	if prefix < bd.prefix {
+		return 0
+	}
+
+	return math.Pow(2, float64(prefix-bd.prefix))
+}
+
+// Available - count of blocks with prefix len which can be allocated from free space
+func (bd *Buddy) Available(prefix uint) float64 {
+	var n float64
+	for p, blocks := range bd.free {
+		if p <= prefix {
+			n += math.Pow(2, float64(prefix-p)) * float64(len(blocks))
+		}
+	}
+
+	return n
+}
+
+// FreeBlocks - all free blocks sorted by address, it is stable representation of allocator state
+func (bd *Buddy) FreeBlocks() []string {
+	type block struct {
+		base   u128
+		prefix uint
+	}
+
+	var blocks []block
+	for p, bases := range bd.free {
+		for _, b := range bases {
+			blocks = append(blocks, block{b, p})
+		}
+	}
+
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].base.less(blocks[j].base) })
+
+	r := make([]string, 0, len(blocks))
+	for _, b := range blocks {
+		r = append(r, formatBlock(b.base, b.prefix, bd.bits))
+	}
+
+	return r
+}
+
+// parse - parse block and check it is inside main pool
+func (bd *Buddy) parse(block string) (u128, uint, error) {
+	base, prefix, bits, err := parseBlock(block)
+	if err != nil {
+		return u128{}, 0, err
+	}
+
+	if bits != bd.bits || prefix < bd.prefix || base.mask(bd.prefix, bd.bits) != bd.base {
+		return u128{}, 0, errors.New("Block " + block + " is out of main pool " + bd.Pool)
+	}
+
+	return base, prefix, nil
+}
+
+// size - size of block with prefix len, it is one bit
+func (bd *Buddy) size(prefix uint) u128 {
+	return bit(bd.bits - prefix)
+}
+
+// isFree - true if block or block which contains it is free
+func (bd *Buddy) isFree(base u128, prefix uint) bool {
+	for p := prefix; p >= bd.prefix; p-- {
+		b := base.mask(p, bd.bits)
+		i := sort.Search(len(bd.free[p]), func(i int) bool { return !bd.free[p][i].less(b) })
+		if i < len(bd.free[p]) && bd.free[p][i] == b {
+			return true
+		}
+
+		if p == 0 {
+			break
+		}
+	}
+
+	return false
+}
+
+// hasFree - true if free block lies inside block, block which is partly free can't be released
+func (bd *Buddy) hasFree(base u128, prefix uint) bool {
+	for p, l := range bd.free {
+		if p <= prefix {
+			continue
+		}
+
+		i := sort.Search(len(l), func(i int) bool { return !l[i].less(base) })
+		if i < len(l) && l[i].mask(prefix, bd.bits) == base {
+			return true
+		}
+	}
+
+	return false
+}
+
+// insert - add free block keeping list sorted
+func (bd *Buddy) insert(base u128, prefix uint) {
+	l := bd.free[prefix]
+	i := sort.Search(len(l), func(i int) bool { return !l[i].less(base) })
+	l = append(l, u128{})
+	copy(l[i+1:], l[i:])
+	l[i] = base
+	bd.free[prefix] = l
+}
+
+// remove - delete free block, false if block is not free
+func (bd *Buddy) remove(base u128, prefix uint) bool {
+	l := bd.free[prefix]
+	i := sort.Search(len(l), func(i int) bool { return !l[i].less(base) })
+	if i == len(l) || l[i] != base {
+		return false
+	}
+
+	bd.free[prefix] = append(l[:i], l[i+1:]...)
+	return true
+}
+
+// u128 - IPv4 or IPv6 address as 128 bit number
+type u128 struct {
+	hi, lo uint64
+}
+
+// bit - number with one bit n
+func bit(n uint) u128 {
+	if n >= 64 {
+		return u128{hi: 1 << (n - 64)}
+	}
+
+	return u128{lo: 1 << n}
+}
+
+func (a u128) or(b u128) u128 {
+	return u128{a.hi | b.hi, a.lo | b.lo}
+}
+
+func (a u128) xor(b u128) u128 {
+	return u128{a.hi ^ b.hi, a.lo ^ b.lo}
+}
+
+func (a u128) less(b u128) bool {
+	return a.hi < b.hi || a.hi == b.hi && a.lo < b.lo
+}
+
+// mask - clear host bits of address with prefix len in address of bits len
+func (a u128) mask(prefix, bits uint) u128 {
+	host := bits - prefix
+	switch {
+	case host == 0:
+		return a
+	case host >= 128:
+		return u128{}
+	case host >= 64:
+		return u128{hi: a.hi &^ (1<<(host-64) - 1)}
+	default:
+		return u128{hi: a.hi, lo: a.lo &^ (1<<host - 1)}
+	}
+}
+
+// fill - set host bits of address with prefix len in address of bits len, it is last address of block
+func (a u128) fill(prefix, bits uint) u128 {
+	host := bits - prefix
+	switch {
+	case host == 0:
+		return a
+	case host >= 128:
+		return u128{^uint64(0), ^uint64(0)}
+	case host >= 64:
+		return u128{hi: a.hi | (1<<(host-64) - 1), lo: ^uint64(0)}
+	default:
+		return u128{hi: a.hi, lo: a.lo | (1<<host - 1)}
+	}
+}
+
+// parseAddr - address and address bits len (32 or 128)
+func parseAddr(ip string) (u128, uint, error) {
+	ipo, err := iplib.ParseIP(ip)
+	if err != nil {
+		return u128{}, 0, errors.New("Can't parce address " + ip)
+	}
+
+	switch ipo := ipo.(type) {
+	case *iplib.IPv6:
+		return u128{ipo.NetId(), ipo.HostId()}, 128, nil
+
+	case *iplib.IPv4:
+		return u128{lo: uint64(ipo.Addr())}, 32, nil
+	}
+
+	return u128{}, 0, errors.New("Can't parce address " + ip)
+}
+
+// parseBlock - network address, prefix len and address bits len (32 or 128) of block
+func parseBlock(block string) (u128, uint, uint, error) {
+	if !strings.Contains(block, "/") {
+		return u128{}, 0, 0, errors.New("Block " + block + " has no prefix len")
+	}
+
+	pn, err := iplib.ParseIPNet(block)
+	if err != nil {
+		return u128{}, 0, 0, errors.New("Can't parce block " + block)
+	}
+
+	switch pn := pn.(type) {
+	case *iplib.IPv6Net:
+		return u128{pn.Network().NetId(), pn.Network().HostId()}, pn.Netmask().PrefixLen(), 128, nil
+
+	case *iplib.IPv4Net:
+		return u128{lo: uint64(pn.Network().Addr())}, pn.Netmask().PrefixLen(), 32, nil
+	}
+
+	return u128{}, 0, 0, errors.New("Can't parce block " + block)
+}
+
+// formatBlock - block in CIDR format
+func formatBlock(base u128, prefix, bits uint) string {
+	if bits == 32 {
+		return iplib.NewIPv4(uint32(base.lo)).String() + "/" + strconv.Itoa(int(prefix))
+	}
+
+	return iplib.NewIPv6(base.hi, base.lo).String() + "/" + strconv.Itoa(int(prefix))
+}
@@ -0,0 +1,162 @@
+package leaser
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuddyAllocate(t *testing.T) {
+	bd, err := NewBuddy("192.168.0.0/16")
+	require.NoError(t, err)
+
+	b, err := bd.Allocate(24)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.0/24", b)
+
+	b, err = bd.Allocate(26)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.1.0/26", b)
+
+	b, err = bd.Allocate(24)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.2.0/24", b)
+
+	_, err = bd.Allocate(16)
+	require.Error(t, err)
+
+	_, err = bd.Allocate(32)
+	require.Error(t, err)
+
+	// /17 is split to /24 and /26, so only one /17 is free
+	_, err = bd.Allocate(17)
+	require.NoError(t, err)
+
+	_, err = bd.Allocate(17)
+	require.Error(t, err)
+
+	bd6, err := NewBuddy("2001:db8::/48")
+	require.NoError(t, err)
+
+	b, err = bd6.Allocate(64)
+	require.NoError(t, err)
+	require.Equal(t, "2001:db8::/64", b)
+
+	b, err = bd6.Allocate(112)
+	require.NoError(t, err)
+	require.Equal(t, "2001:db8:0:1::/112", b)
+
+	b, err = bd6.Allocate(64)
+	require.NoError(t, err)
+	require.Equal(t, "2001:db8:0:2::/64", b)
+}
+
+func TestBuddyRelease(t *testing.T) {
+	bd, err := NewBuddy("10.0.0.0/22")
+	require.NoError(t, err)
+
+	a, _ := bd.Allocate(24)
+	b, _ := bd.Allocate(24)
+	c, _ := bd.Allocate(25)
+	require.Equal(t, []string{"10.0.2.128/25", "10.0.3.0/24"}, bd.FreeBlocks())
+
+	require.NoError(t, bd.Release(b))
+	require.Error(t, bd.Release(b))
+	require.Equal(t, []string{"10.0.1.0/24", "10.0.2.128/25", "10.0.3.0/24"}, bd.FreeBlocks())
+
+	// neighbors are joined back to main pool
+	require.NoError(t, bd.Release(a))
+	require.NoError(t, bd.Release(c))
+	require.Equal(t, []string{"10.0.0.0/22"}, bd.FreeBlocks())
+
+	require.Error(t, bd.Release("10.1.0.0/24"))
+
+	// block which contains free block isn't released, free blocks don't overlap
+	_, err = bd.Allocate(23)
+	require.NoError(t, err)
+	_, err = bd.Allocate(23)
+	require.NoError(t, err)
+	require.NoError(t, bd.Release("10.0.2.0/24"))
+	require.Error(t, bd.Release("10.0.2.0/23"))
+	require.Error(t, bd.Release("10.0.0.0/22"))
+	require.Equal(t, []string{"10.0.2.0/24"}, bd.FreeBlocks())
+}
+
+func TestBuddyReserve(t *testing.T) {
+	bd, err := NewBuddy("10.0.0.0/16")
+	require.NoError(t, err)
+
+	require.NoError(t, bd.Reserve("10.0.5.0/24"))
+	require.Error(t, bd.Reserve("10.0.5.128/25"))
+	require.Error(t, bd.Reserve("10.0.0.0/16"))
+	require.Error(t, bd.Reserve("10.1.0.0/24"))
+
+	// smallest free block is used
+	b, err := bd.Allocate(24)
+	require.NoError(t, err)
+	require.Equal(t, "10.0.4.0/24", b)
+
+	require.NoError(t, bd.Release("10.0.5.0/24"))
+	require.NoError(t, bd.Release(b))
+	require.Equal(t, []string{"10.0.0.0/16"}, bd.FreeBlocks())
+}
+
+func TestBuddyStats(t *testing.T) {
+	bd, err := NewBuddy("10.0.0.0/16")
+	require.NoError(t, err)
+
+	st := bd.Stats()
+	require.Equal(t, uint(16), st.Largest)
+	require.Equal(t, 0.0, st.Fragmentation)
+
+	require.NoError(t, bd.Reserve("10.0.128.0/17"))
+	st = bd.Stats()
+	require.Equal(t, map[uint]int{17: 1}, st.Free)
+	require.Equal(t, 0.0, st.Fragmentation)
+
+	require.NoError(t, bd.Reserve("10.0.0.0/18"))
+	require.NoError(t, bd.Reserve("10.0.64.0/19"))
+	st = bd.Stats()
+	require.Equal(t, map[uint]int{19: 1}, st.Free)
+
+	require.NoError(t, bd.Reserve("10.0.96.0/20"))
+	require.NoError(t, bd.Release("10.0.0.0/18"))
+	st = bd.Stats()
+	require.Equal(t, uint(18), st.Largest)
+	require.InDelta(t, 0.2, st.Fragmentation, 0.001)
+}
+
+func TestLeaserFreeBlocksJSON(t *testing.T) {
+	lsr, err := New("fe80::/48", "192.168.0.1/16", 64, 24)
+	require.NoError(t, err)
+
+	_, _, err = lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+
+	id, _, err := lsr.GetBlock(4, 26)
+	require.NoError(t, err)
+
+	_, _, err = lsr.GetBlock(6, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, lsr.ReturnBlock(id))
+
+	data, err := lsr.MarshalJSON()
+	require.NoError(t, err)
+
+	var c struct {
+		V4Free []string `json:"v4free"`
+	}
+	require.NoError(t, json.Unmarshal(data, &c))
+	require.Equal(t, lsr.V4Tree.FreeBlocks(), c.V4Free)
+
+	var restored Leaser
+	require.NoError(t, restored.UnmarshalJSON(data))
+	require.Equal(t, lsr.V4Tree.FreeBlocks(), restored.V4Tree.FreeBlocks())
+	require.Equal(t, lsr.V6Tree.FreeBlocks(), restored.V6Tree.FreeBlocks())
+
+	_, ipnet, err := restored.GetBlock(4, 0)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.1.0/24", ipnet)
+}
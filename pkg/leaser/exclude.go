@@ -0,0 +1,122 @@
+package leaser
+
+import (
+	"errors"
+	"strings"
+)
+
+// parseExclude - first and last address of excluded item and address bits len (32 or 128)
+func parseExclude(item string) (u128, u128, uint, error) {
+	item = strings.TrimSpace(item)
+
+	if r := strings.SplitN(item, "-", 2); len(r) == 2 {
+		first, fbits, err := parseAddr(strings.TrimSpace(r[0]))
+		if err != nil {
+			return u128{}, u128{}, 0, err
+		}
+
+		last, lbits, err := parseAddr(strings.TrimSpace(r[1]))
+		if err != nil {
+			return u128{}, u128{}, 0, err
+		}
+
+		if fbits != lbits || last.less(first) {
+			return u128{}, u128{}, 0, errors.New("Wrong excluded address range " + item)
+		}
+
+		return first, last, fbits, nil
+	}
+
+	if strings.Contains(item, "/") {
+		base, prefix, bits, err := parseBlock(item)
+		if err != nil {
+			return u128{}, u128{}, 0, err
+		}
+
+		return base, base.fill(prefix, bits), bits, nil
+	}
+
+	ip, bits, err := parseAddr(item)
+	return ip, ip, bits, err
+}
+
+// applyExclude - rebuild excluded offsets from main pool list and own block list, enable or disable IPv6 subnet-router anycast address.
+// Items of other IP version and items of main pool list out of block are skipped.
+func (sn *Subnet) applyExclude(pool []string, anycast bool) error {
+	sn.Lock()
+	defer sn.Unlock()
+
+	var excluded RangeSet
+	if err := sn.exclude(&excluded, pool, false); err != nil {
+		return err
+	}
+
+	if err := sn.exclude(&excluded, sn.Exclude, true); err != nil {
+		return err
+	}
+
+	sn.excluded = excluded
+	sn.poolExclude = pool
+	sn.anycast = anycast
+	return nil
+}
+
+// exclusion - item of block or main pool exclude list which contains excluded offset
+func (sn *Subnet) exclusion(off uint64) string {
+	for _, item := range append(append([]string{}, sn.Exclude...), sn.poolExclude...) {
+		var rs RangeSet
+		if sn.exclude(&rs, []string{item}, false) == nil && rs.Contains(off) {
+			return item
+		}
+	}
+
+	return "exclude list"
+}
+
+// exclude - add offsets of list items inside block to set, if strict item of same IP version out of block is error
+func (sn *Subnet) exclude(rs *RangeSet, list []string, strict bool) error {
+	base, prefix, bits, err := parseBlock(sn.Pool)
+	if err != nil {
+		return err
+	}
+
+	end := base.fill(prefix, bits)
+	for _, item := range list {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+
+		first, last, ibits, err := parseExclude(item)
+		if err != nil {
+			return err
+		}
+
+		if ibits != bits {
+			continue
+		}
+
+		// offsets are 64 bit
+		if bits == 128 && prefix < 64 {
+			return errors.New("Can't exclude addresses of block " + sn.Pool)
+		}
+
+		if last.less(base) || end.less(first) {
+			if strict {
+				return errors.New("Excluded " + item + " is out of block " + sn.Pool)
+			}
+			continue
+		}
+
+		if first.less(base) {
+			first = base
+		}
+
+		if end.less(last) {
+			last = end
+		}
+
+		rs.AddRange(first.lo-base.lo, last.lo-base.lo)
+	}
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package leaser
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	iplib "github.com/dspinhirne/netaddr-go"
+)
+
+// Hold - released address or block which isn't given again until hold-down period is expired,
+// so peers can forget stale ARP/NDP and conntrack entries. Items are queued in order of release and reused in the same order.
+type Hold struct {
+	Item     string `json:"item"`     // address or block
+	Released int64  `json:"released"` // unix time when item was returned
+}
+
+// expired - true if item is held longer than period
+func (h Hold) expired(period time.Duration) bool {
+	return now().Sub(time.Unix(h.Released, 0)) >= period
+}
+
+// hold - put item to the end of queue, item which is already queued is moved
+func hold(q []Hold, item string, at int64) []Hold {
+	return append(unhold(q, item), Hold{Item: item, Released: at})
+}
+
+// unhold - remove item from queue
+func unhold(q []Hold, item string) []Hold {
+	for k, h := range q {
+		if h.Item == item {
+			return append(q[:k:k], q[k+1:]...)
+		}
+	}
+
+	return q
+}
+
+// SetHoldDown - set periods while released addresses and blocks aren't given again, 0 disables hold-down
+// and releases held items at once
+func (lsr *Leaser) SetHoldDown(address, block time.Duration) error {
+	if address < 0 || block < 0 {
+		return errors.New("Hold-down period can't be negative")
+	}
+
+	lsr.Lock()
+	defer lsr.Unlock()
+
+	lsr.AddressHold, lsr.BlockHold = address, block
+	if address == 0 {
+		for _, b := range lsr.Allocated {
+			b.Held = nil
+		}
+	}
+
+	if block == 0 {
+		for _, v := range []uint8{6, 4} {
+			lsr.releaseHeld(v, true)
+		}
+	}
+
+	return nil
+}
+
+// holdBlock - queue returned block, it is kept reserved in its main pool until it is reused or released
+func (lsr *Leaser) holdBlock(b *Subnet, at int64) {
+	lsr.HeldBlocks = hold(lsr.HeldBlocks, b.Pool, at)
+}
+
+// getBlockFromHold - the oldest block of IP version which hold-down is expired and which has requested prefix len,
+// 0 prefix len means allocate block len of its main pool. Nil if there is no such block.
+func (lsr *Leaser) getBlockFromHold(v uint8, prefix uint) *Subnet {
+	for _, h := range lsr.HeldBlocks {
+		pn, err := iplib.ParseIPNet(h.Item)
+		if err != nil || uint8(pn.Version()) != v || !h.expired(lsr.BlockHold) {
+			continue
+		}
+
+		p := lsr.parent(h.Item)
+		if p == nil || p.Drain {
+			continue
+		}
+
+		ab := prefix
+		if ab == 0 {
+			ab = p.AllocateBlock
+		}
+
+		if prefixLen(pn) != ab {
+			continue
+		}
+
+		b, err := NewSubnet(pn)
+		if err != nil {
+			continue
+		}
+
+		lsr.HeldBlocks = unhold(lsr.HeldBlocks, h.Item)
+		b.Parent = p.Pool
+		return b
+	}
+
+	return nil
+}
+
+// releaseHeld - return held blocks of IP version to their main pools, all or only expired ones
+func (lsr *Leaser) releaseHeld(v uint8, all bool) {
+	var q []Hold
+	for _, h := range lsr.HeldBlocks {
+		pn, err := iplib.ParseIPNet(h.Item)
+		if err == nil && (uint8(pn.Version()) != v || !all && !h.expired(lsr.BlockHold)) {
+			q = append(q, h)
+			continue
+		}
+
+		if p := lsr.parent(h.Item); p != nil {
+			if err := p.tree.Release(h.Item); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	lsr.HeldBlocks = q
+}
+
+// releaseOverlap - return held blocks which overlap with block to their main pools, block is requested explicitly
+func (lsr *Leaser) releaseOverlap(block string) {
+	var q []Hold
+	for _, h := range lsr.HeldBlocks {
+		if !isOverlap(h.Item, block) {
+			q = append(q, h)
+			continue
+		}
+
+		if p := lsr.parent(h.Item); p != nil {
+			if err := p.tree.Release(h.Item); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	lsr.HeldBlocks = q
+}
+
+// reuse - lease the oldest released address which hold-down is expired and which can be given, addresses in hold-down
+// are added to held. Expired addresses which can't be given are removed from queue, they are free as others.
+func (sn *Subnet) reuse(period, retention time.Duration, held map[uint64]bool, first, last uint64) (string, bool) {
+	gw, _, gwErr := sn.offset(sn.Gateway)
+
+	var q []Hold
+	var ip string
+	for _, h := range sn.Held {
+		off, ipo, err := sn.offset(h.Item)
+		switch {
+		case err != nil:
+			continue
+
+		case !h.expired(period):
+			held[off] = true
+			q = append(q, h)
+			continue
+
+		case ip != "":
+			q = append(q, h)
+			continue
+
+		case off < first || off > last || sn.excluded.Contains(off) || gwErr == nil && off == gw || sn.retained(off, retention):
+			continue
+		}
+
+		if sn.Leases.Add(off) {
+			ip = ipo.String()
+		}
+	}
+
+	sn.Held = q
+	return ip, ip != ""
+}
@@ -0,0 +1,146 @@
+package leaser
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddressHold(t *testing.T) {
+	lsr, err := New("fe80::/48", "192.168.0.0/16", 64, 24)
+	require.NoError(t, err)
+	require.Error(t, lsr.SetHoldDown(-time.Minute, 0))
+	require.NoError(t, lsr.SetHoldDown(time.Minute, 0))
+
+	id, _, err := lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err = lsr.GetAddress(id, "")
+		require.NoError(t, err)
+	}
+
+	start := time.Now()
+	defer func() { now = time.Now }()
+
+	now = func() time.Time { return start }
+	require.NoError(t, lsr.ReturnAddress(id, "192.168.0.2/24"))
+	now = func() time.Time { return start.Add(time.Second) }
+	require.NoError(t, lsr.ReturnAddress(id, "192.168.0.1/24"))
+
+	// released addresses wait for hold-down, new addresses are given
+	addr, err := lsr.GetAddress(id, "")
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.4/24", addr)
+
+	// held addresses and their timestamps are saved
+	data, err := lsr.MarshalJSON()
+	require.NoError(t, err)
+
+	var restored Leaser
+	require.NoError(t, restored.UnmarshalJSON(data))
+	require.Equal(t, []Hold{{Item: "192.168.0.2", Released: start.Unix()}, {Item: "192.168.0.1", Released: start.Add(time.Second).Unix()}}, restored.Allocated[0].Held)
+
+	// expired addresses are given in order of release
+	now = func() time.Time { return start.Add(2 * time.Minute) }
+	addr, err = lsr.GetAddress(id, "")
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.2/24", addr)
+
+	addr, err = lsr.GetAddress(id, "")
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.1/24", addr)
+	require.Empty(t, lsr.Allocated[0].Held)
+
+	// requested address is given in hold-down
+	require.NoError(t, lsr.ReturnAddress(id, "192.168.0.3/24"))
+	addr, err = lsr.ReserveAddress(id, "192.168.0.3", "")
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.3/24", addr)
+	require.Empty(t, lsr.Allocated[0].Held)
+
+	// disabled hold-down releases held addresses
+	require.NoError(t, lsr.ReturnAddress(id, "192.168.0.3/24"))
+	require.NoError(t, lsr.SetHoldDown(0, 0))
+	require.Empty(t, lsr.Allocated[0].Held)
+}
+
+func TestBlockHold(t *testing.T) {
+	lsr, err := New("", "192.168.0.0/22", 0, 24)
+	require.NoError(t, err)
+	require.NoError(t, lsr.SetHoldDown(0, time.Hour))
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, _, err := lsr.GetBlock(4, 0)
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	start := time.Now()
+	defer func() { now = time.Now }()
+
+	now = func() time.Time { return start }
+	require.NoError(t, lsr.ReturnBlock(ids[1]))
+	now = func() time.Time { return start.Add(time.Second) }
+	require.NoError(t, lsr.ReturnBlock(ids[0]))
+
+	// returned blocks stay reserved while they are held
+	_, pool, err := lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.3.0/24", pool)
+
+	_, _, err = lsr.GetBlock(4, 0)
+	require.Error(t, err)
+
+	// held blocks are restored with their timestamps and reserved
+	data, err := lsr.MarshalJSON()
+	require.NoError(t, err)
+
+	var restored Leaser
+	require.NoError(t, restored.UnmarshalJSON(data))
+	require.Equal(t, lsr.HeldBlocks, restored.HeldBlocks)
+	require.Equal(t, lsr.Pools(), restored.Pools())
+
+	// expired blocks are given in order of return
+	now = func() time.Time { return start.Add(2 * time.Hour) }
+	_, pool, err = lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.1.0/24", pool)
+
+	// block with other len releases expired blocks to main pool
+	_, pool, err = lsr.GetBlock(4, 25)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.0/25", pool)
+	require.Empty(t, lsr.HeldBlocks)
+
+	// requested block is given in hold-down
+	id := lsr.Allocated[len(lsr.Allocated)-1].ID
+	require.NoError(t, lsr.ReturnBlock(id))
+	_, pool, err = lsr.ReserveBlock("192.168.0.0/24", "")
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.0/24", pool)
+	require.Empty(t, lsr.HeldBlocks)
+}
+
+func TestReplayHold(t *testing.T) {
+	lsr, err := New("", "192.168.0.0/22", 0, 24)
+	require.NoError(t, err)
+
+	id, _, err := lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+	block := lsr.Allocated[0]
+
+	// journal keeps hold-down of returned items, so state is the same after replay
+	require.NoError(t, lsr.Replay([]*JournalEntry{
+		{Seq: 1, Op: OpAddress, ID: id, IP: "192.168.0.1"},
+		{Seq: 2, Op: OpRelease, ID: id, IP: "192.168.0.1", Time: 100, Hold: true},
+		{Seq: 3, Op: OpReturnBlock, ID: id, Time: 200},
+		{Seq: 4, Op: OpBlock, ID: "other", Block: &Subnet{ID: "other", V: 4, Pool: "192.168.0.0/25"}},
+	}))
+
+	require.Equal(t, []Hold{{Item: "192.168.0.1", Released: 100}}, block.Held)
+	require.Empty(t, lsr.HeldBlocks)
+	require.Len(t, lsr.Allocated, 1)
+}
@@ -0,0 +1,138 @@
+package leaser
+
+import (
+	"time"
+)
+
+// KeyTTL - how long result of request with idempotency key is kept in state for retries
+var KeyTTL = 10 * time.Minute
+
+// Result - result of mutation which is made by request with idempotency key
+type Result struct {
+	ID      string `json:"id,omitempty"`
+	Pool    string `json:"pool,omitempty"`
+	Address string `json:"address,omitempty"`
+	Time    int64  `json:"time"` // unix time of request, result is removed after KeyTTL
+}
+
+// Interface - calls which allocate and return blocks and addresses of address space, they are implemented by Leaser,
+// Keyed and remote leasers. Driver uses them as gipam.LeaserInterface.
+type Interface interface {
+	GetBlock(uint8, uint) (string, string, error)
+	ReserveBlock(string, string) (string, string, error)
+	ReturnBlock(string) error
+	GetAddress(string, string) (string, error)
+	ReserveAddress(string, string, string) (string, error)
+	GetGateway(string, string) (string, error)
+	ReturnAddress(string, string) error
+	ExcludeAddresses(string, []string) error
+}
+
+// WithKey - leaser calls of request with idempotency key. Key and result of mutation are written to the same journal entry
+// and kept in state, so retried request gets the same result after restart or change of cluster leader, and nothing is
+// allocated twice. Empty key disables it.
+func (lsr *Leaser) WithKey(key string) Interface {
+	return &Keyed{lsr: lsr, key: key}
+}
+
+// Keyed - leaser calls of request with idempotency key, it implements Interface
+type Keyed struct {
+	lsr *Leaser
+	key string
+}
+
+// GetBlock - see Leaser.GetBlock
+func (k *Keyed) GetBlock(v uint8, prefix uint) (string, string, error) {
+	return k.lsr.getBlock(v, prefix, k.of("GetBlock"))
+}
+
+// ReserveBlock - see Leaser.ReserveBlock
+func (k *Keyed) ReserveBlock(pool, subPool string) (string, string, error) {
+	return k.lsr.reserveBlock(pool, subPool, k.of("ReserveBlock"), false)
+}
+
+// ReturnBlock - see Leaser.ReturnBlock
+func (k *Keyed) ReturnBlock(id string) error {
+	return k.lsr.returnBlock(id, k.of("ReturnBlock"))
+}
+
+// GetAddress - see Leaser.GetAddress
+func (k *Keyed) GetAddress(id, mac string) (string, error) {
+	return k.lsr.getAddress(id, mac, k.of("GetAddress"))
+}
+
+// ReserveAddress - see Leaser.ReserveAddress
+func (k *Keyed) ReserveAddress(id, address, mac string) (string, error) {
+	return k.lsr.reserveAddress(id, address, mac, k.of("ReserveAddress"), false)
+}
+
+// GetGateway - see Leaser.GetGateway
+func (k *Keyed) GetGateway(id, address string) (string, error) {
+	return k.lsr.getGateway(id, address, k.of("GetGateway"))
+}
+
+// ReturnAddress - see Leaser.ReturnAddress
+func (k *Keyed) ReturnAddress(id, address string) error {
+	return k.lsr.returnAddress(id, address, k.of("ReturnAddress"))
+}
+
+// ExcludeAddresses - see Leaser.ExcludeAddresses
+func (k *Keyed) ExcludeAddresses(id string, list []string) error {
+	return k.lsr.excludeAddresses(id, list, k.of("ExcludeAddresses"))
+}
+
+// of - key of method call, the same key of other method has other result
+func (k *Keyed) of(method string) string {
+	if k.key == "" {
+		return ""
+	}
+
+	return method + "/" + k.key
+}
+
+// Result - saved result of request with idempotency key, false if key isn't applied to state
+func (lsr *Leaser) Result(key string) (*Result, bool) {
+	lsr.RLock()
+	defer lsr.RUnlock()
+
+	return lsr.result(key)
+}
+
+func (lsr *Leaser) result(key string) (*Result, bool) {
+	if key == "" {
+		return nil, false
+	}
+
+	r, ok := lsr.Results[key]
+	return r, ok
+}
+
+// keyed - add idempotency key and result of request to journal entry, nothing is added for empty key
+func keyed(e *JournalEntry, key string, r Result) *JournalEntry {
+	if key != "" {
+		r.Time = now().Unix()
+		e.Key, e.Result = key, &r
+	}
+
+	return e
+}
+
+// keep - save result of entry by its idempotency key, results older than KeyTTL are removed.
+// Age is counted from time of entry, so all replicas of state keep the same results.
+func (lsr *Leaser) keep(e *JournalEntry) {
+	if e.Key == "" || e.Result == nil {
+		return
+	}
+
+	for k, r := range lsr.Results {
+		if time.Duration(e.Result.Time-r.Time)*time.Second > KeyTTL {
+			delete(lsr.Results, k)
+		}
+	}
+
+	if lsr.Results == nil {
+		lsr.Results = map[string]*Result{}
+	}
+
+	lsr.Results[e.Key] = e.Result
+}
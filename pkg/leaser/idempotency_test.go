@@ -0,0 +1,52 @@
+package leaser
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithKey(t *testing.T) {
+	lsr, err := New("", "192.168.0.0/16", 0, 24)
+	require.NoError(t, err)
+
+	// retry with the same key gets the same result and nothing is allocated again
+	id, pool, err := lsr.WithKey("k1").GetBlock(4, 0)
+	require.NoError(t, err)
+	again, pool2, err := lsr.WithKey("k1").GetBlock(4, 0)
+	require.NoError(t, err)
+	require.Equal(t, id, again)
+	require.Equal(t, pool, pool2)
+	require.Len(t, lsr.Allocated, 1)
+
+	addr, err := lsr.WithKey("k2").GetAddress(id, "")
+	require.NoError(t, err)
+	addr2, err := lsr.WithKey("k2").GetAddress(id, "")
+	require.NoError(t, err)
+	require.Equal(t, addr, addr2)
+
+	require.NoError(t, lsr.WithKey("k3").ReturnBlock(id))
+	require.NoError(t, lsr.WithKey("k3").ReturnBlock(id))
+
+	// results are replayed from journal
+	replica, err := New("", "192.168.0.0/16", 0, 24)
+	require.NoError(t, err)
+	require.NoError(t, replica.Replay([]*JournalEntry{
+		{Seq: 1, Op: OpBlock, ID: id, Block: &Subnet{ID: id, V: 4, Pool: pool}, Key: "k1", Result: &Result{ID: id, Pool: pool, Time: 100}},
+	}))
+
+	r, ok := replica.Result("k1")
+	require.True(t, ok)
+	require.Equal(t, pool, r.Pool)
+
+	// old results are removed by time of new entry
+	require.NoError(t, replica.Replay([]*JournalEntry{
+		{Seq: 2, Op: OpReturnBlock, ID: id, Key: "k2", Result: &Result{Time: 100 + int64(KeyTTL/time.Second) + 1}},
+	}))
+
+	_, ok = replica.Result("k1")
+	require.False(t, ok)
+	_, ok = replica.Result("k2")
+	require.True(t, ok)
+}
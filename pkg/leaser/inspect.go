@@ -0,0 +1,221 @@
+package leaser
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// PoolInfo - main pool usage
+type PoolInfo struct {
+	BuddyStats
+
+	V             uint8    `json:"v"`
+	AllocateBlock uint     `json:"allocate_block"`
+	Blocks        int      `json:"blocks"`          // count of allocated blocks, draining pool is retired when it is 0
+	Drain         bool     `json:"drain,omitempty"` // pool gives no new blocks
+	Capacity      float64  `json:"capacity"`        // count of blocks with allocate block len in main pool
+	Available     float64  `json:"available"`       // count of blocks with allocate block len which can be allocated
+	FreeBlocks    []string `json:"free_blocks"`
+}
+
+// BlockInfo - allocated block with leased addresses
+type BlockInfo struct {
+	ID      string              `json:"id"`
+	V       uint8               `json:"v"`
+	Pool    string              `json:"pool"`
+	Parent  string              `json:"parent,omitempty"` // main pool which block is cut from
+	Range   string              `json:"range,omitempty"`
+	Gateway string              `json:"gateway,omitempty"`
+	Leased  uint64              `json:"leased"` // count of leased addresses
+	Free    float64             `json:"free"`   // count of addresses which can be given
+	Leases  []string            `json:"leases"` // leased addresses and ranges 'first-last'
+	Exclude []string            `json:"exclude,omitempty"`
+	MACs    map[string]*Binding `json:"macs,omitempty"`
+
+	Pinned    bool     `json:"pinned,omitempty"`     // block is reserved by operator
+	PinnedIPs []string `json:"pinned_ips,omitempty"` // addresses reserved by operator
+}
+
+// Owner - who owns address: allocated block and MAC bound to address
+type Owner struct {
+	IP      string `json:"ip"`
+	Block   string `json:"block"`
+	Pool    string `json:"pool"`
+	Leased  bool   `json:"leased"`
+	Gateway bool   `json:"gateway,omitempty"`
+	MAC     string `json:"mac,omitempty"`
+
+	Released int64 `json:"released,omitempty"` // unix time when address bound to MAC was returned
+}
+
+// Pools - usage of main pools in order of allocation, draining pool has no available blocks
+func (lsr *Leaser) Pools() []PoolInfo {
+	lsr.RLock()
+	defer lsr.RUnlock()
+
+	var r []PoolInfo
+	for _, v := range []uint8{6, 4} {
+		for _, p := range lsr.pools(v) {
+			pi := PoolInfo{BuddyStats: p.tree.Stats(), V: v, FreeBlocks: p.tree.FreeBlocks(), AllocateBlock: p.AllocateBlock, Drain: p.Drain}
+			pi.Capacity = p.tree.Capacity(pi.AllocateBlock)
+			if !p.Drain {
+				pi.Available = p.tree.Available(pi.AllocateBlock)
+			}
+
+			for _, b := range lsr.Allocated {
+				if b.V == v && contains(p.net, b.Pool) {
+					pi.Blocks++
+				}
+			}
+
+			r = append(r, pi)
+		}
+	}
+
+	return r
+}
+
+// Blocks - allocated blocks with leases sorted by pool
+func (lsr *Leaser) Blocks() []BlockInfo {
+	lsr.RLock()
+	defer lsr.RUnlock()
+
+	r := make([]BlockInfo, 0, len(lsr.Allocated))
+	for _, b := range lsr.Allocated {
+		r = append(r, b.info())
+	}
+
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].V != r[j].V {
+			return r[i].V < r[j].V
+		}
+
+		bi, _, _ := parseAddr(strings.Split(r[i].Pool, "/")[0])
+		bj, _, _ := parseAddr(strings.Split(r[j].Pool, "/")[0])
+		return bi.less(bj)
+	})
+
+	return r
+}
+
+// Block - allocated block with leases by ID
+func (lsr *Leaser) Block(id string) (BlockInfo, error) {
+	lsr.RLock()
+	defer lsr.RUnlock()
+
+	_, b := lsr.find(id)
+	if b == nil {
+		return BlockInfo{}, errors.New(id + " address block not found")
+	}
+
+	return b.info(), nil
+}
+
+// Whois - owner of address, error if address is out of all allocated blocks
+func (lsr *Leaser) Whois(ip string) (*Owner, error) {
+	ip = strings.Split(ip, "/")[0]
+
+	lsr.RLock()
+	defer lsr.RUnlock()
+
+	for _, b := range lsr.Allocated {
+		if o := b.owner(ip); o != nil {
+			return o, nil
+		}
+	}
+
+	return nil, errors.New("Address " + ip + " is out of allocated blocks")
+}
+
+// info - copy of block state
+func (sn *Subnet) info() BlockInfo {
+	sn.RLock()
+	defer sn.RUnlock()
+
+	bi := BlockInfo{ID: sn.ID, V: sn.V, Pool: sn.Pool, Parent: sn.Parent, Range: sn.Range, Gateway: sn.Gateway, Leased: sn.Leases.Len(), Free: sn.free(), Leases: []string{}, Exclude: sn.Exclude, Pinned: sn.Pinned}
+	bi.PinnedIPs = append(bi.PinnedIPs, sn.PinnedIPs...)
+	sn.Leases.EachRange(func(first, last uint64) bool {
+		fip, err := sn.ip(first)
+		if err != nil {
+			return true
+		}
+
+		if first == last {
+			bi.Leases = append(bi.Leases, fip.String())
+			return true
+		}
+
+		if lip, err := sn.ip(last); err == nil {
+			bi.Leases = append(bi.Leases, fip.String()+"-"+lip.String())
+		}
+
+		return true
+	})
+
+	if len(sn.Bindings) != 0 {
+		bi.MACs = map[string]*Binding{}
+		for mac, b := range sn.Bindings {
+			c := *b
+			bi.MACs[mac] = &c
+		}
+	}
+
+	return bi
+}
+
+// free - count of addresses in bounds which are not leased, excluded or gateway
+func (sn *Subnet) free() float64 {
+	first, last, err := sn.bounds()
+	if err != nil || last < first {
+		return 0
+	}
+
+	var used RangeSet
+	for _, rs := range []*RangeSet{&sn.Leases, &sn.excluded} {
+		rs.EachRange(func(f, l uint64) bool {
+			if f < first {
+				f = first
+			}
+
+			if l > last {
+				l = last
+			}
+
+			if f <= l {
+				used.AddRange(f, l)
+			}
+
+			return true
+		})
+	}
+
+	if sn.Gateway != "" {
+		if off, _, err := sn.offset(sn.Gateway); err == nil && off >= first && off <= last {
+			used.Add(off)
+		}
+	}
+
+	return float64(last-first) + 1 - float64(used.Len())
+}
+
+// owner - owner of ip in block, nil if ip is out of block
+func (sn *Subnet) owner(ip string) *Owner {
+	sn.RLock()
+	defer sn.RUnlock()
+
+	off, ipo, err := sn.offset(ip)
+	if err != nil {
+		return nil
+	}
+
+	o := &Owner{IP: ipo.String(), Block: sn.ID, Pool: sn.Pool, Leased: sn.Leases.Contains(off), Gateway: sn.Gateway == ipo.String()}
+	for mac, b := range sn.Bindings {
+		if b.IP == o.IP {
+			o.MAC = mac
+			o.Released = b.Released
+		}
+	}
+
+	return o
+}
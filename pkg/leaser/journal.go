@@ -0,0 +1,382 @@
+package leaser
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Journal operations
+const (
+	OpBlock       = "block"        // new allocated block, it is stored whole
+	OpReturnBlock = "return_block" // block returned to main pool
+	OpAddress     = "address"      // address given or reserved, it is bound to MAC if not empty
+	OpRelease     = "release"      // address returned to block
+	OpGateway     = "gateway"      // gateway of block is set
+	OpExclude     = "exclude"      // excluded addresses of block are set
+	OpPool        = "pool"         // main pools of IP version are set, empty list removes them
+)
+
+// JournalEntry - one mutation of leaser state
+type JournalEntry struct {
+	Seq     uint64     `json:"seq"`
+	Op      string     `json:"op"`
+	ID      string     `json:"id"`
+	Block   *Subnet    `json:"block,omitempty"`
+	IP      string     `json:"ip,omitempty"`
+	MAC     string     `json:"mac,omitempty"`
+	Exclude []string   `json:"exclude,omitempty"`
+	Time    int64      `json:"time,omitempty"` // unix time of release, returned block is held only if it is set
+	Hold    bool       `json:"hold,omitempty"` // released address is held
+	V       uint8      `json:"v,omitempty"`
+	Pools   []MainPool `json:"pools,omitempty"`
+	Pinned  bool       `json:"pinned,omitempty"` // address is reserved by operator
+	Key     string     `json:"key,omitempty"`    // idempotency key of request which made mutation
+	Result  *Result    `json:"result,omitempty"` // result of request with idempotency key
+}
+
+// OpenJournal - open append-only journal file, it is created if not exists
+func OpenJournal(file string) (*Journal, error) {
+	if file == "" {
+		return nil, errors.New("Journal file name is empty")
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Journal{File: file, file: f}, nil
+}
+
+// Journal - append-only file of leaser mutations, one JSON entry by line.
+// Every entry is synced to disk before mutation is acknowledged, entries saved in snapshot are removed by Compact.
+type Journal struct {
+	sync.Mutex
+
+	File string
+	file *os.File
+}
+
+// Append - write entry and sync it to disk
+func (j *Journal) Append(e *JournalEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	j.Lock()
+	defer j.Unlock()
+
+	if j.file == nil {
+		return errors.New("Journal " + j.File + " is closed")
+	}
+
+	_, err = j.file.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+
+	return j.file.Sync()
+}
+
+// Entries - all entries of journal, truncated last entry (crash while write) is skipped
+func (j *Journal) Entries() ([]*JournalEntry, error) {
+	j.Lock()
+	defer j.Unlock()
+
+	return j.entries()
+}
+
+func (j *Journal) entries() ([]*JournalEntry, error) {
+	data, err := ioutil.ReadFile(j.File)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// every entry ends with new line, so only last line can be written partly
+	var r []*JournalEntry
+	lines := bytes.Split(data, []byte("\n"))
+	for k, line := range lines {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		var e JournalEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			if k == len(lines)-1 {
+				log.Println("Journal " + j.File + " last entry is truncated, it is skipped")
+				break
+			}
+
+			return nil, errors.New("Journal " + j.File + " is broken: " + err.Error())
+		}
+
+		r = append(r, &e)
+	}
+
+	return r, nil
+}
+
+// Compact - remove entries which are saved in snapshot (seq is not greater than given), newer entries are kept
+func (j *Journal) Compact(seq uint64) error {
+	j.Lock()
+	defer j.Unlock()
+
+	entries, err := j.entries()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, e := range entries {
+		if e.Seq <= seq {
+			continue
+		}
+
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		buf.Write(append(data, '\n'))
+	}
+
+	tmp := j.File + ".tmp"
+	err = ioutil.WriteFile(tmp, buf.Bytes(), 0644)
+	if err == nil {
+		err = syncFile(tmp)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if j.file != nil {
+		j.file.Close()
+	}
+
+	err = os.Rename(tmp, j.File)
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	// journal must be open anyway
+	f, oerr := os.OpenFile(j.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if oerr != nil {
+		j.file = nil
+		return oerr
+	}
+
+	j.file = f
+	return err
+}
+
+// Close - close journal file
+func (j *Journal) Close() error {
+	j.Lock()
+	defer j.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// SetStore - write every mutation to store before it is acknowledged, nil disables it
+func (lsr *Leaser) SetStore(s Store) {
+	lsr.Lock()
+	defer lsr.Unlock()
+
+	lsr.store = s
+}
+
+// record - write mutation to store with next sequence number, result of request with idempotency key is kept
+func (lsr *Leaser) record(e *JournalEntry) error {
+	if lsr.store != nil {
+		e.Seq = lsr.Seq + 1
+		err := lsr.store.Update(e)
+		if err != nil {
+			log.Println("Journal write error:", err)
+			return errors.New("Can't write journal, state is not changed")
+		}
+
+		lsr.Seq = e.Seq
+	}
+
+	lsr.keep(e)
+	return nil
+}
+
+// Replay - apply journal entries which are newer than state
+func (lsr *Leaser) Replay(entries []*JournalEntry) error {
+	lsr.Lock()
+	defer lsr.Unlock()
+
+	for _, e := range entries {
+		if e.Seq <= lsr.Seq {
+			continue
+		}
+
+		if e.Seq != lsr.Seq+1 {
+			return errors.New("Journal doesn't continue state, entries " + strconv.FormatUint(lsr.Seq+1, 10) + "-" + strconv.FormatUint(e.Seq-1, 10) + " are lost")
+		}
+
+		err := lsr.apply(e)
+		if err != nil {
+			return errors.New("Can't replay journal entry " + e.Op + " of block " + e.ID + ": " + err.Error())
+		}
+
+		lsr.keep(e)
+		lsr.Seq = e.Seq
+	}
+
+	return nil
+}
+
+// apply - make mutation of journal entry, result is already known so nothing is allocated again
+func (lsr *Leaser) apply(e *JournalEntry) error {
+	if e.Op == OpPool {
+		// forced pools can change block len of allocated blocks, so only fit is checked
+		if err := lsr.fitPools(e.V, e.Pools); err != nil {
+			return err
+		}
+
+		lsr.setPools(e.V, e.Pools)
+		return nil
+	}
+
+	if e.Op == OpBlock {
+		if e.Block == nil {
+			return errors.New("Block is empty")
+		}
+
+		p := lsr.parent(e.Block.Pool)
+		if p == nil {
+			return errors.New("No main pool of block " + e.Block.Pool)
+		}
+
+		lsr.releaseOverlap(e.Block.Pool)
+		err := p.tree.Reserve(e.Block.Pool)
+		if err != nil {
+			return err
+		}
+
+		e.Block.Parent = p.Pool
+
+		if err := e.Block.applyExclude(lsr.Exclude, lsr.V6Anycast); err != nil {
+			log.Println(err)
+		}
+
+		lsr.Allocated = append(lsr.Allocated, e.Block)
+		return nil
+	}
+
+	k, b := lsr.find(e.ID)
+	if b == nil {
+		return errors.New(e.ID + " address block not found")
+	}
+
+	switch e.Op {
+	case OpReturnBlock:
+		lsr.dropBlock(k, e.Time)
+		return nil
+
+	case OpAddress:
+		if err := b.lease(e.IP, e.MAC); err != nil {
+			return err
+		}
+
+		if e.Pinned {
+			b.pin(e.IP)
+		}
+
+		return nil
+
+	case OpRelease:
+		return b.unlease(e.IP, e.Time, e.Hold)
+
+	case OpGateway:
+		b.Gateway = e.IP
+		return nil
+
+	case OpExclude:
+		b.Exclude = e.Exclude
+		return b.applyExclude(lsr.Exclude, lsr.V6Anycast)
+	}
+
+	return errors.New("Unknown journal operation")
+}
+
+// lease - mark ip as allocated and bind it to MAC if not empty
+func (sn *Subnet) lease(ip, mac string) error {
+	sn.Lock()
+	defer sn.Unlock()
+
+	off, ipo, err := sn.offset(ip)
+	if err != nil {
+		return err
+	}
+
+	sn.Leases.Add(off)
+	sn.Held = unhold(sn.Held, ipo.String())
+	sn.bind(mac, ipo.String())
+	return nil
+}
+
+// unlease - mark ip as free, its bindings are released at unix time at, 0 keeps bindings as is.
+// If held is true ip is queued for hold-down from unix time at.
+func (sn *Subnet) unlease(ip string, at int64, held bool) error {
+	sn.Lock()
+	defer sn.Unlock()
+
+	off, ipo, err := sn.offset(ip)
+	if err != nil {
+		return err
+	}
+
+	sn.Leases.Remove(off)
+	sn.PinnedIPs = removeString(sn.PinnedIPs, ipo.String())
+	if at == 0 {
+		return nil
+	}
+
+	if held {
+		sn.Held = hold(sn.Held, ipo.String(), at)
+	}
+
+	sn.release(ipo.String(), at)
+	return nil
+}
+
+// pin - mark leased ip as reserved by operator
+func (sn *Subnet) pin(ip string) {
+	sn.Lock()
+	defer sn.Unlock()
+
+	sn.PinnedIPs = append(removeString(sn.PinnedIPs, ip), ip)
+}
+
+// syncFile - flush file to disk
+func syncFile(name string) error {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
@@ -0,0 +1,46 @@
+package leaser
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournalEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gipam")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "lease.json.journal")
+	j, err := OpenJournal(file)
+	require.NoError(t, err)
+	defer j.Close()
+
+	for i := uint64(1); i <= 3; i++ {
+		require.NoError(t, j.Append(&JournalEntry{Seq: i, Op: OpReturnBlock, ID: "aaa"}))
+	}
+
+	// last entry is written partly
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	f.WriteString(`{"seq":4,"op":"ret`)
+	f.Close()
+
+	entries, err := j.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	require.NoError(t, j.Compact(2))
+	entries, err = j.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, uint64(3), entries[0].Seq)
+
+	// journal which doesn't continue state can't be replayed
+	lsr, err := New("fe80::/48", "192.168.0.0/16", 64, 24)
+	require.NoError(t, err)
+	require.Error(t, lsr.Replay(entries))
+}
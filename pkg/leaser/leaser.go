@@ -5,7 +5,9 @@ import (
 	"errors"
 	"log"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	iplib "github.com/dspinhirne/netaddr-go"
 )
@@ -20,9 +22,17 @@ func New(v6, v4 string, abv6, abv4 uint) (*Leaser, error) {
 	}
 
 	errV4 := lsr.setV4(v4, abv4)
-	if errV4 != nil {
-		log.Println(errV4)
-		return nil, errors.New("IPv4 pool can't be empty")
+	if lsr.V6Pool == nil && lsr.V4Pool == nil {
+		if !isIPNet(v6) && !isIPNet(v4) {
+			return nil, errors.New("IPv4 address pool can't be empty")
+		}
+
+		return nil, errors.New("Can't create new Leaser, IPv4 and IPv6 pools are empty")
+	}
+
+	// IPv4 pool can be omitted if IPv6 pool is set, but wrong IPv4 pool isn't skipped
+	if errV4 != nil && v4 != "" {
+		return nil, errV4
 	}
 
 	return &lsr, nil
@@ -34,14 +44,130 @@ type Leaser struct {
 
 	V6Pool          *iplib.IPv6Net `json:"v6"`
 	V6AllocateBlock uint           `json:"v6ab"`
-	V6Idx           uint           `json:"v6idx"`
 
 	V4Pool          *iplib.IPv4Net `json:"v4"`
 	V4AllocateBlock uint           `json:"v4ab"`
-	V4Idx           uint           `json:"v4idx"`
 
-	Allocated []*Subnet `json:"allocated,omitempty"`
-	Free      []*Subnet `json:"free,omitempty"`
+	V6Tree *Buddy `json:"-"`
+	V4Tree *Buddy `json:"-"`
+
+	V6Fallback []*MainPool `json:"-"` // IPv6 main pools which are used in order after V6Pool
+	V4Fallback []*MainPool `json:"-"` // IPv4 main pools which are used in order after V4Pool
+
+	V6Drain bool `json:"-"` // V6Pool gives no new blocks, it is retired when its last block is returned
+	V4Drain bool `json:"-"` // V4Pool gives no new blocks, it is retired when its last block is returned
+
+	Allocated  []*Subnet `json:"allocated,omitempty"`
+	HeldBlocks []Hold    `json:"-"` // returned blocks in hold-down, the oldest first, they are reserved in main pools
+	Seq        uint64    `json:"-"` // sequence number of last journal entry which is applied to state
+
+	Results map[string]*Result `json:"-"` // results of requests by idempotency key, they are removed after KeyTTL
+
+	GatewayPolicy string            `json:"-"`
+	PoolGateways  map[string]string `json:"-"` // gateway policies of blocks of main pools by pool CIDR, GatewayPolicy is used for others
+	MACRetention  time.Duration     `json:"-"`
+	AddressHold   time.Duration     `json:"-"` // period while returned address isn't given again
+	BlockHold     time.Duration     `json:"-"` // period while returned block isn't given again
+	Exclude       []string          `json:"-"` // addresses of main pools which are never given to containers
+	V6Anycast     bool              `json:"-"` // IPv6 subnet-router anycast address can be given to containers
+
+	store Store
+}
+
+// SetExclude - set addresses of main pools which are never given to containers: ip, network or range 'first-last'.
+// It is applied to all allocated blocks.
+func (lsr *Leaser) SetExclude(list []string) error {
+	for _, item := range list {
+		if _, _, _, err := parseExclude(item); err != nil {
+			return err
+		}
+	}
+
+	lsr.Lock()
+	defer lsr.Unlock()
+
+	lsr.Exclude = list
+	lsr.applyExclude()
+	return nil
+}
+
+// SetV6Anycast - allow or deny to give IPv6 subnet-router anycast address (network address of block) to containers.
+// It is applied to all allocated blocks.
+func (lsr *Leaser) SetV6Anycast(anycast bool) {
+	lsr.Lock()
+	defer lsr.Unlock()
+
+	lsr.V6Anycast = anycast
+	lsr.applyExclude()
+}
+
+// applyExclude - apply main pools exclusions to all allocated blocks
+func (lsr *Leaser) applyExclude() {
+	for _, b := range lsr.Allocated {
+		if err := b.applyExclude(lsr.Exclude, lsr.V6Anycast); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// SetMACRetention - set period while released address is kept for container with same MAC, 0 disables it
+func (lsr *Leaser) SetMACRetention(retention time.Duration) error {
+	if retention < 0 {
+		return errors.New("MAC retention period can't be negative")
+	}
+
+	lsr.Lock()
+	defer lsr.Unlock()
+
+	lsr.MACRetention = retention
+	return nil
+}
+
+// SetGatewayPolicy - set policy of choosing gateway address in new blocks: "first", "last" or offset from network address
+func (lsr *Leaser) SetGatewayPolicy(policy string) error {
+	_, err := parseGatewayPolicy(policy, ^uint64(0))
+	if err != nil {
+		return err
+	}
+
+	lsr.Lock()
+	defer lsr.Unlock()
+
+	lsr.GatewayPolicy = policy
+	return nil
+}
+
+// SetPoolGateway - set policy of choosing gateway address in new blocks of main pool, empty policy resets it to GatewayPolicy
+func (lsr *Leaser) SetPoolGateway(pool, policy string) error {
+	if _, err := parseGatewayPolicy(policy, ^uint64(0)); err != nil {
+		return err
+	}
+
+	lsr.Lock()
+	defer lsr.Unlock()
+
+	if policy == "" {
+		delete(lsr.PoolGateways, pool)
+		return nil
+	}
+
+	if lsr.PoolGateways == nil {
+		lsr.PoolGateways = map[string]string{}
+	}
+
+	lsr.PoolGateways[pool] = policy
+	return nil
+}
+
+// gatewayPolicy - gateway policy of main pool which contains block
+func (lsr *Leaser) gatewayPolicy(b *Subnet) string {
+	for pool, policy := range lsr.PoolGateways {
+		if isOverlap(pool, b.Pool) {
+			return policy
+		}
+	}
+
+	return lsr.GatewayPolicy
 }
 
 // MarshalJSON implements JSON marshaler
@@ -49,25 +175,58 @@ func (lsr *Leaser) MarshalJSON() ([]byte, error) {
 	lsr.Lock()
 	defer lsr.Unlock()
 
+	return lsr.marshal()
+}
+
+// Snapshot - state in JSON and sequence number of last journal entry which is applied to it
+func (lsr *Leaser) Snapshot() ([]byte, uint64, error) {
+	lsr.Lock()
+	defer lsr.Unlock()
+
+	data, err := lsr.marshal()
+	return data, lsr.Seq, err
+}
+
+func (lsr *Leaser) marshal() ([]byte, error) {
 	c := struct {
 		V6Pool          string `json:"v6"`
 		V6AllocateBlock uint   `json:"v6ab"`
-		V6Idx           uint   `json:"v6idx,omitempty"`
 
 		V4Pool          string `json:"v4"`
 		V4AllocateBlock uint   `json:"v4ab"`
-		V4Idx           uint   `json:"v4idx,omitempty"`
+
+		V6Drain bool `json:"v6drain,omitempty"`
+		V4Drain bool `json:"v4drain,omitempty"`
+
+		V6Fallback []MainPool `json:"v6fallback,omitempty"`
+		V4Fallback []MainPool `json:"v4fallback,omitempty"`
+
+		V6Free []string `json:"v6free,omitempty"`
+		V4Free []string `json:"v4free,omitempty"`
 
 		Allocated *[]*Subnet `json:"allocated,omitempty"`
-		Free      *[]*Subnet `json:"free,omitempty"`
-	}{V6AllocateBlock: lsr.V6AllocateBlock, V6Idx: lsr.V6Idx, V4AllocateBlock: lsr.V4AllocateBlock, V4Idx: lsr.V4Idx, Allocated: &lsr.Allocated, Free: &lsr.Free}
+		Held      []Hold     `json:"held,omitempty"`
+		Seq       uint64     `json:"seq,omitempty"`
+
+		Results map[string]*Result `json:"results,omitempty"`
+	}{V6AllocateBlock: lsr.V6AllocateBlock, V4AllocateBlock: lsr.V4AllocateBlock, V6Drain: lsr.V6Drain, V4Drain: lsr.V4Drain, Allocated: &lsr.Allocated, Held: lsr.HeldBlocks, Seq: lsr.Seq, Results: lsr.Results}
+
+	if specs := lsr.specs(6); len(specs) > 1 {
+		c.V6Fallback = specs[1:]
+	}
+
+	if specs := lsr.specs(4); len(specs) > 1 {
+		c.V4Fallback = specs[1:]
+	}
 
 	if lsr.V6Pool != nil {
 		c.V6Pool = lsr.V6Pool.String()
+		c.V6Free = lsr.V6Tree.FreeBlocks()
 	}
 
 	if lsr.V4Pool != nil {
 		c.V4Pool = lsr.V4Pool.String()
+		c.V4Free = lsr.V4Tree.FreeBlocks()
 	}
 
 	return json.MarshalIndent(c, "", "  ")
@@ -81,14 +240,24 @@ func (lsr *Leaser) UnmarshalJSON(data []byte) error {
 	c := struct {
 		V6Pool          string `json:"v6"`
 		V6AllocateBlock uint   `json:"v6ab"`
-		V6Idx           uint   `json:"v6idx,omitempty"`
 
 		V4Pool          string `json:"v4"`
 		V4AllocateBlock uint   `json:"v4ab"`
-		V4Idx           uint   `json:"v4idx,omitempty"`
+
+		V6Drain bool `json:"v6drain,omitempty"`
+		V4Drain bool `json:"v4drain,omitempty"`
+
+		V6Fallback []MainPool `json:"v6fallback,omitempty"`
+		V4Fallback []MainPool `json:"v4fallback,omitempty"`
+
+		V6Free []string `json:"v6free,omitempty"`
+		V4Free []string `json:"v4free,omitempty"`
 
 		Allocated *[]*Subnet `json:"allocated,omitempty"`
-		Free      *[]*Subnet `json:"free,omitempty"`
+		Held      []Hold     `json:"held,omitempty"`
+		Seq       uint64     `json:"seq,omitempty"`
+
+		Results map[string]*Result `json:"results,omitempty"`
 	}{}
 
 	err := json.Unmarshal(data, &c)
@@ -99,24 +268,70 @@ func (lsr *Leaser) UnmarshalJSON(data []byte) error {
 	if c.Allocated != nil {
 		lsr.Allocated = *c.Allocated
 	}
+	lsr.HeldBlocks = c.Held
+	lsr.Seq = c.Seq
+	lsr.Results = c.Results
 
-	if c.Free != nil {
-		lsr.Free = *c.Free
-	}
-
+	// free blocks are built from allocated, stored ones only checked.
+	// Allocated blocks are never dropped: state with blocks of wrong main pool can't be restored.
 	errV6 := lsr.setV6(c.V6Pool, c.V6AllocateBlock)
 	if errV6 != nil {
+		if n := len(lsr.outOf(6, nil)); n != 0 {
+			return errors.New("Can't restore Leaser, " + strconv.Itoa(n) + " IPv6 blocks are allocated, but main pool '" + c.V6Pool + "' /" + strconv.FormatUint(uint64(c.V6AllocateBlock), 10) + " is wrong: " + errV6.Error())
+		}
+
 		log.Println(errV6)
-	} else {
-		lsr.V6Idx = c.V6Idx
+	} else if c.V6Free != nil && !equalStrings(c.V6Free, lsr.V6Tree.FreeBlocks()) {
+		log.Println("Stored free IPv6 blocks differ from allocated, free blocks are rebuilt")
 	}
 
 	errV4 := lsr.setV4(c.V4Pool, c.V4AllocateBlock)
 	if errV4 != nil {
-		return errV4
+		if n := len(lsr.outOf(4, nil)); n != 0 {
+			return errors.New("Can't restore Leaser, " + strconv.Itoa(n) + " IPv4 blocks are allocated, but main pool '" + c.V4Pool + "' /" + strconv.FormatUint(uint64(c.V4AllocateBlock), 10) + " is wrong: " + errV4.Error())
+		}
+
+		// IPv4 pool can be omitted if IPv6 pool is set
+		if c.V4Pool != "" {
+			return errV4
+		}
+	} else if c.V4Free != nil && !equalStrings(c.V4Free, lsr.V4Tree.FreeBlocks()) {
+		log.Println("Stored free IPv4 blocks differ from allocated, free blocks are rebuilt")
 	}
 
-	lsr.V4Idx = c.V4Idx
+	if lsr.V6Pool == nil && lsr.V4Pool == nil {
+		return errors.New("Can't restore Leaser, IPv4 and IPv6 pools are empty")
+	}
+
+	lsr.V6Drain = c.V6Drain && lsr.V6Pool != nil
+	lsr.V4Drain = c.V4Drain && lsr.V4Pool != nil
+
+	// fallback pools are used only after main pool of their IP version
+	for _, f := range []struct {
+		v     uint8
+		pools []MainPool
+	}{{6, c.V6Fallback}, {4, c.V4Fallback}} {
+		if len(f.pools) == 0 {
+			continue
+		}
+
+		pools := append(lsr.specs(f.v), f.pools...)
+		if len(pools) == len(f.pools) {
+			return errors.New("Can't restore Leaser, IPv" + strconv.Itoa(int(f.v)) + " fallback pools are set without main pool")
+		}
+
+		if err := lsr.validPools(f.v, pools); err != nil {
+			return errors.New("Can't restore Leaser, " + err.Error())
+		}
+
+		lsr.setPools(f.v, pools)
+	}
+
+	for _, b := range lsr.Allocated {
+		if lsr.parent(b.Pool) == nil {
+			log.Println("Allocated block", b.ID, b.Pool, "is out of main pools")
+		}
+	}
 
 	return nil
 }
@@ -130,16 +345,18 @@ func (lsr *Leaser) setV6(pool string, ab uint) error {
 
 	switch {
 	case ab >= 128:
-		lsr.clearBlocks(6)
 		return errors.New("Len of allocate block can't be less than 2")
 
+	case ab < maxV6Block:
+		return errors.New("Len of IPv6 allocate block can't be less than " + strconv.Itoa(maxV6Block) + ", addresses aren't given from bigger blocks")
+
 	case net6.SubnetCount(ab) == 0:
-		lsr.clearBlocks(6)
 		return errors.New("Len of main IPv6 address pool to allocate block is 0")
 
 	default:
 		lsr.V6Pool = net6
 		lsr.V6AllocateBlock = ab
+		lsr.V6Tree = lsr.buildTree(net6.String(), 6)
 	}
 
 	return nil
@@ -154,48 +371,57 @@ func (lsr *Leaser) setV4(pool string, ab uint) error {
 
 	switch {
 	case ab >= 32:
-		lsr.clearBlocks(4)
 		return errors.New("Len of allocate block can't be less than 2")
 
 	case net4.SubnetCount(ab) == 0:
-		lsr.clearBlocks(4)
 		return errors.New("Len of main IPv4 address pool to allocate block is 0")
 
 	default:
 		lsr.V4Pool = net4
 		lsr.V4AllocateBlock = ab
+		lsr.V4Tree = lsr.buildTree(net4.String(), 4)
 	}
 
 	return nil
 }
 
-// clearBlocks - delete allocate and free subnet blocks by IP Version, it can be 4 or 6
-func (lsr *Leaser) clearBlocks(v uint8) {
-	if v != 6 && v != 4 {
-		return
-	}
-
-	lsr.Lock()
-	defer lsr.Unlock()
+// buildTree - make allocator of main pool, where allocated and held blocks inside of it are reserved, pool is set as parent of allocated blocks
+func (lsr *Leaser) buildTree(pool string, v uint8) *Buddy {
+	tree, _ := NewBuddy(pool)
+	pn, _ := iplib.ParseIPNet(pool)
+	for _, b := range lsr.Allocated {
+		if b.V != v || !contains(pn, b.Pool) {
+			continue
+		}
 
-	for k, b := range lsr.Allocated {
-		if b.V == v {
-			lsr.Allocated[k] = lsr.Allocated[len(lsr.Allocated)-1]
-			lsr.Allocated = lsr.Allocated[:len(lsr.Allocated)-1]
+		b.Parent = pn.String()
+		err := tree.Reserve(b.Pool)
+		if err != nil {
+			log.Println("Allocated block", b.ID, "can't be reserved:", err)
 		}
 	}
 
-	for k, b := range lsr.Free {
-		if b.V == v {
-			lsr.Free[k] = lsr.Free[len(lsr.Free)-1]
-			lsr.Free = lsr.Free[:len(lsr.Free)-1]
+	for _, h := range lsr.HeldBlocks {
+		if !contains(pn, h.Item) {
+			continue
+		}
+
+		if err := tree.Reserve(h.Item); err != nil {
+			log.Println("Held block", h.Item, "can't be reserved:", err)
 		}
 	}
+
+	return tree
+}
+
+// GetBlock - get one block by IP Version, it can be 4 or 6, and prefix len, if it is 0 allocate block len is used.
+// Returned block with expired hold-down and the same len is given again in order of return,
+// else block is cut from main pool by buddy allocator, the smallest free block which fits is used.
+func (lsr *Leaser) GetBlock(v uint8, prefix uint) (string, string, error) {
+	return lsr.getBlock(v, prefix, "")
 }
 
-// GetBlock - get one block by IP Version, it can be 4 or 6.
-// Firstly try get block from free, and if no blocks in free, cut block from main pool.
-func (lsr *Leaser) GetBlock(v uint8) (string, string, error) {
+func (lsr *Leaser) getBlock(v uint8, prefix uint, key string) (string, string, error) {
 	if v != 6 && v != 4 {
 		return "", "", errors.New("Wrong requested IP protocol version")
 	}
@@ -203,137 +429,519 @@ func (lsr *Leaser) GetBlock(v uint8) (string, string, error) {
 	lsr.Lock()
 	defer lsr.Unlock()
 
-	b, err := lsr.getBlockFromFree(v)
-	if err == nil {
-		lsr.Allocated = append(lsr.Allocated, b)
-		return b.ID, b.Pool, nil
+	if r, ok := lsr.result(key); ok {
+		return r.ID, r.Pool, nil
 	}
 
-	b, err = lsr.getBlockFromMainPool(v)
-	if err == nil {
-		lsr.Allocated = append(lsr.Allocated, b)
-		return b.ID, b.Pool, nil
+	prefix, err := lsr.blockPrefix(v, prefix)
+	if err != nil {
+		return "", "", err
+	}
+
+	b := lsr.getBlockFromHold(v, prefix)
+	if b == nil {
+		lsr.releaseHeld(v, false)
+		if b, err = lsr.getBlockFromMainPool(v, prefix); err != nil {
+			return "", "", err
+		}
+	}
+
+	if err := b.applyExclude(lsr.Exclude, lsr.V6Anycast); err != nil {
+		log.Println(err)
 	}
 
-	return "", "", err
+	lsr.Allocated = append(lsr.Allocated, b)
+	if err := lsr.record(keyed(&JournalEntry{Op: OpBlock, ID: b.ID, Block: b}, key, Result{ID: b.ID, Pool: b.Pool})); err != nil {
+		lsr.dropBlock(len(lsr.Allocated)-1, 0)
+		return "", "", err
+	}
+
+	return b.ID, b.Pool, nil
 }
 
-// get one block from available free blocks by IP Version, it can be 4 or 6.
-func (lsr *Leaser) getBlockFromFree(v uint8) (*Subnet, error) {
-	for k, b := range lsr.Free {
-		if b.V != v {
-			continue
+// blockPrefix - check requested prefix len of block, 0 means allocate block len of every main pool
+func (lsr *Leaser) blockPrefix(v uint8, prefix uint) (uint, error) {
+	if prefix == 0 {
+		return 0, nil
+	}
+
+	bits := uint(32)
+	if v == 6 {
+		bits = 128
+	}
+
+	if prefix >= bits {
+		return 0, errors.New("Len of requested IPv" + strconv.Itoa(int(v)) + " block can't be less than 2")
+	}
+
+	if v == 6 && prefix < maxV6Block {
+		return 0, errors.New("Len of requested IPv6 block can't be less than " + strconv.Itoa(maxV6Block) + ", addresses aren't given from bigger blocks")
+	}
+
+	pools := lsr.pools(v)
+	for _, p := range pools {
+		if prefix > prefixLen(p.net) {
+			return prefix, nil
 		}
-		lsr.Free[k] = lsr.Free[len(lsr.Free)-1]
-		lsr.Free = lsr.Free[:len(lsr.Free)-1]
+	}
 
-		return b, nil
+	if len(pools) != 0 {
+		return 0, errors.New("Requested IPv" + strconv.Itoa(int(v)) + " block /" + strconv.Itoa(int(prefix)) + " is bigger than main pool " + poolNames(pools))
 	}
 
-	return nil, errors.New("No block in Free pool")
+	return prefix, nil
 }
 
-// getBlockFromMainPool - cut one block from main pool by IP Version, it can be 4 or 6.
-func (lsr *Leaser) getBlockFromMainPool(v uint8) (*Subnet, error) {
-	switch v {
-	case 6:
-		if lsr.V6Pool == nil {
-			return nil, errors.New("Can't get new IPv6 address block from main pool, because IPv6 block is ignore")
+// getBlockFromMainPool - cut one block with prefix len from main pools by IP Version, it can be 4 or 6.
+// Pools are tried in order, draining pools are skipped, 0 prefix len means allocate block len of pool.
+func (lsr *Leaser) getBlockFromMainPool(v uint8, prefix uint) (*Subnet, error) {
+	if v != 6 && v != 4 {
+		return nil, errors.New("Wrong requested IP protocol version")
+	}
+
+	pools := lsr.pools(v)
+	if len(pools) == 0 {
+		return nil, errors.New("Can't get new IPv" + strconv.Itoa(int(v)) + " address block from main pool, because IPv" + strconv.Itoa(int(v)) + " block is ignore")
+	}
+
+	err := errors.New("No free IPv" + strconv.Itoa(int(v)) + " block in main pools " + poolNames(pools))
+	for _, p := range pools {
+		ab := prefix
+		if ab == 0 {
+			ab = p.AllocateBlock
 		}
 
-		nbv6 := lsr.V6Pool.NthSubnet(lsr.V6AllocateBlock, uint64(lsr.V6Idx))
-		if nbv6 == nil {
-			return nil, errors.New("Can't get new IPv6 address block from main pool " + lsr.V6Pool.String())
+		if p.Drain {
+			err = errors.New("Main pool " + p.Pool + " is draining, it gives no new blocks")
+			continue
 		}
 
-		lsr.V6Idx++
+		if ab <= prefixLen(p.net) {
+			continue
+		}
 
-		b, err := NewSubnet(nbv6)
+		var pool string
+		if pool, err = p.tree.Allocate(ab); err != nil {
+			continue
+		}
+
+		pn, _ := iplib.ParseIPNet(pool)
+		b, err := NewSubnet(pn)
 		if err != nil {
 			return nil, err
 		}
 
+		b.Parent = p.Pool
 		return b, nil
+	}
 
-	case 4:
-		if lsr.V6Pool == nil {
-			return nil, errors.New("Can't get new IPv4 address block from main pool, because IPv4 block is ignore")
+	return nil, err
+}
+
+// Stats - free space and fragmentation of main pools
+func (lsr *Leaser) Stats() []BuddyStats {
+	lsr.RLock()
+	defer lsr.RUnlock()
+
+	var r []BuddyStats
+	for _, v := range []uint8{6, 4} {
+		for _, p := range lsr.pools(v) {
+			r = append(r, p.tree.Stats())
 		}
+	}
+
+	return r
+}
+
+// ReserveBlock - reserve exactly requested block (CIDR) from main pool.
+// If subPool is not empty, addresses will be given only from this range inside the block.
+func (lsr *Leaser) ReserveBlock(pool, subPool string) (string, string, error) {
+	return lsr.reserveBlock(pool, subPool, "", false)
+}
+
+// PinBlock - reserve block for operator, it is the same as ReserveBlock, but reconciler never releases pinned block
+// if Docker has no network of it
+func (lsr *Leaser) PinBlock(pool, subPool string) (string, string, error) {
+	return lsr.reserveBlock(pool, subPool, "", true)
+}
 
-		nbv4 := lsr.V4Pool.NthSubnet(lsr.V4AllocateBlock, uint32(lsr.V4Idx))
-		if nbv4 == nil {
-			return nil, errors.New("Can't get new IPv4 address block from main pool " + lsr.V4Pool.String())
+func (lsr *Leaser) reserveBlock(pool, subPool, key string, pin bool) (string, string, error) {
+	pn, err := iplib.ParseIPNet(pool)
+	if err != nil {
+		return "", "", errors.New("Can't parce requested address block " + pool)
+	}
+
+	lsr.Lock()
+	defer lsr.Unlock()
+
+	if r, ok := lsr.result(key); ok {
+		return r.ID, r.Pool, nil
+	}
+
+	v, bits := uint8(pn.Version()), uint(32)
+	if v == 6 {
+		bits = 128
+	}
+
+	pools := lsr.pools(v)
+	if len(pools) == 0 {
+		return "", "", errors.New("Can't reserve IPv" + strconv.Itoa(int(v)) + " address block " + pool + ", because IPv" + strconv.Itoa(int(v)) + " block is ignore")
+	}
+
+	parent := lsr.parent(pn.String())
+	if parent == nil {
+		return "", "", errors.New("Requested address block " + pool + " is out of main pool " + poolNames(pools))
+	}
+
+	if prefixLen(pn) >= bits {
+		return "", "", errors.New("Len of requested address block can't be less than 2")
+	}
+
+	if v == 6 && prefixLen(pn) < maxV6Block {
+		return "", "", errors.New("Len of requested IPv6 address block can't be less than " + strconv.Itoa(maxV6Block) + ", addresses aren't given from bigger blocks")
+	}
+
+	if b := lsr.findOverlap(pn.String()); b != nil {
+		return "", "", errors.New("Requested address block " + pool + " overlaps with block " + b.Pool)
+	}
+
+	b, err := NewSubnet(pn)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = b.setRange(subPool)
+	if err != nil {
+		return "", "", err
+	}
+
+	// requested block is given even in hold-down
+	lsr.releaseOverlap(b.Pool)
+	err = parent.tree.Reserve(b.Pool)
+	if err != nil {
+		return "", "", err
+	}
+
+	b.Parent = parent.Pool
+	b.Pinned = pin
+
+	if err := b.applyExclude(lsr.Exclude, lsr.V6Anycast); err != nil {
+		log.Println(err)
+	}
+
+	lsr.Allocated = append(lsr.Allocated, b)
+	if err := lsr.record(keyed(&JournalEntry{Op: OpBlock, ID: b.ID, Block: b}, key, Result{ID: b.ID, Pool: b.Pool})); err != nil {
+		lsr.dropBlock(len(lsr.Allocated)-1, 0)
+		return "", "", err
+	}
+
+	return b.ID, b.Pool, nil
+}
+
+// findOverlap - find allocated block which overlaps with pool, nil if not found
+func (lsr *Leaser) findOverlap(pool string) *Subnet {
+	for _, b := range lsr.Allocated {
+		if isOverlap(b.Pool, pool) {
+			return b
 		}
+	}
 
-		lsr.V4Idx++
+	return nil
+}
 
-		b, err := NewSubnet(nbv4)
-		if err != nil {
-			return nil, err
+// find - allocated block by id and its index, nil if not found
+func (lsr *Leaser) find(id string) (int, *Subnet) {
+	for k, b := range lsr.Allocated {
+		if b.ID == id {
+			return k, b
 		}
+	}
 
-		return b, nil
+	return -1, nil
+}
 
-	default:
-		return nil, errors.New("Wrong requested IP protocol version")
+// dropBlock - remove allocated block by index and return it to main pool, draining pool without blocks is retired.
+// If at isn't 0 block is held from unix time at and it stays reserved in main pool.
+func (lsr *Leaser) dropBlock(k int, at int64) {
+	b := lsr.Allocated[k]
+	lsr.Allocated[k] = lsr.Allocated[len(lsr.Allocated)-1]
+	lsr.Allocated = lsr.Allocated[:len(lsr.Allocated)-1]
+
+	if p := lsr.parent(b.Pool); p != nil {
+		if at != 0 {
+			lsr.holdBlock(b, at)
+		} else if err := p.tree.Release(b.Pool); err != nil {
+			log.Println(err)
+		}
+
+		if p.Drain {
+			lsr.retirePool(b.V)
+		}
 	}
 }
 
-// ReturnBlock - return one allocated block to free
+// ReturnBlock - return one allocated block to main pool, it is joined with free neighbors after hold-down
 func (lsr *Leaser) ReturnBlock(id string) error {
+	return lsr.returnBlock(id, "")
+}
+
+func (lsr *Leaser) returnBlock(id, key string) error {
 	lsr.Lock()
 	defer lsr.Unlock()
 
-	for k, b := range lsr.Allocated {
-		if b.ID == id {
-			lsr.Allocated[k] = lsr.Allocated[len(lsr.Allocated)-1]
-			lsr.Allocated = lsr.Allocated[:len(lsr.Allocated)-1]
-			b.Reset()
-			lsr.Free = append(lsr.Free, b)
+	if _, ok := lsr.result(key); ok {
+		return nil
+	}
 
-			return nil
-		}
+	k, b := lsr.find(id)
+	if b == nil {
+		return errors.New(id + " address block not found")
+	}
+
+	// block is held only if hold-down is set, so journal is replayed in the same way
+	var at int64
+	if lsr.BlockHold > 0 {
+		at = now().Unix()
+	}
+
+	if err := lsr.record(keyed(&JournalEntry{Op: OpReturnBlock, ID: id, Time: at}, key, Result{})); err != nil {
+		return err
 	}
 
-	return errors.New(id + " address block not found")
+	lsr.dropBlock(k, at)
+	return nil
+}
+
+// ExcludeAddresses - set addresses of allocated block which are never given to containers: ip, network or range 'first-last'.
+// Addresses of other IP version are skipped.
+func (lsr *Leaser) ExcludeAddresses(id string, list []string) error {
+	return lsr.excludeAddresses(id, list, "")
 }
 
-// GetAddress - get one address from allocate block
-func (lsr *Leaser) GetAddress(id string) (string, error) {
+func (lsr *Leaser) excludeAddresses(id string, list []string, key string) error {
 	lsr.Lock()
 	defer lsr.Unlock()
 
-	for _, b := range lsr.Allocated {
-		if b.ID == id {
-			ip, err := b.GetAddress()
-			if err != nil {
-				log.Println(err)
-				return "", errors.New(id + " can't get ip address.")
-			}
+	if _, ok := lsr.result(key); ok {
+		return nil
+	}
 
-			switch {
-			case b.V == 6:
-				return ip + "/" + strconv.Itoa(int(lsr.V6AllocateBlock)), nil
+	_, b := lsr.find(id)
+	if b == nil {
+		return errors.New(id + " address block not found")
+	}
+
+	prev := b.Exclude
+	b.Exclude = list
+
+	err := b.applyExclude(lsr.Exclude, lsr.V6Anycast)
+	if err == nil {
+		err = lsr.record(keyed(&JournalEntry{Op: OpExclude, ID: id, Exclude: list}, key, Result{}))
+	}
 
-			case b.V == 4:
-				return ip + "/" + strconv.Itoa(int(lsr.V4AllocateBlock)), nil
-			}
+	if err != nil {
+		b.Exclude = prev
+		b.applyExclude(lsr.Exclude, lsr.V6Anycast)
+		return err
+	}
+
+	return nil
+}
+
+// GetAddress - get one address from allocate block, if MAC is not empty it gets same address as before
+func (lsr *Leaser) GetAddress(id, mac string) (string, error) {
+	return lsr.getAddress(id, mac, "")
+}
+
+func (lsr *Leaser) getAddress(id, mac, key string) (string, error) {
+	lsr.Lock()
+	defer lsr.Unlock()
+
+	if r, ok := lsr.result(key); ok {
+		return r.Address, nil
+	}
+
+	_, b := lsr.find(id)
+	if b == nil {
+		return "", errors.New(id + " address block not found")
+	}
+
+	ip, err := b.GetAddress(mac, lsr.MACRetention, lsr.AddressHold)
+	if err != nil {
+		log.Println(err)
+		return "", errors.New(id + " can't get ip address.")
+	}
+
+	if err := lsr.record(keyed(&JournalEntry{Op: OpAddress, ID: id, IP: ip, MAC: mac}, key, Result{Address: ip + "/" + b.Mask()})); err != nil {
+		b.unlease(ip, 0, false)
+		return "", err
+	}
+
+	return ip + "/" + b.Mask(), nil
+}
+
+// ReserveAddress - reserve exactly requested address from allocate block, if MAC is not empty address is bound to it
+func (lsr *Leaser) ReserveAddress(id, address, mac string) (string, error) {
+	return lsr.reserveAddress(id, address, mac, "", false)
+}
+
+// PinAddress - reserve address for operator, it is the same as ReserveAddress, but reconciler never releases pinned address
+// if Docker has no container with it
+func (lsr *Leaser) PinAddress(id, address, mac string) (string, error) {
+	return lsr.reserveAddress(id, address, mac, "", true)
+}
+
+func (lsr *Leaser) reserveAddress(id, address, mac, key string, pin bool) (string, error) {
+	lsr.Lock()
+	defer lsr.Unlock()
+
+	if r, ok := lsr.result(key); ok {
+		return r.Address, nil
+	}
+
+	_, b := lsr.find(id)
+	if b == nil {
+		return "", errors.New(id + " address block not found")
+	}
+
+	ip, err := b.ReserveAddress(address, mac)
+	if err != nil {
+		return "", err
+	}
+
+	if err := lsr.record(keyed(&JournalEntry{Op: OpAddress, ID: id, IP: ip, MAC: mac, Pinned: pin}, key, Result{Address: ip + "/" + b.Mask()})); err != nil {
+		b.unlease(ip, 0, false)
+		return "", err
+	}
+
+	if pin {
+		b.pin(ip)
+	}
+
+	return ip + "/" + b.Mask(), nil
+}
+
+// GetGateway - get gateway address of allocate block, if address is empty it will be choosen by gateway policy
+func (lsr *Leaser) GetGateway(id, address string) (string, error) {
+	return lsr.getGateway(id, address, "")
+}
+
+func (lsr *Leaser) getGateway(id, address, key string) (string, error) {
+	lsr.Lock()
+	defer lsr.Unlock()
+
+	if r, ok := lsr.result(key); ok {
+		return r.Address, nil
+	}
+
+	_, b := lsr.find(id)
+	if b == nil {
+		return "", errors.New(id + " address block not found")
+	}
+
+	prev := b.Gateway
+	ip, err := b.GetGateway(lsr.gatewayPolicy(b), address, lsr.MACRetention, lsr.AddressHold)
+	if err != nil {
+		return "", err
+	}
+
+	if ip != prev {
+		if err := lsr.record(keyed(&JournalEntry{Op: OpGateway, ID: id, IP: ip}, key, Result{Address: ip + "/" + b.Mask()})); err != nil {
+			b.Gateway = prev
+			return "", err
 		}
 	}
 
-	return "", errors.New(id + " address block not found")
+	return ip + "/" + b.Mask(), nil
 }
 
 // ReturnAddress - return address to allocate block
 func (lsr *Leaser) ReturnAddress(id, address string) error {
+	return lsr.returnAddress(id, address, "")
+}
+
+func (lsr *Leaser) returnAddress(id, address, key string) error {
 	lsr.Lock()
 	defer lsr.Unlock()
 
-	for _, b := range lsr.Allocated {
-		if b.ID == id {
-			return b.ReturnAddress(address)
+	if _, ok := lsr.result(key); ok {
+		return nil
+	}
+
+	_, b := lsr.find(id)
+	if b == nil {
+		return errors.New(id + " address block not found")
+	}
+
+	changed, err := b.returnable(address)
+	if err != nil || !changed {
+		return err
+	}
+
+	ip, at, held := strings.Split(address, "/")[0], now().Unix(), lsr.AddressHold > 0
+	if err := lsr.record(keyed(&JournalEntry{Op: OpRelease, ID: id, IP: ip, Time: at, Hold: held}, key, Result{})); err != nil {
+		return err
+	}
+
+	return b.unlease(ip, at, held)
+}
+
+// utils
+func isIPNet(pool string) bool {
+	_, err := iplib.ParseIPNet(pool)
+	return err == nil
+}
+
+// isOverlap - true if one of networks contains another
+func isOverlap(a, b string) bool {
+	na, err := iplib.ParseIPNet(a)
+	if err != nil {
+		return false
+	}
+
+	nb, err := iplib.ParseIPNet(b)
+	if err != nil {
+		return false
+	}
+
+	switch na := na.(type) {
+	case *iplib.IPv6Net:
+		if nb, ok := nb.(*iplib.IPv6Net); ok {
+			related, _ := na.Rel(nb)
+			return related
+		}
+
+	case *iplib.IPv4Net:
+		if nb, ok := nb.(*iplib.IPv4Net); ok {
+			related, _ := na.Rel(nb)
+			return related
+		}
+	}
+
+	return false
+}
+
+// removeString - list without s
+func removeString(list []string, s string) []string {
+	for k := range list {
+		if list[k] == s {
+			return append(list[:k:k], list[k+1:]...)
+		}
+	}
+
+	return list
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k := range a {
+		if a[k] != b[k] {
+			return false
 		}
 	}
 
-	return errors.New(id + " address block not found")
+	return true
 }
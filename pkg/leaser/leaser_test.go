@@ -1,7 +1,10 @@
 package leaser
 
 import (
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -25,6 +28,9 @@ func TestNew(t *testing.T) {
 		"Right v4 pool and wrong AB=32, empty v6":      {NetV6: "", NetV6AB: 0, NetV4: "192.168.0.1/16", NetV4AB: 32, Success: false, ErrStr: "Can't create new Leaser, IPv4 and IPv6 pools are empty"},
 		"Right v4 pool and wrong AB=33, empty v6":      {NetV6: "", NetV6AB: 0, NetV4: "192.168.0.1/16", NetV4AB: 33, Success: false, ErrStr: "Can't create new Leaser, IPv4 and IPv6 pools are empty"},
 		"Right v4 pool (16) and wrong AB=8, empty v6":  {NetV6: "", NetV6AB: 0, NetV4: "192.168.0.1/16", NetV4AB: 8, Success: false, ErrStr: "Can't create new Leaser, IPv4 and IPv6 pools are empty"},
+		"Right v6 pool and wrong v4 pool":              {NetV6: "fe80::/48", NetV6AB: 64, NetV4: "bla", NetV4AB: 24, Success: false, ErrStr: "Can't parce main IPv4 address pool"},
+		"Right v6 pool and wrong v4 AB=8":              {NetV6: "fe80::/48", NetV6AB: 64, NetV4: "192.168.0.1/16", NetV4AB: 8, Success: false, ErrStr: "Len of main IPv4 address pool to allocate block is 0"},
+		"Right v6 pool and AB=56 bigger than /64":      {NetV6: "fe80::/48", NetV6AB: 56, NetV4: "", NetV4AB: 0, Success: false, ErrStr: "Can't create new Leaser, IPv4 and IPv6 pools are empty"},
 
 		"Right v6 and empty v4": {NetV6: "fe80::/48", NetV6AB: 64, NetV4: "", NetV4AB: 0, Success: true},
 		"Empty v6 and right v4": {NetV6: "", NetV6AB: 0, NetV4: "192.168.0.1/16", NetV4AB: 24, Success: true},
@@ -32,6 +38,7 @@ func TestNew(t *testing.T) {
 	}
 
 	for k, v := range cases {
+		v := v
 		t.Run(k, func(t *testing.T) {
 			t.Parallel()
 			lsr, err := New(v.NetV6, v.NetV4, v.NetV6AB, v.NetV4AB)
@@ -53,29 +60,159 @@ func TestGetBlock(t *testing.T) {
 		t.Error("Expected success create new Leaser")
 	}
 
-	name, ipnet, err := lsr.GetBlock(4)
+	name, ipnet, err := lsr.GetBlock(4, 0)
 	if len(name) == 0 || ipnet != "192.168.0.0/24" || err != nil {
 		t.Error("Expected success for get IPv4 block")
 	}
 
-	name, ipnet, err = lsr.GetBlock(6)
+	name, ipnet, err = lsr.GetBlock(6, 0)
 	if len(name) == 0 || ipnet != "fe80::/64" || err != nil {
 		t.Error("Expected success for get IPv6 block")
 	}
 
-	name, ipnet, err = lsr.GetBlock(0)
+	name, ipnet, err = lsr.GetBlock(0, 0)
 	if len(name) != 0 || len(ipnet) != 0 || err == nil {
 		t.Error("Expected fail for IPv0 (error version of ip protocol), but success")
 	}
 }
 
+func TestGetBlockPrefix(t *testing.T) {
+	lsr, err := New("fe80::/48", "192.168.0.1/16", 64, 24)
+	if lsr == nil || err != nil {
+		t.Error("Expected success create new Leaser")
+	}
+
+	_, ipnet, err := lsr.GetBlock(4, 26)
+	if ipnet != "192.168.0.0/26" || err != nil {
+		t.Error("Expected success for get IPv4 /26 block, got", ipnet, err)
+	}
+
+	// default block skips overlapped /26
+	_, ipnet, err = lsr.GetBlock(4, 0)
+	if ipnet != "192.168.1.0/24" || err != nil {
+		t.Error("Expected success for get IPv4 /24 block, got", ipnet, err)
+	}
+
+	name, ipnet, err := lsr.GetBlock(4, 26)
+	if ipnet != "192.168.0.64/26" || err != nil {
+		t.Error("Expected success for get next IPv4 /26 block, got", ipnet, err)
+	}
+
+	// returned block is reused only for same prefix len
+	lsr.ReturnBlock(name)
+	_, ipnet, _ = lsr.GetBlock(4, 25)
+	if ipnet != "192.168.0.128/25" {
+		t.Error("Expected 192.168.0.128/25, got", ipnet)
+	}
+
+	_, ipnet, _ = lsr.GetBlock(4, 26)
+	if ipnet != "192.168.0.64/26" {
+		t.Error("Expected returned 192.168.0.64/26, got", ipnet)
+	}
+
+	_, ipnet, err = lsr.GetBlock(6, 96)
+	if ipnet != "fe80::/96" || err != nil {
+		t.Error("Expected success for get IPv6 /96 block, got", ipnet, err)
+	}
+
+	_, _, err = lsr.GetBlock(4, 8)
+	if err == nil {
+		t.Error("Expected fail for get IPv4 block bigger than main pool")
+	}
+
+	// addresses aren't given from IPv6 blocks bigger than /64
+	_, _, err = lsr.GetBlock(6, 56)
+	if err == nil || err.Error() != "Len of requested IPv6 block can't be less than 64, addresses aren't given from bigger blocks" {
+		t.Error("Expected fail for get IPv6 /56 block, got", err)
+	}
+
+	_, _, err = lsr.GetBlock(4, 32)
+	if err == nil {
+		t.Error("Expected fail for get IPv4 /32 block")
+	}
+}
+
+func TestReserveBlock(t *testing.T) {
+	lsr, err := New("fe80::/48", "192.168.0.1/16", 64, 24)
+	if lsr == nil || err != nil {
+		t.Error("Expected success create new Leaser")
+	}
+
+	name, ipnet, err := lsr.ReserveBlock("192.168.0.0/24", "")
+	if len(name) == 0 || ipnet != "192.168.0.0/24" || err != nil {
+		t.Error("Expected success for reserve IPv4 block")
+	}
+
+	_, _, err = lsr.ReserveBlock("192.168.0.128/25", "")
+	if err == nil {
+		t.Error("Expected fail for reserve IPv4 block overlapped with allocated block")
+	}
+
+	_, _, err = lsr.ReserveBlock("10.0.0.0/24", "")
+	if err == nil {
+		t.Error("Expected fail for reserve IPv4 block out of main pool")
+	}
+
+	_, _, err = lsr.ReserveBlock("192.168.5.0/24", "192.168.6.0/25")
+	if err == nil {
+		t.Error("Expected fail for reserve IPv4 block with sub pool out of block")
+	}
+
+	// next block from main pool skips reserved one
+	_, ipnet, err = lsr.GetBlock(4, 0)
+	if ipnet != "192.168.1.0/24" || err != nil {
+		t.Error("Expected success for get IPv4 block after reserved")
+	}
+
+	name, ipnet, err = lsr.ReserveBlock("192.168.2.0/24", "192.168.2.128/25")
+	if len(name) == 0 || ipnet != "192.168.2.0/24" || err != nil {
+		t.Error("Expected success for reserve IPv4 block with sub pool")
+	}
+
+	addr, err := lsr.GetAddress(name, "")
+	if addr != "192.168.2.128/24" || err != nil {
+		t.Error("Expected success for get IPv4 address from sub pool, got", addr, err)
+	}
+
+	// returned block can be reserved again
+	err = lsr.ReturnBlock(name)
+	if err != nil {
+		t.Error("Expected success for return IPv4 block")
+	}
+
+	name, ipnet, err = lsr.ReserveBlock("192.168.2.0/24", "")
+	if len(name) == 0 || ipnet != "192.168.2.0/24" || err != nil {
+		t.Error("Expected success for reserve returned IPv4 block")
+	}
+
+	addr, err = lsr.GetAddress(name, "")
+	if addr != "192.168.2.1/24" || err != nil {
+		t.Error("Expected success for get IPv4 address from reserved block, got", addr, err)
+	}
+
+	name, ipnet, err = lsr.ReserveBlock("fe80:0:0:10::/64", "fe80:0:0:10::100/120")
+	if len(name) == 0 || ipnet != "fe80:0:0:10::/64" || err != nil {
+		t.Error("Expected success for reserve IPv6 block with sub pool")
+	}
+
+	addr, err = lsr.GetAddress(name, "")
+	if addr != "fe80:0:0:10::100/64" || err != nil {
+		t.Error("Expected success for get IPv6 address from sub pool, got", addr, err)
+	}
+
+	_, _, err = lsr.ReserveBlock("fe80:0:0:100::/56", "")
+	if err == nil || err.Error() != "Len of requested IPv6 address block can't be less than 64, addresses aren't given from bigger blocks" {
+		t.Error("Expected fail for reserve IPv6 /56 block, got", err)
+	}
+}
+
 func TestReturnBlock(t *testing.T) {
 	lsr, err := New("fe80::/48", "192.168.0.1/16", 64, 24)
 	if lsr == nil || err != nil {
 		t.Error("Expected success create new Leaser")
 	}
 
-	name, ipnet, err := lsr.GetBlock(4)
+	name, ipnet, err := lsr.GetBlock(4, 0)
 	if len(name) == 0 || ipnet != "192.168.0.0/24" || err != nil {
 		t.Error("Expected success for get IPv4 block")
 	}
@@ -85,7 +222,7 @@ func TestReturnBlock(t *testing.T) {
 		t.Error("Expected success for return IPv4 block")
 	}
 
-	name, ipnet, err = lsr.GetBlock(6)
+	name, ipnet, err = lsr.GetBlock(6, 0)
 	if len(name) == 0 || ipnet != "fe80::/64" || err != nil {
 		t.Error("Expected success for get IPv6 block")
 	}
@@ -107,44 +244,384 @@ func TestGetAddress(t *testing.T) {
 		t.Error("Expected success create new Leaser")
 	}
 
-	name, ipnet, err := lsr.GetBlock(4)
+	name, ipnet, err := lsr.GetBlock(4, 0)
 	if len(name) == 0 || ipnet != "192.168.0.0/24" || err != nil {
 		t.Error("Expected success for get IPv4 block")
 	}
 
-	addr, err := lsr.GetAddress(name)
+	addr, err := lsr.GetAddress(name, "")
 	if addr != "192.168.0.1/24" || err != nil {
 		t.Error("Expected success for get IPv4 address from block")
 	}
 
-	name, ipnet, err = lsr.GetBlock(6)
+	name, ipnet, err = lsr.GetBlock(6, 0)
 	if len(name) == 0 || ipnet != "fe80::/64" || err != nil {
 		t.Error("Expected success for get IPv6 block")
 	}
 
-	addr, err = lsr.GetAddress(name)
+	addr, err = lsr.GetAddress(name, "")
 	if addr != "fe80::1/64" || err != nil {
 		t.Error("Expected success for get IPv6 address from block")
 	}
 
-	addr, err = lsr.GetAddress("aaa")
+	addr, err = lsr.GetAddress("aaa", "")
 	if len(addr) != 0 || err == nil {
 		t.Error("Expected fail for get IP address from unknown 'aaa' block")
 	}
 }
 
+func TestReserveAddress(t *testing.T) {
+	lsr, err := New("fe80::/48", "192.168.0.1/16", 64, 24)
+	if lsr == nil || err != nil {
+		t.Error("Expected success create new Leaser")
+	}
+
+	name, _, err := lsr.GetBlock(4, 0)
+	if len(name) == 0 || err != nil {
+		t.Error("Expected success for get IPv4 block")
+	}
+
+	addr, err := lsr.ReserveAddress(name, "192.168.0.2", "")
+	if addr != "192.168.0.2/24" || err != nil {
+		t.Error("Expected success for reserve IPv4 address above index, got", addr, err)
+	}
+
+	_, err = lsr.ReserveAddress(name, "192.168.0.2", "")
+	if err == nil {
+		t.Error("Expected fail for reserve allocated IPv4 address")
+	}
+
+	_, err = lsr.ReserveAddress(name, "192.168.1.2", "")
+	if err == nil {
+		t.Error("Expected fail for reserve IPv4 address out of block")
+	}
+
+	_, err = lsr.ReserveAddress(name, "192.168.0.0", "")
+	if err == nil {
+		t.Error("Expected fail for reserve IPv4 network address")
+	}
+
+	// taken address is skipped
+	addr, _ = lsr.GetAddress(name, "")
+	if addr != "192.168.0.1/24" {
+		t.Error("Expected 192.168.0.1/24, got", addr)
+	}
+
+	addr, _ = lsr.GetAddress(name, "")
+	if addr != "192.168.0.3/24" {
+		t.Error("Expected 192.168.0.3/24 (skip reserved), got", addr)
+	}
+
+	// returned address is reserved from free
+	err = lsr.ReturnAddress(name, "192.168.0.1/24")
+	if err != nil {
+		t.Error("Expected success for return IPv4 address")
+	}
+
+	addr, err = lsr.ReserveAddress(name, "192.168.0.1", "")
+	if addr != "192.168.0.1/24" || err != nil {
+		t.Error("Expected success for reserve IPv4 address from free, got", addr, err)
+	}
+
+	addr, _ = lsr.GetAddress(name, "")
+	if addr != "192.168.0.4/24" {
+		t.Error("Expected 192.168.0.4/24, got", addr)
+	}
+
+	name, _, err = lsr.GetBlock(6, 0)
+	if len(name) == 0 || err != nil {
+		t.Error("Expected success for get IPv6 block")
+	}
+
+	addr, err = lsr.ReserveAddress(name, "fe80:0:0:0:0:0:0:1", "")
+	if addr != "fe80::1/64" || err != nil {
+		t.Error("Expected success for reserve IPv6 address, got", addr, err)
+	}
+
+	addr, _ = lsr.GetAddress(name, "")
+	if addr != "fe80::2/64" {
+		t.Error("Expected fe80::2/64, got", addr)
+	}
+
+	_, err = lsr.ReserveAddress("aaa", "fe80::5", "")
+	if err == nil {
+		t.Error("Expected fail for reserve IP address in unknown 'aaa' block")
+	}
+}
+
+func TestGetGateway(t *testing.T) {
+	lsr, err := New("fe80::/48", "192.168.0.1/16", 64, 24)
+	if lsr == nil || err != nil {
+		t.Error("Expected success create new Leaser")
+	}
+
+	name, _, err := lsr.GetBlock(4, 0)
+	if len(name) == 0 || err != nil {
+		t.Error("Expected success for get IPv4 block")
+	}
+
+	addr, err := lsr.GetGateway(name, "")
+	if addr != "192.168.0.1/24" || err != nil {
+		t.Error("Expected success for get first IPv4 gateway, got", addr, err)
+	}
+
+	// gateway is never given to container
+	addr, _ = lsr.GetAddress(name, "")
+	if addr != "192.168.0.2/24" {
+		t.Error("Expected 192.168.0.2/24, got", addr)
+	}
+
+	_, err = lsr.ReserveAddress(name, "192.168.0.1", "")
+	if err == nil {
+		t.Error("Expected fail for reserve gateway address")
+	}
+
+	// gateway survives return address and block
+	err = lsr.ReturnAddress(name, "192.168.0.1/24")
+	if err != nil {
+		t.Error("Expected success for return gateway address")
+	}
+
+	err = lsr.ReturnBlock(name)
+	if err != nil {
+		t.Error("Expected success for return IPv4 block")
+	}
+
+	name, _, _ = lsr.GetBlock(4, 0)
+	addr, err = lsr.GetGateway(name, "")
+	if addr != "192.168.0.1/24" || err != nil {
+		t.Error("Expected success for get same IPv4 gateway, got", addr, err)
+	}
+
+	addr, _ = lsr.GetAddress(name, "")
+	if addr != "192.168.0.2/24" {
+		t.Error("Expected 192.168.0.2/24, got", addr)
+	}
+
+	// explicit gateway
+	addr, err = lsr.GetGateway(name, "192.168.0.100")
+	if addr != "192.168.0.100/24" || err != nil {
+		t.Error("Expected success for get requested IPv4 gateway, got", addr, err)
+	}
+
+	addr, _ = lsr.GetAddress(name, "")
+	if addr != "192.168.0.1/24" {
+		t.Error("Expected previous gateway 192.168.0.1/24, got", addr)
+	}
+
+	_, err = lsr.GetGateway(name, "192.168.0.2")
+	if err == nil {
+		t.Error("Expected fail for get allocated address as gateway")
+	}
+
+	// policies
+	err = lsr.SetGatewayPolicy("bla")
+	if err == nil {
+		t.Error("Expected fail for wrong gateway policy")
+	}
+
+	err = lsr.SetGatewayPolicy(GatewayLast)
+	if err != nil {
+		t.Error("Expected success for last gateway policy")
+	}
+
+	name, _, _ = lsr.GetBlock(4, 0)
+	addr, err = lsr.GetGateway(name, "")
+	if addr != "192.168.1.254/24" || err != nil {
+		t.Error("Expected success for get last IPv4 gateway, got", addr, err)
+	}
+
+	name, _, _ = lsr.GetBlock(6, 0)
+	addr, err = lsr.GetGateway(name, "")
+	if addr != "fe80::ffff:ffff:ffff:ffff/64" || err != nil {
+		t.Error("Expected success for get last IPv6 gateway, got", addr, err)
+	}
+
+	err = lsr.SetGatewayPolicy("10")
+	if err != nil {
+		t.Error("Expected success for offset gateway policy")
+	}
+
+	name, _, _ = lsr.GetBlock(4, 0)
+	addr, err = lsr.GetGateway(name, "")
+	if addr != "192.168.2.10/24" || err != nil {
+		t.Error("Expected success for get IPv4 gateway by offset, got", addr, err)
+	}
+
+	err = lsr.SetGatewayPolicy("300")
+	if err != nil {
+		t.Error("Expected success for offset gateway policy")
+	}
+
+	name, _, _ = lsr.GetBlock(4, 0)
+	_, err = lsr.GetGateway(name, "")
+	if err == nil {
+		t.Error("Expected fail for get IPv4 gateway by offset out of block")
+	}
+
+	// policy of main pool
+	err = lsr.SetPoolGateway("fe80::/48", GatewayFirst)
+	if err != nil {
+		t.Error("Expected success for gateway policy of main pool")
+	}
+
+	name, _, _ = lsr.GetBlock(6, 0)
+	addr, err = lsr.GetGateway(name, "")
+	if addr != "fe80:0:0:1::1/64" || err != nil {
+		t.Error("Expected success for get first IPv6 gateway by policy of main pool, got", addr, err)
+	}
+
+	if lsr.SetPoolGateway("fe80::/48", "bla") == nil {
+		t.Error("Expected fail for wrong gateway policy of main pool")
+	}
+}
+
+func TestMACBinding(t *testing.T) {
+	lsr, err := New("fe80::/48", "192.168.0.1/16", 64, 24)
+	if lsr == nil || err != nil {
+		t.Error("Expected success create new Leaser")
+	}
+
+	err = lsr.SetMACRetention(time.Hour)
+	if err != nil {
+		t.Error("Expected success for set MAC retention")
+	}
+
+	name, _, _ := lsr.GetBlock(4, 0)
+	addr, _ := lsr.GetAddress(name, "02:42:c0:a8:00:01")
+	if addr != "192.168.0.1/24" {
+		t.Error("Expected 192.168.0.1/24, got", addr)
+	}
+
+	addr, _ = lsr.GetAddress(name, "02:42:c0:a8:00:02")
+	if addr != "192.168.0.2/24" {
+		t.Error("Expected 192.168.0.2/24, got", addr)
+	}
+
+	lsr.ReturnAddress(name, "192.168.0.1/24")
+	lsr.ReturnAddress(name, "192.168.0.2/24")
+
+	// released addresses are retained for its MAC
+	addr, _ = lsr.GetAddress(name, "02:42:c0:a8:00:03")
+	if addr != "192.168.0.3/24" {
+		t.Error("Expected 192.168.0.3/24 (retained addresses skipped), got", addr)
+	}
+
+	addr, _ = lsr.GetAddress(name, "02:42:C0:A8:00:01")
+	if addr != "192.168.0.1/24" {
+		t.Error("Expected same 192.168.0.1/24 for same MAC, got", addr)
+	}
+
+	// binding expires after retention period
+	now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	defer func() { now = time.Now }()
+
+	addr, _ = lsr.GetAddress(name, "02:42:c0:a8:00:04")
+	if addr != "192.168.0.2/24" {
+		t.Error("Expected expired 192.168.0.2/24, got", addr)
+	}
+
+	addr, _ = lsr.GetAddress(name, "02:42:c0:a8:00:02")
+	if addr != "192.168.0.4/24" {
+		t.Error("Expected new 192.168.0.4/24 for expired MAC, got", addr)
+	}
+
+	err = lsr.SetMACRetention(-time.Hour)
+	if err == nil {
+		t.Error("Expected fail for negative MAC retention")
+	}
+}
+
+// TestMACChurn - containers with random MAC never come back, retained addresses of small block are given again
+func TestMACChurn(t *testing.T) {
+	lsr, err := New("fe80::/48", "192.168.0.0/16", 64, 29)
+	require.NoError(t, err)
+	require.NoError(t, lsr.SetMACRetention(24*time.Hour))
+
+	sec := int64(0)
+	now = func() time.Time { sec++; return time.Unix(1600000000+sec, 0) }
+	defer func() { now = time.Now }()
+
+	id, _, err := lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+
+	// gateway and 5 addresses of /29
+	_, err = lsr.GetGateway(id, "")
+	require.NoError(t, err)
+
+	for i := 0; i < 50; i++ {
+		addr, err := lsr.GetAddress(id, "02:42:c0:a8:01:"+strconv.Itoa(10+i))
+		require.NoError(t, err, "cycle %d", i)
+		require.NoError(t, lsr.ReturnAddress(id, addr))
+	}
+
+	_, b := lsr.find(id)
+	require.Equal(t, uint64(0), b.Leases.Len())
+	require.Len(t, b.Bindings, 5)
+
+	// the earliest released address is given first, the latest MAC keeps its address
+	_, err = lsr.GetAddress(id, "02:42:c0:a8:02:01")
+	require.NoError(t, err)
+
+	addr, err := lsr.GetAddress(id, "02:42:c0:a8:01:59")
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.6/29", addr)
+
+	// other addresses are leased
+	for i := 0; i < 3; i++ {
+		_, err = lsr.GetAddress(id, "02:42:c0:a8:03:0"+strconv.Itoa(i))
+		require.NoError(t, err)
+	}
+
+	_, err = lsr.GetAddress(id, "02:42:c0:a8:03:09")
+	require.Error(t, err)
+}
+
+func TestGatewayConflict(t *testing.T) {
+	lsr, err := New("fe80::/48", "192.168.0.0/16", 64, 24)
+	require.NoError(t, err)
+	require.NoError(t, lsr.SetMACRetention(time.Hour))
+	require.NoError(t, lsr.SetHoldDown(time.Minute, 0))
+
+	start := time.Now()
+	now = func() time.Time { return start }
+	defer func() { now = time.Now }()
+
+	id, _, err := lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+
+	// first address is released before gateway is choosen
+	addr, err := lsr.GetAddress(id, "02:42:c0:a8:00:01")
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.1/24", addr)
+	require.NoError(t, lsr.ReturnAddress(id, addr))
+
+	_, err = lsr.GetGateway(id, "")
+	require.ErrorContains(t, err, "retained for MAC 02:42:c0:a8:00:01")
+
+	require.NoError(t, lsr.SetMACRetention(0))
+	_, err = lsr.GetGateway(id, "")
+	require.ErrorContains(t, err, "hold-down")
+
+	// expired hold-down doesn't keep address
+	now = func() time.Time { return start.Add(2 * time.Minute) }
+	addr, err = lsr.GetGateway(id, "")
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.1/24", addr)
+}
+
 func TestReturnAddress(t *testing.T) {
 	lsr, err := New("fe80::/48", "192.168.0.1/16", 64, 24)
 	if lsr == nil || err != nil {
 		t.Error("Expected success create new Leaser")
 	}
 
-	name, ipnet, err := lsr.GetBlock(4)
+	name, ipnet, err := lsr.GetBlock(4, 0)
 	if len(name) == 0 || ipnet != "192.168.0.0/24" || err != nil {
 		t.Error("Expected success for get IPv4 block")
 	}
 
-	addr, err := lsr.GetAddress(name)
+	addr, err := lsr.GetAddress(name, "")
 	if addr != "192.168.0.1/24" || err != nil {
 		t.Error("Expected success for get IPv4 address from block")
 	}
@@ -159,12 +636,12 @@ func TestReturnAddress(t *testing.T) {
 		t.Error("Expected fail for return IPv4 address to block")
 	}
 
-	name, ipnet, err = lsr.GetBlock(6)
+	name, ipnet, err = lsr.GetBlock(6, 0)
 	if len(name) == 0 || ipnet != "fe80::/64" || err != nil {
 		t.Error("Expected success for get IPv6 block")
 	}
 
-	addr, err = lsr.GetAddress(name)
+	addr, err = lsr.GetAddress(name, "")
 	if addr != "fe80::1/64" || err != nil {
 		t.Error("Expected success for get IPv6 address from block")
 	}
@@ -184,3 +661,102 @@ func TestReturnAddress(t *testing.T) {
 		t.Error("Expected fail for return IP address to 'aaa' unknown block")
 	}
 }
+
+func TestExclude(t *testing.T) {
+	lsr, err := New("fe80::/48", "192.168.0.1/16", 64, 24)
+	if lsr == nil || err != nil {
+		t.Error("Expected success create new Leaser")
+	}
+
+	// broadcast is never given
+	name, _, _ := lsr.GetBlock(4, 30)
+	lsr.GetAddress(name, "")
+	lsr.GetAddress(name, "")
+	addr, err := lsr.GetAddress(name, "")
+	if err == nil {
+		t.Error("Expected fail for get IPv4 broadcast address, got", addr)
+	}
+
+	_, err = lsr.ReserveAddress(name, "192.168.0.3", "")
+	if err == nil {
+		t.Error("Expected fail for reserve IPv4 broadcast address")
+	}
+
+	err = lsr.SetExclude([]string{"bla"})
+	if err == nil {
+		t.Error("Expected fail for wrong excluded addresses")
+	}
+
+	err = lsr.SetExclude([]string{"192.168.1.1", "192.168.1.3-192.168.1.4", "fe80::/126"})
+	if err != nil {
+		t.Error("Expected success for set excluded addresses of main pools")
+	}
+
+	name, _, _ = lsr.GetBlock(4, 0)
+	addr, _ = lsr.GetAddress(name, "")
+	if addr != "192.168.1.2/24" {
+		t.Error("Expected 192.168.1.2/24 (skip excluded), got", addr)
+	}
+
+	addr, _ = lsr.GetAddress(name, "")
+	if addr != "192.168.1.5/24" {
+		t.Error("Expected 192.168.1.5/24 (skip excluded range), got", addr)
+	}
+
+	_, err = lsr.ReserveAddress(name, "192.168.1.4", "")
+	if err == nil {
+		t.Error("Expected fail for reserve excluded address")
+	}
+
+	// excluded address isn't choosen by policy, but it can be requested gateway
+	_, err = lsr.GetGateway(name, "")
+	if err == nil || !strings.Contains(err.Error(), "excluded by 192.168.1.1") {
+		t.Error("Expected fail naming exclusion for excluded gateway by policy, got", err)
+	}
+
+	addr, err = lsr.GetGateway(name, "192.168.1.1")
+	if addr != "192.168.1.1/24" || err != nil {
+		t.Error("Expected success for get requested excluded gateway, got", addr, err)
+	}
+
+	// block exclusions
+	err = lsr.ExcludeAddresses(name, []string{"192.168.1.6/31", "fe80::1"})
+	if err != nil {
+		t.Error("Expected success for exclude addresses of block, got", err)
+	}
+
+	addr, _ = lsr.GetAddress(name, "")
+	if addr != "192.168.1.8/24" {
+		t.Error("Expected 192.168.1.8/24 (skip block excluded), got", addr)
+	}
+
+	err = lsr.ExcludeAddresses(name, []string{"192.168.2.1"})
+	if err == nil {
+		t.Error("Expected fail for exclude address out of block")
+	}
+
+	err = lsr.ExcludeAddresses("aaa", []string{"192.168.2.1"})
+	if err == nil {
+		t.Error("Expected fail for exclude addresses of unknown 'aaa' block")
+	}
+
+	// IPv6 subnet-router anycast address
+	name, _, _ = lsr.GetBlock(6, 0)
+	addr, _ = lsr.GetAddress(name, "")
+	if addr != "fe80::4/64" {
+		t.Error("Expected fe80::4/64 (skip excluded), got", addr)
+	}
+
+	_, err = lsr.ReserveAddress(name, "fe80::", "")
+	if err == nil {
+		t.Error("Expected fail for reserve IPv6 subnet-router anycast address")
+	}
+
+	lsr.SetV6Anycast(true)
+	lsr.SetExclude(nil)
+
+	addr, _ = lsr.GetAddress(name, "")
+	if addr != "fe80::/64" {
+		t.Error("Expected fe80::/64 (subnet-router anycast address), got", addr)
+	}
+}
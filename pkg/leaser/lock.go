@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package leaser
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile - open file and take flock on it without wait, exclusive lock conflicts with any other lock
+func lockFile(name string, exclusive bool) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errors.New("File " + name + " is locked by another gipam process")
+		}
+
+		return nil, err
+	}
+
+	return f, nil
+}
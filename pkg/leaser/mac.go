@@ -0,0 +1,158 @@
+package leaser
+
+import (
+	"strings"
+	"time"
+)
+
+// now - current time, can be replaced in tests
+var now = time.Now
+
+// Binding - MAC address to IP binding, container with same MAC gets same IP
+type Binding struct {
+	IP       string `json:"ip"`
+	Released int64  `json:"released,omitempty"` // unix time when IP was returned, 0 while IP is allocated
+}
+
+// expired - true if binding is released longer than retention period
+func (b *Binding) expired(retention time.Duration) bool {
+	return b.Released != 0 && now().Sub(time.Unix(b.Released, 0)) >= retention
+}
+
+// bind - remember MAC to IP binding, other bindings of this IP are removed even if MAC is empty
+func (sn *Subnet) bind(mac, ip string) {
+	mac = strings.ToLower(mac)
+	off, _, err := sn.offset(ip)
+	if err != nil {
+		return
+	}
+
+	macs := sn.owners()
+	if m, ok := macs[off]; ok && m != mac {
+		sn.unbind(m)
+	}
+
+	if mac == "" {
+		return
+	}
+
+	// MAC is bound to one IP only
+	if b, ok := sn.Bindings[mac]; ok {
+		if old, _, err := sn.offset(b.IP); err == nil {
+			delete(macs, old)
+		}
+	}
+
+	if sn.Bindings == nil {
+		sn.Bindings = map[string]*Binding{}
+	}
+
+	sn.Bindings[mac] = &Binding{IP: ip}
+	macs[off] = mac
+}
+
+// release - mark binding of IP as released at unix time at, retention period starts then
+func (sn *Subnet) release(ip string, at int64) {
+	off, _, err := sn.offset(ip)
+	if err != nil {
+		return
+	}
+
+	if b := sn.binding(off); b != nil {
+		b.Released = at
+	}
+}
+
+// bound - IP bound to MAC and still retained, expired binding is removed
+func (sn *Subnet) bound(mac string, retention time.Duration) (string, bool) {
+	mac = strings.ToLower(mac)
+	b, ok := sn.Bindings[mac]
+	if !ok {
+		return "", false
+	}
+
+	if b.expired(retention) {
+		sn.unbind(mac)
+		return "", false
+	}
+
+	return b.IP, true
+}
+
+// retained - true if released offset is kept for its MAC, expired binding is removed
+func (sn *Subnet) retained(off uint64, retention time.Duration) bool {
+	b := sn.binding(off)
+	if b == nil || b.Released == 0 {
+		return false
+	}
+
+	if b.expired(retention) {
+		sn.unbind(sn.owners()[off])
+		return false
+	}
+
+	return true
+}
+
+// oldestRetained - offset of the earliest released binding which can be given in bounds, its binding is removed,
+// so address retained for MAC which never comes back (random MAC of container) is given when block is full
+func (sn *Subnet) oldestRetained(first, last uint64, skip func(uint64) bool) (uint64, bool) {
+	var off uint64
+	var mac string
+	var at int64
+	for o, m := range sn.owners() {
+		b := sn.Bindings[m]
+		if b == nil || b.Released == 0 || o < first || o > last || sn.Leases.Contains(o) || skip(o) {
+			continue
+		}
+
+		if mac == "" || b.Released < at || b.Released == at && o < off {
+			off, mac, at = o, m, b.Released
+		}
+	}
+
+	if mac == "" {
+		return 0, false
+	}
+
+	sn.unbind(mac)
+	return off, true
+}
+
+// binding - binding of offset, nil if offset isn't bound to MAC
+func (sn *Subnet) binding(off uint64) *Binding {
+	m, ok := sn.owners()[off]
+	if !ok {
+		return nil
+	}
+
+	return sn.Bindings[m]
+}
+
+// unbind - remove binding of MAC
+func (sn *Subnet) unbind(mac string) {
+	if b, ok := sn.Bindings[mac]; ok {
+		if off, _, err := sn.offset(b.IP); err == nil {
+			delete(sn.owners(), off)
+		}
+	}
+
+	delete(sn.Bindings, mac)
+}
+
+// owners - MAC bound to offset, index of bindings is built once and kept by bind and unbind.
+// Caller must hold write lock.
+func (sn *Subnet) owners() map[uint64]string {
+	if sn.macs != nil {
+		return sn.macs
+	}
+
+	sn.macs = map[uint64]string{}
+	for m, b := range sn.Bindings {
+		if off, _, err := sn.offset(b.IP); err == nil {
+			sn.macs[off] = m
+		}
+	}
+
+	return sn.macs
+}
@@ -0,0 +1,473 @@
+package leaser
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+
+	iplib "github.com/dspinhirne/netaddr-go"
+)
+
+// MainPool - main address pool which blocks are cut from. Pools of IP version are used in order,
+// next pool is used when blocks can't be cut from previous ones. Draining pool gives no new blocks,
+// its allocated blocks keep working and pool is retired when its last block is returned.
+type MainPool struct {
+	Pool          string `json:"pool"`
+	AllocateBlock uint   `json:"ab"`
+	Drain         bool   `json:"drain,omitempty"`
+
+	net  iplib.IPNet
+	tree *Buddy
+}
+
+// PoolChange - change of main pools of IP version, Error is set if change is unsafe for allocated blocks
+type PoolChange struct {
+	V     uint8  `json:"v"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Error string `json:"error,omitempty"`
+}
+
+// String - change for log and reload result
+func (pc *PoolChange) String() string {
+	s := "IPv" + strconv.Itoa(int(pc.V)) + " pool " + pc.From + " -> " + pc.To
+	if pc.Error != "" {
+		s += ": " + pc.Error
+	}
+
+	return s
+}
+
+// PlanPools - change of main pools of IP version to ordered pools, nil if nothing is changed.
+// Safe changes are new pools, pools which contain all allocated blocks (wider pools), block len of pool without allocated blocks and drain.
+// Empty list removes main pools if they have no allocated blocks. Draining pools without allocated blocks are retired.
+func (lsr *Leaser) PlanPools(v uint8, pools []MainPool) *PoolChange {
+	lsr.RLock()
+	defer lsr.RUnlock()
+
+	return lsr.planPools(v, pools)
+}
+
+// MainPools - ordered main pools of IP version, they can be given back to SetPools
+func (lsr *Leaser) MainPools(v uint8) []MainPool {
+	lsr.RLock()
+	defer lsr.RUnlock()
+
+	return lsr.specs(v)
+}
+
+// SetPools - apply change of main pools of IP version, unsafe change is error. Change is written to journal.
+func (lsr *Leaser) SetPools(v uint8, pools []MainPool) error {
+	lsr.Lock()
+	defer lsr.Unlock()
+
+	pc := lsr.planPools(v, pools)
+	if pc == nil {
+		return nil
+	}
+
+	if pc.Error != "" {
+		return errors.New(pc.String())
+	}
+
+	return lsr.changePools(v, lsr.retire(v, canonicalPools(pools)))
+}
+
+// ForcePools - set main pools of IP version even if allocated blocks don't fit them: blocks out of new pools are released,
+// blocks inside of them are kept with their len. Released blocks are returned. Every change is written to journal.
+func (lsr *Leaser) ForcePools(v uint8, pools []MainPool) ([]string, error) {
+	lsr.Lock()
+	defer lsr.Unlock()
+
+	pools = lsr.retire(v, canonicalPools(pools))
+	if err := lsr.validPools(v, pools); err != nil {
+		return nil, err
+	}
+
+	var released []string
+	for _, b := range lsr.outOf(v, pools) {
+		if err := lsr.record(&JournalEntry{Op: OpReturnBlock, ID: b.ID}); err != nil {
+			return released, err
+		}
+
+		k, _ := lsr.find(b.ID)
+		lsr.dropBlock(k, 0)
+		released = append(released, b.Pool+" ("+b.ID+")")
+	}
+
+	if pools = lsr.retire(v, pools); lsr.planPools(v, pools) == nil {
+		return released, nil
+	}
+
+	return released, lsr.changePools(v, pools)
+}
+
+// changePools - set checked main pools and write them to journal, pools are restored if journal can't be written
+func (lsr *Leaser) changePools(v uint8, pools []MainPool) error {
+	prev := lsr.specs(v)
+	lsr.setPools(v, pools)
+	if err := lsr.record(&JournalEntry{Op: OpPool, V: v, Pools: pools}); err != nil {
+		lsr.setPools(v, prev)
+		return err
+	}
+
+	return nil
+}
+
+func (lsr *Leaser) planPools(v uint8, pools []MainPool) *PoolChange {
+	pools = lsr.retire(v, canonicalPools(pools))
+	cur := lsr.specs(v)
+	if equalPools(cur, pools) {
+		return nil
+	}
+
+	pc := &PoolChange{V: v, From: describePools(cur), To: describePools(pools)}
+	if err := lsr.checkPools(v, pools); err != nil {
+		pc.Error = err.Error()
+	}
+
+	return pc
+}
+
+// checkPools - error if allocated blocks of IP version don't fit new main pools or block len of their pool is changed
+func (lsr *Leaser) checkPools(v uint8, pools []MainPool) error {
+	if err := lsr.fitPools(v, pools); err != nil {
+		return err
+	}
+
+	changed := map[string]int{}
+	for _, b := range lsr.Allocated {
+		if b.V != v {
+			continue
+		}
+
+		cur, next := lsr.parent(b.Pool), findPool(pools, b.Pool)
+		if cur != nil && next != nil && cur.AllocateBlock != next.AllocateBlock {
+			changed[next.Pool]++
+		}
+	}
+
+	for _, p := range pools {
+		if n := changed[p.Pool]; n != 0 {
+			return errors.New("allocate block len of pool " + p.Pool + " can't be changed, " + strconv.Itoa(n) + " blocks are allocated")
+		}
+	}
+
+	return nil
+}
+
+// fitPools - error if pools are wrong or allocated blocks of IP version are out of them, journal entry of pools is checked by it
+func (lsr *Leaser) fitPools(v uint8, pools []MainPool) error {
+	if err := lsr.validPools(v, pools); err != nil {
+		return err
+	}
+
+	out := lsr.outOf(v, pools)
+	switch {
+	case len(out) == 0:
+		return nil
+
+	case len(pools) == 0:
+		return errors.New("pool can't be removed, " + strconv.Itoa(len(out)) + " blocks are allocated from it")
+	}
+
+	var list []string
+	for _, b := range out {
+		list = append(list, b.Pool+" ("+b.ID+")")
+	}
+
+	if len(list) > 5 {
+		list = append(list[:5], "and "+strconv.Itoa(len(list)-5)+" more")
+	}
+
+	return errors.New("allocated blocks are out of new pool: " + strings.Join(list, ", "))
+}
+
+// validPools - error if pool isn't network of IP version, allocate block len doesn't fit it or pools overlap.
+// Empty list is valid if main pool of other IP version is set.
+func (lsr *Leaser) validPools(v uint8, pools []MainPool) error {
+	if len(pools) == 0 {
+		other := uint8(6)
+		if v == 6 {
+			other = 4
+		}
+
+		if len(lsr.pools(other)) == 0 {
+			return errors.New("IPv4 and IPv6 pools can't be both empty")
+		}
+
+		return nil
+	}
+
+	bits := uint(32)
+	if v == 6 {
+		bits = 128
+	}
+
+	for k, p := range pools {
+		pn, err := iplib.ParseIPNet(p.Pool)
+		if err != nil || uint8(pn.Version()) != v {
+			return errors.New("wrong IPv" + strconv.Itoa(int(v)) + " pool " + p.Pool)
+		}
+
+		if p.AllocateBlock >= bits || p.AllocateBlock < prefixLen(pn) {
+			return errors.New("wrong allocate block /" + strconv.Itoa(int(p.AllocateBlock)) + " of pool " + pn.String())
+		}
+
+		if v == 6 && p.AllocateBlock < maxV6Block {
+			return errors.New("allocate block /" + strconv.Itoa(int(p.AllocateBlock)) + " of pool " + pn.String() + " is bigger than /" + strconv.Itoa(maxV6Block) + ", addresses aren't given from it")
+		}
+
+		for _, prev := range pools[:k] {
+			if isOverlap(prev.Pool, p.Pool) {
+				return errors.New("pool " + p.Pool + " overlaps with pool " + prev.Pool)
+			}
+		}
+	}
+
+	return nil
+}
+
+// retire - pools without draining pools which have no allocated blocks, so retired pool is never added again.
+// Draining pools are kept if IP versions would be left without main pools.
+func (lsr *Leaser) retire(v uint8, pools []MainPool) []MainPool {
+	var r []MainPool
+	for _, p := range pools {
+		if !p.Drain || lsr.hasBlocks(v, p.Pool) {
+			r = append(r, p)
+		}
+	}
+
+	if len(r) == 0 && lsr.validPools(v, nil) != nil {
+		return pools
+	}
+
+	return r
+}
+
+// retirePool - remove draining pool of IP version when its last block is returned, it isn't written to journal,
+// because replay of returned block retires it again
+func (lsr *Leaser) retirePool(v uint8) {
+	cur := lsr.specs(v)
+	pools := lsr.retire(v, cur)
+	if equalPools(cur, pools) {
+		return
+	}
+
+	for _, p := range cur {
+		if findPool(pools, p.Pool) == nil {
+			log.Println("Draining main pool", p.Pool, "has no allocated blocks, it is retired")
+		}
+	}
+
+	lsr.setPools(v, pools)
+}
+
+// hasBlocks - true if some block of IP version is allocated from pool
+func (lsr *Leaser) hasBlocks(v uint8, pool string) bool {
+	pn, err := iplib.ParseIPNet(pool)
+	if err != nil {
+		return false
+	}
+
+	for _, b := range lsr.Allocated {
+		if b.V == v && contains(pn, b.Pool) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// outOf - allocated blocks of IP version which are out of all pools
+func (lsr *Leaser) outOf(v uint8, pools []MainPool) []*Subnet {
+	var out []*Subnet
+	for _, b := range lsr.Allocated {
+		if b.V == v && findPool(pools, b.Pool) == nil {
+			out = append(out, b)
+		}
+	}
+
+	return out
+}
+
+// pools - main pools of IP version in order, the first is V6Pool or V4Pool
+func (lsr *Leaser) pools(v uint8) []*MainPool {
+	var r []*MainPool
+	switch {
+	case v == 6 && lsr.V6Pool != nil:
+		r = append(r, &MainPool{Pool: lsr.V6Pool.String(), AllocateBlock: lsr.V6AllocateBlock, Drain: lsr.V6Drain, net: lsr.V6Pool, tree: lsr.V6Tree})
+		r = append(r, lsr.V6Fallback...)
+
+	case v == 4 && lsr.V4Pool != nil:
+		r = append(r, &MainPool{Pool: lsr.V4Pool.String(), AllocateBlock: lsr.V4AllocateBlock, Drain: lsr.V4Drain, net: lsr.V4Pool, tree: lsr.V4Tree})
+		r = append(r, lsr.V4Fallback...)
+	}
+
+	return r
+}
+
+// parent - main pool which contains block, nil if block is out of main pools
+func (lsr *Leaser) parent(block string) *MainPool {
+	bn, err := iplib.ParseIPNet(block)
+	if err != nil {
+		return nil
+	}
+
+	for _, p := range lsr.pools(uint8(bn.Version())) {
+		if contains(p.net, block) {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// specs - main pools of IP version without allocators
+func (lsr *Leaser) specs(v uint8) []MainPool {
+	var r []MainPool
+	for _, p := range lsr.pools(v) {
+		r = append(r, MainPool{Pool: p.Pool, AllocateBlock: p.AllocateBlock, Drain: p.Drain})
+	}
+
+	return r
+}
+
+// setPools - set checked main pools of IP version, allocators are rebuilt from allocated blocks
+func (lsr *Leaser) setPools(v uint8, pools []MainPool) {
+	if len(pools) == 0 {
+		if v == 6 {
+			lsr.V6Pool, lsr.V6Tree, lsr.V6Fallback, lsr.V6Drain = nil, nil, nil, false
+		} else {
+			lsr.V4Pool, lsr.V4Tree, lsr.V4Fallback, lsr.V4Drain = nil, nil, nil, false
+		}
+
+		return
+	}
+
+	var fallback []*MainPool
+	for _, p := range pools[1:] {
+		f := lsr.newPool(p.Pool, p.AllocateBlock)
+		f.Drain = p.Drain
+		fallback = append(fallback, f)
+	}
+
+	if v == 6 {
+		lsr.setV6(pools[0].Pool, pools[0].AllocateBlock)
+		lsr.V6Fallback, lsr.V6Drain = fallback, pools[0].Drain
+	} else {
+		lsr.setV4(pools[0].Pool, pools[0].AllocateBlock)
+		lsr.V4Fallback, lsr.V4Drain = fallback, pools[0].Drain
+	}
+}
+
+// newPool - main pool with allocator where allocated blocks inside of it are reserved
+func (lsr *Leaser) newPool(pool string, ab uint) *MainPool {
+	pn, _ := iplib.ParseIPNet(pool)
+	return &MainPool{Pool: pn.String(), AllocateBlock: ab, net: pn, tree: lsr.buildTree(pn.String(), uint8(pn.Version()))}
+}
+
+// findPool - pool which contains block, nil if not found
+func findPool(pools []MainPool, block string) *MainPool {
+	for k := range pools {
+		if pn, err := iplib.ParseIPNet(pools[k].Pool); err == nil && contains(pn, block) {
+			return &pools[k]
+		}
+	}
+
+	return nil
+}
+
+// canonicalPools - pools in the same form as they are stored
+func canonicalPools(pools []MainPool) []MainPool {
+	r := make([]MainPool, 0, len(pools))
+	for _, p := range pools {
+		if pn, err := iplib.ParseIPNet(p.Pool); err == nil {
+			p.Pool = pn.String()
+		}
+
+		r = append(r, MainPool{Pool: p.Pool, AllocateBlock: p.AllocateBlock, Drain: p.Drain})
+	}
+
+	return r
+}
+
+func equalPools(a, b []MainPool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k := range a {
+		if a[k].Pool != b[k].Pool || a[k].AllocateBlock != b[k].AllocateBlock || a[k].Drain != b[k].Drain {
+			return false
+		}
+	}
+
+	return true
+}
+
+// contains - true if block is inside of pool
+func contains(pool iplib.IPNet, block string) bool {
+	bn, err := iplib.ParseIPNet(block)
+	if err != nil {
+		return false
+	}
+
+	switch pool := pool.(type) {
+	case *iplib.IPv6Net:
+		if bn, ok := bn.(*iplib.IPv6Net); ok {
+			ok, rel := pool.Rel(bn)
+			return ok && rel >= 0
+		}
+
+	case *iplib.IPv4Net:
+		if bn, ok := bn.(*iplib.IPv4Net); ok {
+			ok, rel := pool.Rel(bn)
+			return ok && rel >= 0
+		}
+	}
+
+	return false
+}
+
+// prefixLen - prefix len of network
+func prefixLen(pn iplib.IPNet) uint {
+	switch pn := pn.(type) {
+	case *iplib.IPv6Net:
+		return uint(pn.Netmask().PrefixLen())
+
+	case *iplib.IPv4Net:
+		return uint(pn.Netmask().PrefixLen())
+	}
+
+	return 0
+}
+
+// poolNames - pools separated by comma
+func poolNames(pools []*MainPool) string {
+	var r []string
+	for _, p := range pools {
+		r = append(r, p.Pool)
+	}
+
+	return strings.Join(r, ", ")
+}
+
+func describePools(pools []MainPool) string {
+	if len(pools) == 0 {
+		return "none"
+	}
+
+	var r []string
+	for _, p := range pools {
+		d := p.Pool + " block /" + strconv.Itoa(int(p.AllocateBlock))
+		if p.Drain {
+			d += " drain"
+		}
+
+		r = append(r, d)
+	}
+
+	return strings.Join(r, ", ")
+}
@@ -0,0 +1,255 @@
+package leaser
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetPools(t *testing.T) {
+	lsr, err := New("fe80::/48", "192.168.0.0/24", 64, 26)
+	require.NoError(t, err)
+
+	// same pool in other form is not a change
+	require.Nil(t, lsr.PlanPools(6, []MainPool{{Pool: "fe80:0::/48", AllocateBlock: 64}}))
+
+	// block len can be changed while no blocks are allocated
+	require.NoError(t, lsr.SetPools(4, []MainPool{{Pool: "192.168.0.0/24", AllocateBlock: 27}}))
+	require.Equal(t, uint(27), lsr.V4AllocateBlock)
+
+	_, pool, err := lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.0/27", pool)
+
+	// wider pool keeps allocated block, new blocks are given from it
+	pc := lsr.PlanPools(4, []MainPool{{Pool: "192.168.0.0/23", AllocateBlock: 27}})
+	require.NotNil(t, pc)
+	require.Empty(t, pc.Error)
+	require.Equal(t, "IPv4 pool 192.168.0.0/24 block /27 -> 192.168.0.0/23 block /27", pc.String())
+	require.NoError(t, lsr.SetPools(4, []MainPool{{Pool: "192.168.0.0/23", AllocateBlock: 27}}))
+
+	for i := 0; i < 15; i++ {
+		_, pool, err = lsr.GetBlock(4, 0)
+		require.NoError(t, err)
+		require.NotEqual(t, "192.168.0.0/27", pool)
+	}
+
+	// unsafe changes are rejected and nothing is changed
+	pc = lsr.PlanPools(4, []MainPool{{Pool: "192.168.1.0/24", AllocateBlock: 27}})
+	require.NotNil(t, pc)
+	require.Contains(t, pc.Error, "allocated blocks are out of new pool: 192.168.0.0/27")
+	require.Contains(t, pc.Error, "and 3 more")
+	require.Error(t, lsr.SetPools(4, []MainPool{{Pool: "192.168.1.0/24", AllocateBlock: 27}}))
+
+	pc = lsr.PlanPools(4, []MainPool{{Pool: "192.168.0.0/23", AllocateBlock: 28}})
+	require.Contains(t, pc.Error, "allocate block len of pool 192.168.0.0/23 can't be changed, 16 blocks are allocated")
+
+	pc = lsr.PlanPools(4, nil)
+	require.Contains(t, pc.Error, "pool can't be removed")
+
+	pc = lsr.PlanPools(4, []MainPool{{Pool: "fe80::/48", AllocateBlock: 64}})
+	require.Contains(t, pc.Error, "wrong IPv4 pool")
+
+	pc = lsr.PlanPools(6, []MainPool{{Pool: "fe80::/48", AllocateBlock: 56}})
+	require.Contains(t, pc.Error, "allocate block /56 of pool fe80::/48 is bigger than /64, addresses aren't given from it")
+	require.Equal(t, "192.168.0.0/23", lsr.V4Pool.String())
+
+	// pool without blocks can be removed, but not both pools
+	require.NoError(t, lsr.SetPools(6, nil))
+	require.Nil(t, lsr.V6Pool)
+	_, _, err = lsr.GetBlock(6, 0)
+	require.Error(t, err)
+
+	require.NoError(t, lsr.SetPools(6, []MainPool{{Pool: "fe80::/56", AllocateBlock: 64}}))
+	require.Equal(t, "fe80::/56", lsr.V6Pool.String())
+}
+
+func TestReplayPools(t *testing.T) {
+	lsr, err := New("fe80::/48", "192.168.0.0/24", 64, 26)
+	require.NoError(t, err)
+
+	require.NoError(t, lsr.Replay([]*JournalEntry{
+		{Seq: 1, Op: OpPool, V: 4, Pools: []MainPool{{Pool: "192.168.0.0/22", AllocateBlock: 26}, {Pool: "10.0.0.0/24", AllocateBlock: 26}}},
+		{Seq: 2, Op: OpPool, V: 6, Pools: []MainPool{{Pool: "fe80::/56", AllocateBlock: 64}}},
+	}))
+
+	require.Equal(t, "192.168.0.0/22", lsr.V4Pool.String())
+	require.Len(t, lsr.V4Fallback, 1)
+	require.Equal(t, "fe80::/56", lsr.V6Pool.String())
+	require.Equal(t, uint64(2), lsr.Seq)
+}
+
+func TestForcePools(t *testing.T) {
+	lsr, err := New("fe80::/48", "192.168.0.0/23", 64, 24)
+	require.NoError(t, err)
+
+	id1, _, err := lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+	id2, _, err := lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+
+	_, err = lsr.ForcePools(4, []MainPool{{Pool: "10.0.0.0/33", AllocateBlock: 24}})
+	require.Error(t, err)
+	require.Len(t, lsr.Allocated, 2)
+
+	// block out of new pool is released, block inside of it is kept with its len
+	released, err := lsr.ForcePools(4, []MainPool{{Pool: "192.168.1.0/24", AllocateBlock: 26}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"192.168.0.0/24 (" + id1 + ")"}, released)
+	require.Len(t, lsr.Allocated, 1)
+	require.Equal(t, id2, lsr.Allocated[0].ID)
+	require.Equal(t, "192.168.1.0/24", lsr.V4Pool.String())
+	require.Equal(t, uint(26), lsr.V4AllocateBlock)
+}
+
+func TestRestoreWrongPool(t *testing.T) {
+	lsr, err := New("fe80::/48", "192.168.0.0/16", 64, 24)
+	require.NoError(t, err)
+
+	_, _, err = lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+
+	data, err := lsr.MarshalJSON()
+	require.NoError(t, err)
+
+	// allocated blocks are never dropped because stored pool is wrong
+	var restored Leaser
+	err = restored.UnmarshalJSON([]byte(strings.Replace(string(data), `"v4ab": 24`, `"v4ab": 40`, 1)))
+	require.EqualError(t, err, "Can't restore Leaser, 1 IPv4 blocks are allocated, but main pool '192.168.0.0/16' /40 is wrong: Len of allocate block can't be less than 2")
+
+	// pool without blocks is skipped
+	restored = Leaser{}
+	err = restored.UnmarshalJSON([]byte(strings.Replace(string(data), `"v6ab": 64`, `"v6ab": 130`, 1)))
+	require.NoError(t, err)
+	require.Nil(t, restored.V6Pool)
+	require.Len(t, restored.Allocated, 1)
+
+	// wrong IPv4 pool without blocks isn't skipped
+	restored = Leaser{}
+	empty := strings.Replace(strings.Replace(string(data), `"v4ab": 24`, `"v4ab": 40`, 1), `"allocated"`, `"skipped"`, 1)
+	require.EqualError(t, restored.UnmarshalJSON([]byte(empty)), "Len of allocate block can't be less than 2")
+}
+
+func TestFallbackPools(t *testing.T) {
+	lsr, err := New("", "192.168.0.0/25", 0, 26)
+	require.NoError(t, err)
+
+	require.NoError(t, lsr.SetPools(4, []MainPool{{Pool: "192.168.0.0/25", AllocateBlock: 26}, {Pool: "10.0.0.0/24", AllocateBlock: 25}}))
+	require.Error(t, lsr.SetPools(4, []MainPool{{Pool: "192.168.0.0/25", AllocateBlock: 26}, {Pool: "192.168.0.0/24", AllocateBlock: 25}}))
+
+	// next pool is used when previous one is exhausted, every pool uses its block len
+	var pools []string
+	for i := 0; i < 4; i++ {
+		_, pool, err := lsr.GetBlock(4, 0)
+		require.NoError(t, err)
+		pools = append(pools, pool)
+	}
+
+	require.Equal(t, []string{"192.168.0.0/26", "192.168.0.64/26", "10.0.0.0/25", "10.0.0.128/25"}, pools)
+	_, _, err = lsr.GetBlock(4, 0)
+	require.EqualError(t, err, "No free /25 block in main pool 10.0.0.0/24")
+
+	// returned block of first pool is used again
+	id := lsr.Allocated[0].ID
+	require.Equal(t, "192.168.0.0/25", lsr.Allocated[0].Parent)
+	require.NoError(t, lsr.ReturnBlock(id))
+
+	_, pool, err := lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.0/26", pool)
+
+	// block can be reserved in every pool, requested len must fit one of them
+	for _, b := range lsr.Blocks() {
+		if b.Pool == "10.0.0.128/25" {
+			require.NoError(t, lsr.ReturnBlock(b.ID))
+		}
+	}
+
+	_, pool, err = lsr.ReserveBlock("10.0.0.128/26", "")
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.128/26", pool)
+
+	_, _, err = lsr.GetBlock(4, 23)
+	require.EqualError(t, err, "Requested IPv4 block /23 is bigger than main pool 192.168.0.0/25, 10.0.0.0/24")
+
+	// capacity is reported per pool
+	info := lsr.Pools()
+	require.Len(t, info, 2)
+	require.Equal(t, "192.168.0.0/25", info[0].Pool)
+	require.Equal(t, 2, info[0].Blocks)
+	require.Equal(t, float64(2), info[0].Capacity)
+	require.Equal(t, "10.0.0.0/24", info[1].Pool)
+	require.Equal(t, 2, info[1].Blocks)
+	require.Equal(t, float64(2), info[1].Capacity)
+	require.Equal(t, float64(0), info[1].Available)
+
+	// fallback pools and parents of blocks are restored
+	data, err := lsr.MarshalJSON()
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"v4fallback"`)
+
+	var restored Leaser
+	require.NoError(t, restored.UnmarshalJSON(data))
+	require.Equal(t, lsr.specs(4), restored.specs(4))
+	require.Equal(t, lsr.Pools(), restored.Pools())
+	for _, b := range restored.Allocated {
+		require.NotEmpty(t, b.Parent)
+	}
+}
+
+func TestDrainPool(t *testing.T) {
+	lsr, err := New("fe80::/48", "192.168.0.0/25", 64, 26)
+	require.NoError(t, err)
+
+	require.NoError(t, lsr.SetPools(4, []MainPool{{Pool: "192.168.0.0/25", AllocateBlock: 26}, {Pool: "10.0.0.0/24", AllocateBlock: 26}}))
+	id1, _, err := lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+	id2, _, err := lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+
+	// drain is safe change, draining pool gives no new blocks even after block is returned
+	pools := []MainPool{{Pool: "192.168.0.0/25", AllocateBlock: 26, Drain: true}, {Pool: "10.0.0.0/24", AllocateBlock: 26}}
+	pc := lsr.PlanPools(4, pools)
+	require.NotNil(t, pc)
+	require.Empty(t, pc.Error)
+	require.Equal(t, "IPv4 pool 192.168.0.0/25 block /26, 10.0.0.0/24 block /26 -> 192.168.0.0/25 block /26 drain, 10.0.0.0/24 block /26", pc.String())
+	require.NoError(t, lsr.SetPools(4, pools))
+
+	require.NoError(t, lsr.ReturnBlock(id1))
+	_, pool, err := lsr.GetBlock(4, 0)
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.0/26", pool)
+
+	// allocated block of draining pool keeps working, status shows blocks which keep pool
+	_, err = lsr.GetAddress(id2, "")
+	require.NoError(t, err)
+
+	info := lsr.Pools()
+	require.True(t, info[1].Drain)
+	require.Equal(t, 1, info[1].Blocks)
+	require.Equal(t, float64(0), info[1].Available)
+
+	// draining pool and its state are restored
+	data, err := lsr.MarshalJSON()
+	require.NoError(t, err)
+
+	var restored Leaser
+	require.NoError(t, restored.UnmarshalJSON(data))
+	require.Equal(t, lsr.specs(4), restored.specs(4))
+
+	// pool is retired with its last block and isn't added again by config
+	require.NoError(t, lsr.ReturnBlock(id2))
+	require.Equal(t, []MainPool{{Pool: "10.0.0.0/24", AllocateBlock: 26}}, lsr.specs(4))
+	require.Nil(t, lsr.PlanPools(4, pools))
+
+	// draining pool without blocks is retired at once, the last pools of leaser are kept
+	require.NoError(t, lsr.SetPools(6, []MainPool{{Pool: "fe80::/48", AllocateBlock: 64, Drain: true}}))
+	require.Nil(t, lsr.V6Pool)
+
+	require.NoError(t, lsr.ReturnBlock(lsr.Allocated[0].ID))
+	require.NoError(t, lsr.SetPools(4, []MainPool{{Pool: "10.0.0.0/24", AllocateBlock: 26, Drain: true}}))
+	require.True(t, lsr.V4Drain)
+	_, _, err = lsr.GetBlock(4, 0)
+	require.EqualError(t, err, "Main pool 10.0.0.0/24 is draining, it gives no new blocks")
+}
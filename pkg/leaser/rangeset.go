@@ -0,0 +1,194 @@
+package leaser
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+// RangeSet - set of address offsets from block base, it is stored as sorted not overlapped and not adjacent ranges.
+// Allocate, release and membership checks are O(log n) from count of ranges.
+type RangeSet struct {
+	ranges []span
+}
+
+// span - range of offsets, last is included
+type span struct {
+	first, last uint64
+}
+
+// Contains - true if offset is in set
+func (rs *RangeSet) Contains(off uint64) bool {
+	i := rs.search(off)
+	return i < len(rs.ranges) && rs.ranges[i].first <= off
+}
+
+// Add - add offset to set, false if it is already in set
+func (rs *RangeSet) Add(off uint64) bool {
+	i := rs.search(off)
+	if i < len(rs.ranges) && rs.ranges[i].first <= off {
+		return false
+	}
+
+	joinPrev := i > 0 && rs.ranges[i-1].last+1 == off
+	joinNext := i < len(rs.ranges) && off+1 == rs.ranges[i].first
+
+	switch {
+	case joinPrev && joinNext:
+		rs.ranges[i-1].last = rs.ranges[i].last
+		rs.ranges = append(rs.ranges[:i], rs.ranges[i+1:]...)
+
+	case joinPrev:
+		rs.ranges[i-1].last = off
+
+	case joinNext:
+		rs.ranges[i].first = off
+
+	default:
+		rs.ranges = append(rs.ranges, span{})
+		copy(rs.ranges[i+1:], rs.ranges[i:])
+		rs.ranges[i] = span{off, off}
+	}
+
+	return true
+}
+
+// AddRange - add all offsets from first to last, ranges which overlap or adjoin it are joined
+func (rs *RangeSet) AddRange(first, last uint64) {
+	if first > last {
+		return
+	}
+
+	n := len(rs.ranges)
+	i := sort.Search(n, func(i int) bool { return first == 0 || rs.ranges[i].last >= first-1 })
+	j := sort.Search(n, func(j int) bool { return last != ^uint64(0) && rs.ranges[j].first > last+1 })
+
+	if i < j {
+		if rs.ranges[i].first < first {
+			first = rs.ranges[i].first
+		}
+
+		if rs.ranges[j-1].last > last {
+			last = rs.ranges[j-1].last
+		}
+	}
+
+	rs.ranges = append(rs.ranges[:i], append([]span{{first, last}}, rs.ranges[j:]...)...)
+}
+
+// Remove - remove offset from set, false if it is not in set
+func (rs *RangeSet) Remove(off uint64) bool {
+	i := rs.search(off)
+	if i == len(rs.ranges) || rs.ranges[i].first > off {
+		return false
+	}
+
+	r := rs.ranges[i]
+	switch {
+	case r.first == off && r.last == off:
+		rs.ranges = append(rs.ranges[:i], rs.ranges[i+1:]...)
+
+	case r.first == off:
+		rs.ranges[i].first++
+
+	case r.last == off:
+		rs.ranges[i].last--
+
+	default:
+		rs.ranges = append(rs.ranges, span{})
+		copy(rs.ranges[i+1:], rs.ranges[i:])
+		rs.ranges[i] = span{r.first, off - 1}
+		rs.ranges[i+1] = span{off + 1, r.last}
+	}
+
+	return true
+}
+
+// NextFree - lowest offset which is not in set and not less than off, false if there is no such offset
+func (rs *RangeSet) NextFree(off uint64) (uint64, bool) {
+	i := rs.search(off)
+	if i == len(rs.ranges) || rs.ranges[i].first > off {
+		return off, true
+	}
+
+	// ranges are not adjacent, so next offset after range is free
+	if rs.ranges[i].last == ^uint64(0) {
+		return 0, false
+	}
+
+	return rs.ranges[i].last + 1, true
+}
+
+// Len - count of offsets in set
+func (rs *RangeSet) Len() uint64 {
+	var n uint64
+	for _, r := range rs.ranges {
+		n += r.last - r.first + 1
+	}
+
+	return n
+}
+
+// Each - call f for every offset in set while it returns true
+func (rs *RangeSet) Each(f func(off uint64) bool) {
+	for _, r := range rs.ranges {
+		for off := r.first; ; off++ {
+			if !f(off) {
+				return
+			}
+
+			if off == r.last {
+				break
+			}
+		}
+	}
+}
+
+// EachRange - call f for every range of set while it returns true
+func (rs *RangeSet) EachRange(f func(first, last uint64) bool) {
+	for _, r := range rs.ranges {
+		if !f(r.first, r.last) {
+			return
+		}
+	}
+}
+
+// Clear - remove all offsets
+func (rs *RangeSet) Clear() {
+	rs.ranges = nil
+}
+
+// MarshalJSON implements JSON marshaler, set is list of [first, last] ranges
+func (rs RangeSet) MarshalJSON() ([]byte, error) {
+	c := make([][2]uint64, 0, len(rs.ranges))
+	for _, r := range rs.ranges {
+		c = append(c, [2]uint64{r.first, r.last})
+	}
+
+	return json.Marshal(c)
+}
+
+// UnmarshalJSON implements JSON unmarshaler
+func (rs *RangeSet) UnmarshalJSON(data []byte) error {
+	var c [][2]uint64
+	err := json.Unmarshal(data, &c)
+	if err != nil {
+		return err
+	}
+
+	rs.ranges = make([]span, 0, len(c))
+	for _, r := range c {
+		if r[0] > r[1] || len(rs.ranges) > 0 && rs.ranges[len(rs.ranges)-1].last+1 >= r[0] {
+			return errors.New("Wrong address ranges, they must be sorted and not overlapped")
+		}
+
+		rs.ranges = append(rs.ranges, span{r[0], r[1]})
+	}
+
+	return nil
+}
+
+// search - index of first range which last offset is not less than off
+func (rs *RangeSet) search(off uint64) int {
+	return sort.Search(len(rs.ranges), func(i int) bool { return rs.ranges[i].last >= off })
+}
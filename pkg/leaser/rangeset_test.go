@@ -0,0 +1,117 @@
+package leaser
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	iplib "github.com/dspinhirne/netaddr-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRangeSet(t *testing.T) {
+	var rs RangeSet
+
+	require.True(t, rs.Add(1))
+	require.True(t, rs.Add(3))
+	require.False(t, rs.Add(3))
+	require.Equal(t, []span{{1, 1}, {3, 3}}, rs.ranges)
+
+	// adjacent offsets are joined
+	require.True(t, rs.Add(2))
+	require.Equal(t, []span{{1, 3}}, rs.ranges)
+	require.True(t, rs.Contains(2))
+	require.False(t, rs.Contains(4))
+
+	off, ok := rs.NextFree(1)
+	require.True(t, ok)
+	require.Equal(t, uint64(4), off)
+
+	// removed offset splits range
+	require.True(t, rs.Remove(2))
+	require.False(t, rs.Remove(2))
+	require.Equal(t, []span{{1, 1}, {3, 3}}, rs.ranges)
+	require.Equal(t, uint64(2), rs.Len())
+
+	off, _ = rs.NextFree(1)
+	require.Equal(t, uint64(2), off)
+
+	require.True(t, rs.Add(^uint64(0)))
+	_, ok = rs.NextFree(^uint64(0))
+	require.False(t, ok)
+}
+
+func TestRangeSetAddRange(t *testing.T) {
+	var rs RangeSet
+	rs.Add(1)
+	rs.Add(10)
+	rs.Add(20)
+
+	rs.AddRange(5, 7)
+	require.Equal(t, []span{{1, 1}, {5, 7}, {10, 10}, {20, 20}}, rs.ranges)
+
+	// overlapped and adjacent ranges are joined
+	rs.AddRange(2, 11)
+	require.Equal(t, []span{{1, 11}, {20, 20}}, rs.ranges)
+
+	rs.AddRange(0, ^uint64(0))
+	require.Equal(t, []span{{0, ^uint64(0)}}, rs.ranges)
+}
+
+func TestRangeSetJSON(t *testing.T) {
+	var rs RangeSet
+	for _, off := range []uint64{1, 2, 3, 10, 12} {
+		rs.Add(off)
+	}
+
+	data, err := json.Marshal(&rs)
+	require.NoError(t, err)
+	require.Equal(t, "[[1,3],[10,10],[12,12]]", string(data))
+
+	var restored RangeSet
+	require.NoError(t, json.Unmarshal(data, &restored))
+	require.Equal(t, rs.ranges, restored.ranges)
+
+	require.Error(t, json.Unmarshal([]byte("[[3,5],[1,2]]"), &restored))
+	require.Error(t, json.Unmarshal([]byte("[[1,2],[3,5]]"), &restored))
+}
+
+func TestSubnetMigration(t *testing.T) {
+	old := `{"id":"aaa","v":4,"pool":"192.168.0.0/24","idx":4,"allocated":["192.168.0.1","192.168.0.3"],"free":["192.168.0.2"]}`
+
+	var sn Subnet
+	require.NoError(t, json.Unmarshal([]byte(old), &sn))
+	require.Equal(t, []span{{1, 1}, {3, 3}}, sn.Leases.ranges)
+
+	ip, err := sn.GetAddress("", time.Hour, 0)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.2", ip)
+
+	data, err := json.Marshal(&sn)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"id":"aaa","v":4,"pool":"192.168.0.0/24","leases":[[1,3]]}`, string(data))
+
+	require.Error(t, json.Unmarshal([]byte(`{"v":4,"pool":"192.168.0.0/24","allocated":["10.0.0.1"]}`), &Subnet{}))
+}
+
+func TestSubnetRange(t *testing.T) {
+	pn, _ := iplib.ParseIPNet("fe80::/64")
+	sn, err := NewSubnet(pn)
+	require.NoError(t, err)
+	require.NoError(t, sn.setRange("fe80::ffff:ffff:ffff:fffe/127"))
+
+	ip, err := sn.GetAddress("", 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, "fe80::ffff:ffff:ffff:fffe", ip)
+
+	ip, err = sn.GetAddress("", 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, "fe80::ffff:ffff:ffff:ffff", ip)
+
+	_, err = sn.GetAddress("", 0, 0)
+	require.Error(t, err)
+
+	require.NoError(t, sn.ReturnAddress("fe80::ffff:ffff:ffff:fffe"))
+	ip, _ = sn.GetAddress("", 0, 0)
+	require.Equal(t, "fe80::ffff:ffff:ffff:fffe", ip)
+}
@@ -0,0 +1,162 @@
+//go:build cgo
+// +build cgo
+
+package leaser
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	// SQLite driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// NewSQLiteStore - open or create SQLite database
+func NewSQLiteStore(file string) (*SQLiteStore, error) {
+	return openSQLite(file, false)
+}
+
+// openSQLite - open database, read-only database must exist
+func openSQLite(file string, readOnly bool) (*SQLiteStore, error) {
+	if file == "" {
+		return nil, errors.New("Database file name is empty")
+	}
+
+	dsn := "file:" + file + "?_journal_mode=WAL&_synchronous=FULL&_busy_timeout=1000"
+	if readOnly {
+		dsn = "file:" + file + "?mode=ro&_busy_timeout=1000"
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, errors.New("Can't open database " + file + ": " + err.Error())
+	}
+
+	// one connection, sqlite serializes writes anyway
+	db.SetMaxOpenConns(1)
+	if readOnly {
+		return &SQLiteStore{File: file, db: db}, nil
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS state (id INTEGER PRIMARY KEY CHECK (id = 1), seq INTEGER NOT NULL, data BLOB NOT NULL);
+		CREATE TABLE IF NOT EXISTS journal (seq INTEGER PRIMARY KEY, entry BLOB NOT NULL);
+	`)
+	if err != nil {
+		db.Close()
+		return nil, errors.New("Can't create tables in database " + file + ": " + err.Error())
+	}
+
+	return &SQLiteStore{File: file, db: db}, nil
+}
+
+// SQLiteStore - state in SQLite database: table 'state' keeps whole leaser, table 'journal' keeps mutations by sequence number
+type SQLiteStore struct {
+	File string
+
+	db *sql.DB
+}
+
+// Load - saved state with journal replayed to it
+func (ss *SQLiteStore) Load() (*Leaser, error) {
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var state []byte
+	err = tx.QueryRow("SELECT data FROM state WHERE id = 1").Scan(&state)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	rows, err := tx.Query("SELECT entry FROM journal ORDER BY seq")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*JournalEntry
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+
+		var e JournalEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, &e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if state == nil {
+		if len(entries) != 0 {
+			return nil, errors.New("Journal exists without state in database " + ss.File)
+		}
+
+		return nil, ErrNoState
+	}
+
+	var lsr Leaser
+	err = lsr.UnmarshalJSON(state)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lsr.Replay(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lsr, nil
+}
+
+// Save - save state and remove journal entries which are in it
+func (ss *SQLiteStore) Save(lsr *Leaser) error {
+	state, seq, err := lsr.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT OR REPLACE INTO state (id, seq, data) VALUES (1, ?, ?)", int64(seq), state)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM journal WHERE seq <= ?", int64(seq))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Update - write mutation to journal
+func (ss *SQLiteStore) Update(e *JournalEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = ss.db.Exec("INSERT INTO journal (seq, entry) VALUES (?, ?)", int64(e.Seq), data)
+	return err
+}
+
+// Close - close database
+func (ss *SQLiteStore) Close() error {
+	return ss.db.Close()
+}
@@ -0,0 +1,15 @@
+//go:build !cgo
+// +build !cgo
+
+package leaser
+
+import "errors"
+
+// NewSQLiteStore - SQLite driver needs cgo, so store isn't available in build without it
+func NewSQLiteStore(file string) (Store, error) {
+	return openSQLite(file, false)
+}
+
+func openSQLite(file string, readOnly bool) (Store, error) {
+	return nil, errors.New("SQLite store isn't available, gipam is built without cgo")
+}
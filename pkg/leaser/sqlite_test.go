@@ -0,0 +1,8 @@
+//go:build cgo
+// +build cgo
+
+package leaser
+
+func init() {
+	stores[StoreSQLite] = "lease.sqlite"
+}
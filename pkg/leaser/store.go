@@ -0,0 +1,103 @@
+package leaser
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// Store backends
+const (
+	StoreJSON   = "json"
+	StoreBolt   = "bolt"
+	StoreSQLite = "sqlite"
+)
+
+// ErrNoState - store has no saved state, it can be created from scratch
+var ErrNoState = errors.New("No saved state")
+
+// Store - persistent storage of leaser state.
+// Leaser writes every mutation by Update before it is acknowledged, whole state is saved periodically by Save.
+type Store interface {
+	// Load - saved state with all mutations after it, ErrNoState if store is empty
+	Load() (*Leaser, error)
+
+	// Save - save whole state, mutations which are in it can be removed
+	Save(lsr *Leaser) error
+
+	// Update - durable write of one mutation in transaction
+	Update(e *JournalEntry) error
+
+	Close() error
+}
+
+// NewStore - open store by kind: 'json' file, 'bolt' (bbolt) or 'sqlite' database, generations is used by 'json' store only
+func NewStore(kind, file string, generations uint) (Store, error) {
+	switch strings.ToLower(kind) {
+	case "", StoreJSON:
+		return NewBackup(file, generations)
+
+	case StoreBolt, "bbolt":
+		return NewBoltStore(file)
+
+	case StoreSQLite:
+		return NewSQLiteStore(file)
+	}
+
+	return nil, errors.New("Unknown store '" + kind + "', it can be '" + StoreJSON + "', '" + StoreBolt + "' or '" + StoreSQLite + "'")
+}
+
+// NewReadOnlyStore - open store by kind only for Load, it isn't changed and it can't be opened while driver writes it
+func NewReadOnlyStore(kind, file string, generations uint) (Store, error) {
+	switch strings.ToLower(kind) {
+	case "", StoreJSON:
+		return NewReadOnlyBackup(file, generations)
+
+	case StoreBolt, "bbolt":
+		return openBolt(file, true)
+
+	case StoreSQLite:
+		return openSQLite(file, true)
+	}
+
+	return nil, errors.New("Unknown store '" + kind + "', it can be '" + StoreJSON + "', '" + StoreBolt + "' or '" + StoreSQLite + "'")
+}
+
+// Saver - background save every 30 seconds
+func Saver(ctx context.Context, s Store, lsr *Leaser) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Saver canseled")
+			return
+
+		case <-ticker.C:
+			if err := s.Save(lsr); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// Migrate - copy state from one store to another, target store must be empty
+func Migrate(from, to Store) error {
+	lsr, err := from.Load()
+	if err != nil {
+		return errors.New("Can't load state from source store: " + err.Error())
+	}
+
+	if _, err := to.Load(); err != ErrNoState {
+		if err == nil {
+			return errors.New("Target store is not empty")
+		}
+
+		return errors.New("Can't check target store: " + err.Error())
+	}
+
+	return to.Save(lsr)
+}
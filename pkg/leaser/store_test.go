@@ -0,0 +1,168 @@
+package leaser
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// stores - all store backends in dir, sqlite is added in build with cgo
+var stores = map[string]string{StoreJSON: "lease.json", StoreBolt: "lease.db"}
+
+// TestStoreConformance - every backend must restore exactly state which was acknowledged
+func TestStoreConformance(t *testing.T) {
+	for kind, name := range stores {
+		kind, name := kind, name
+		t.Run(kind, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "gipam")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			file := filepath.Join(dir, name)
+			st, err := NewStore(kind, file, 2)
+			require.NoError(t, err)
+
+			_, err = st.Load()
+			require.Equal(t, ErrNoState, err)
+
+			lsr, err := New("fe80::/48", "192.168.0.0/16", 64, 24)
+			require.NoError(t, err)
+			require.NoError(t, st.Save(lsr))
+			lsr.SetStore(st)
+
+			id, _, err := lsr.GetBlock(4, 0)
+			require.NoError(t, err)
+
+			// part of mutations is saved in state, others are only in journal
+			require.NoError(t, st.Save(lsr))
+
+			_, err = lsr.GetGateway(id, "")
+			require.NoError(t, err)
+			_, err = lsr.GetAddress(id, "02:42:c0:a8:00:02")
+			require.NoError(t, err)
+			_, err = lsr.ReserveAddress(id, "192.168.0.10", "")
+			require.NoError(t, err)
+			_, err = lsr.PinAddress(id, "192.168.0.11", "")
+			require.NoError(t, err)
+			_, _, err = lsr.PinBlock("192.168.10.0/24", "")
+			require.NoError(t, err)
+			require.NoError(t, lsr.ReturnAddress(id, "192.168.0.2/24"))
+			require.NoError(t, lsr.ExcludeAddresses(id, []string{"192.168.0.3"}))
+
+			id6, _, err := lsr.GetBlock(6, 0)
+			require.NoError(t, err)
+			require.NoError(t, lsr.ReturnBlock(id6))
+
+			// crash: store is closed without save
+			require.NoError(t, st.Close())
+
+			st, err = NewStore(kind, file, 2)
+			require.NoError(t, err)
+			defer st.Close()
+
+			restored, err := st.Load()
+			require.NoError(t, err)
+			require.Equal(t, lsr.Seq, restored.Seq)
+			require.Equal(t, lsr.V4Tree.FreeBlocks(), restored.V4Tree.FreeBlocks())
+			require.Equal(t, lsr.V6Tree.FreeBlocks(), restored.V6Tree.FreeBlocks())
+
+			want, _, _ := lsr.Snapshot()
+			got, _, _ := restored.Snapshot()
+			require.JSONEq(t, string(want), string(got))
+
+			// retained MAC binding survives
+			restored.SetStore(st)
+			addr, err := restored.GetAddress(id, "02:42:c0:a8:00:02")
+			require.NoError(t, err)
+			require.Equal(t, "192.168.0.2/24", addr)
+
+			require.NoError(t, st.Save(restored))
+			again, err := st.Load()
+			require.NoError(t, err)
+			require.Equal(t, restored.Seq, again.Seq)
+		})
+	}
+}
+
+// TestStoreClosed - mutation which can't be written is rejected and state is not changed
+func TestStoreClosed(t *testing.T) {
+	for kind, name := range stores {
+		kind, name := kind, name
+		t.Run(kind, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "gipam")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			st, err := NewStore(kind, filepath.Join(dir, name), 2)
+			require.NoError(t, err)
+
+			lsr, err := New("fe80::/48", "192.168.0.0/16", 64, 24)
+			require.NoError(t, err)
+			require.NoError(t, st.Save(lsr))
+			lsr.SetStore(st)
+
+			id, _, err := lsr.GetBlock(4, 0)
+			require.NoError(t, err)
+			_, err = lsr.ReserveAddress(id, "192.168.0.10", "")
+			require.NoError(t, err)
+
+			require.NoError(t, st.Close())
+
+			_, err = lsr.GetAddress(id, "")
+			require.Error(t, err)
+			_, err = lsr.ReserveAddress(id, "192.168.0.20", "")
+			require.Error(t, err)
+			require.Error(t, lsr.ReturnAddress(id, "192.168.0.10"))
+			_, _, err = lsr.GetBlock(4, 0)
+			require.Error(t, err)
+			require.Len(t, lsr.Allocated, 1)
+
+			lsr.SetStore(nil)
+			addr, _ := lsr.GetAddress(id, "")
+			require.Equal(t, "192.168.0.1/24", addr)
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gipam")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	from, err := NewStore(StoreJSON, filepath.Join(dir, "lease.json"), 2)
+	require.NoError(t, err)
+	defer from.Close()
+
+	lsr, err := New("fe80::/48", "192.168.0.0/16", 64, 24)
+	require.NoError(t, err)
+	require.NoError(t, from.Save(lsr))
+	lsr.SetStore(from)
+
+	id, _, _ := lsr.GetBlock(4, 0)
+	lsr.GetAddress(id, "")
+
+	for kind, name := range stores {
+		if kind == StoreJSON {
+			continue
+		}
+
+		to, err := NewStore(kind, filepath.Join(dir, name), 0)
+		require.NoError(t, err)
+
+		require.NoError(t, Migrate(from, to))
+		require.Error(t, Migrate(from, to))
+
+		migrated, err := to.Load()
+		require.NoError(t, err)
+		require.Len(t, migrated.Allocated, 1)
+		require.Equal(t, lsr.Seq, migrated.Seq)
+
+		to.Close()
+	}
+
+	_, err = NewStore("bla", filepath.Join(dir, "bla"), 0)
+	require.Error(t, err)
+}
@@ -1,8 +1,11 @@
 package leaser
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
-	"math/rand"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -10,102 +13,523 @@ import (
 	iplib "github.com/dspinhirne/netaddr-go"
 )
 
-// NewSubnet - create new allocated block with random name (16 symbols)
+// Gateway policies
+const (
+	GatewayFirst = "first"
+	GatewayLast  = "last"
+)
+
+// maxV6Block - the biggest IPv6 block (the shortest prefix len), addresses are counted by 64 bit offsets
+// of block, so shorter blocks can't give addresses and gateway
+const maxV6Block = 64
+
+// NewSubnet - create new allocated block, its name (16 symbols) is derived from network of block,
+// so block which is adopted from Docker after state is lost gets the same ID which Docker keeps as pool ID
 func NewSubnet(pool iplib.IPNet) (*Subnet, error) {
 	if pool == nil {
 		return nil, errors.New("Allocated address pool is empty")
 	}
 
-	return &Subnet{ID: makeRandomString(16), Pool: pool.String(), V: uint8(pool.Version()), Idx: 1}, nil
+	return &Subnet{ID: blockID(pool.String()), Pool: pool.String(), V: uint8(pool.Version())}, nil
 }
 
 // Subnet - allocated address block
 type Subnet struct {
 	sync.RWMutex `json:"-"`
 
-	ID   string `json:"id"`
-	V    uint8  `json:"v"`
-	Pool string `json:"pool"`
-	Idx  uint   `json:"idx"`
+	ID     string `json:"id"`
+	V      uint8  `json:"v"`
+	Pool   string `json:"pool"`
+	Parent string `json:"parent,omitempty"` // main pool which block is cut from
+	Range  string `json:"range,omitempty"`
+
+	Gateway string `json:"gateway,omitempty"`
+
+	Leases  RangeSet `json:"leases"`            // offsets of allocated addresses from network address
+	Exclude []string `json:"exclude,omitempty"` // addresses of block which are never given: ip, network or range 'first-last'
+
+	Bindings map[string]*Binding `json:"bindings,omitempty"`
+	Held     []Hold              `json:"held,omitempty"` // released addresses in hold-down, the oldest first
+
+	Pinned    bool     `json:"pinned,omitempty"`     // block is reserved by operator, reconciler doesn't release it
+	PinnedIPs []string `json:"pinned_ips,omitempty"` // addresses reserved by operator, reconciler doesn't release them
 
-	Allocated []string `json:"allocated"`
-	Free      []string `json:"free"`
+	excluded    RangeSet          // offsets of excluded addresses of block and main pool
+	poolExclude []string          // excluded addresses of main pool, they name exclusion of offset in errors
+	anycast     bool              // IPv6 subnet-router anycast address can be given
+	macs        map[uint64]string // index of bindings by offset, it is built on first use
 }
 
-// GetAddress - one ip from allocated address block
-func (sn *Subnet) GetAddress() (string, error) {
+// UnmarshalJSON implements JSON unmarshaler, old lease files with list of allocated addresses are converted to offsets
+func (sn *Subnet) UnmarshalJSON(data []byte) error {
+	type subnet Subnet
+	c := struct {
+		*subnet
+		Allocated []string `json:"allocated"`
+	}{subnet: (*subnet)(sn)}
+
+	err := json.Unmarshal(data, &c)
+	if err != nil {
+		return err
+	}
+
+	sn.macs = nil
+
+	for _, ip := range c.Allocated {
+		off, _, err := sn.offset(ip)
+		if err != nil {
+			return err
+		}
+
+		sn.Leases.Add(off)
+	}
+
+	return sn.exclude(&sn.excluded, sn.Exclude, true)
+}
+
+// GetAddress - lowest free ip from allocated address block, gateway and ips retained by MAC bindings are skipped.
+// If MAC is not empty and it has retained binding, ip bound to MAC is given again.
+// If hold-down period is set, released ips are given again in order of release after it is expired.
+func (sn *Subnet) GetAddress(mac string, retention, hold time.Duration) (string, error) {
 	sn.Lock()
 	defer sn.Unlock()
 
-	ip, err := sn.getFromFreePool()
-	if err == nil {
-		sn.Allocated = append(sn.Allocated, ip)
-		return ip, err
+	if ip, ok := sn.bound(mac, retention); ok {
+		if off, _, err := sn.offset(ip); err == nil && sn.Leases.Add(off) {
+			sn.Held = unhold(sn.Held, ip)
+			sn.bind(mac, ip)
+			return ip, nil
+		}
+	}
+
+	ip, err := sn.allocate(retention, hold)
+	if err != nil {
+		return "", err
+	}
+
+	sn.bind(mac, ip)
+	return ip, nil
+}
+
+// allocate - mark the oldest released offset which hold-down is expired or lowest free offset inside range as allocated (first fit).
+// Offsets retained for MAC are skipped while there are other free offsets, then the earliest released of them is given.
+func (sn *Subnet) allocate(retention, hold time.Duration) (string, error) {
+	first, last, err := sn.bounds()
+	if err != nil {
+		return "", err
+	}
+
+	gw, _, gwErr := sn.offset(sn.Gateway)
+	held := map[uint64]bool{}
+	if hold > 0 {
+		if ip, ok := sn.reuse(hold, retention, held, first, last); ok {
+			return ip, nil
+		}
+	}
+
+	off := first
+	for {
+		next, ok := sn.Leases.NextFree(off)
+		if !ok || next > last {
+			break
+		}
+
+		if sn.excluded.Contains(next) {
+			if off, ok = sn.excluded.NextFree(next); !ok {
+				break
+			}
+			continue
+		}
+
+		if (gwErr == nil && next == gw) || held[next] || sn.retained(next, retention) {
+			if next == last {
+				break
+			}
+
+			off = next + 1
+			continue
+		}
+
+		return sn.take(next)
 	}
 
-	ip, err = sn.getFromMainPool()
-	if err == nil {
-		sn.Allocated = append(sn.Allocated, ip)
-		return ip, err
+	// containers with random MAC never come back, so retained addresses mustn't exhaust block
+	next, ok := sn.oldestRetained(first, last, func(off uint64) bool {
+		return held[off] || sn.excluded.Contains(off) || gwErr == nil && off == gw
+	})
+	if ok {
+		return sn.take(next)
 	}
 
-	return "", errors.New("Can't get ip from '" + sn.ID + "' allocated pool: " + sn.Pool)
+	return "", errors.New("No more address in '" + sn.ID + "' Subnet pool " + sn.Pool)
 }
 
-func (sn *Subnet) getFromFreePool() (string, error) {
-	if len(sn.Free) == 0 {
-		return "", errors.New("No Address in free pool")
+// take - mark free offset as allocated
+func (sn *Subnet) take(off uint64) (string, error) {
+	ipo, err := sn.ip(off)
+	if err != nil {
+		return "", err
 	}
 
-	ip := sn.Free[len(sn.Free)-1]
-	sn.Free = sn.Free[:len(sn.Free)-1]
+	sn.Leases.Add(off)
+	return ipo.String(), nil
+}
+
+// ReserveAddress - reserve exactly requested ip from allocated address block and bind it to MAC if not empty.
+// Ip can be out of range (sub pool), but inside allocated block.
+func (sn *Subnet) ReserveAddress(ip, mac string) (string, error) {
+	// if we get ip with mask
+	ip = strings.Split(ip, "/")[0]
+
+	sn.Lock()
+	defer sn.Unlock()
+
+	off, ipo, err := sn.offset(ip)
+	if err != nil {
+		return "", err
+	}
+
+	if err := sn.reserved(off, ipo); err != nil {
+		return "", err
+	}
+
+	ip = ipo.String()
+	if ip == sn.Gateway {
+		return "", errors.New("Address " + ip + " is gateway of block " + sn.ID)
+	}
+
+	if sn.excluded.Contains(off) {
+		return "", errors.New("Address " + ip + " is excluded in block " + sn.ID)
+	}
+
+	if !sn.Leases.Add(off) {
+		return "", errors.New("Address " + ip + " already allocated in block " + sn.ID)
+	}
+
+	// requested address is given even in hold-down
+	sn.Held = unhold(sn.Held, ip)
+	sn.bind(mac, ip)
 	return ip, nil
 }
 
-func (sn *Subnet) getFromMainPool() (string, error) {
+// ReturnAddress - mark ip as free, now IP can be given in another Address request
+func (sn *Subnet) ReturnAddress(ip string) error {
+	// if we get ip with mask
+	ip = strings.Split(ip, "/")[0]
+
+	sn.Lock()
+	defer sn.Unlock()
+
+	off, ipo, err := sn.offset(ip)
+	if err != nil {
+		return errors.New("Returned address not found in block " + sn.ID)
+	}
+
+	// gateway lives while block exists
+	ip = ipo.String()
+	if ip == sn.Gateway {
+		return nil
+	}
+
+	if !sn.Leases.Remove(off) {
+		return errors.New("Returned address not found in block " + sn.ID)
+	}
+
+	sn.PinnedIPs = removeString(sn.PinnedIPs, ip)
+	sn.release(ip, now().Unix())
+	return nil
+}
+
+// returnable - error if ip can't be returned, false if ip is gateway and nothing will be changed
+func (sn *Subnet) returnable(ip string) (bool, error) {
+	// if we get ip with mask
+	ip = strings.Split(ip, "/")[0]
+
+	sn.RLock()
+	defer sn.RUnlock()
+
+	off, ipo, err := sn.offset(ip)
+	if err != nil || ipo.String() != sn.Gateway && !sn.Leases.Contains(off) {
+		return false, errors.New("Returned address not found in block " + sn.ID)
+	}
+
+	return ipo.String() != sn.Gateway, nil
+}
+
+// GetGateway - gateway address of allocated block, it is stored separately from container addresses.
+// If address is not empty it will be gateway, else if gateway is not set yet it will be choosen by policy:
+// "first" usable address, "last" usable address or offset from network address.
+// Address choosen by policy mustn't be excluded, retained for MAC or in hold-down, requested address can be excluded.
+func (sn *Subnet) GetGateway(policy, address string, retention, hold time.Duration) (string, error) {
+	// if we get ip with mask
+	address = strings.Split(address, "/")[0]
+
+	sn.Lock()
+	defer sn.Unlock()
+
+	if address == "" && sn.Gateway != "" {
+		return sn.Gateway, nil
+	}
+
+	var off uint64
+	var ipo iplib.IP
+	var err error
+	if address != "" {
+		off, ipo, err = sn.offset(address)
+	} else {
+		off, ipo, err = sn.gatewayByPolicy(policy)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if err := sn.reserved(off, ipo); err != nil {
+		return "", err
+	}
+
+	ip := ipo.String()
+	if ip == sn.Gateway {
+		return ip, nil
+	}
+
+	if sn.Leases.Contains(off) {
+		return "", errors.New("Gateway address " + ip + " already allocated in block " + sn.ID)
+	}
+
+	if address == "" {
+		if err := sn.usable(off, ip, retention, hold); err != nil {
+			return "", err
+		}
+	}
+
+	sn.Gateway = ip
+	return ip, nil
+}
+
+// usable - error if free address can't be given: it is excluded, retained for MAC or in hold-down
+func (sn *Subnet) usable(off uint64, ip string, retention, hold time.Duration) error {
+	if sn.excluded.Contains(off) {
+		return errors.New("Address " + ip + " is excluded by " + sn.exclusion(off) + " in block " + sn.ID)
+	}
+
+	if sn.retained(off, retention) {
+		return errors.New("Address " + ip + " is retained for MAC " + sn.owners()[off] + " in block " + sn.ID)
+	}
+
+	for _, h := range sn.Held {
+		if o, _, err := sn.offset(h.Item); err == nil && o == off && !h.expired(hold) {
+			return errors.New("Address " + ip + " is in hold-down in block " + sn.ID)
+		}
+	}
+
+	return nil
+}
+
+// gatewayByPolicy - gateway offset and address by policy
+func (sn *Subnet) gatewayByPolicy(policy string) (uint64, iplib.IP, error) {
 	switch sn.V {
 	case 6:
 		spv6, _ := iplib.ParseIPv6Net(sn.Pool)
-		ipo := spv6.Nth(uint64(sn.Idx))
+		if spv6 == nil || spv6.Netmask().PrefixLen() < maxV6Block {
+			return 0, nil, errors.New("Can't choose gateway for block " + sn.Pool)
+		}
+
+		last := uint64(iplib.F64)
+		if spv6.Len() != 0 {
+			last = spv6.Len() - 1
+		}
+
+		off, err := parseGatewayPolicy(policy, last)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		ipo := spv6.Nth(off)
 		if ipo == nil {
-			return "", errors.New("No more address in '" + sn.ID + "' IPv6 Subnet pool " + sn.Pool)
+			return 0, nil, errors.New("Gateway offset " + policy + " is out of block " + sn.Pool)
 		}
 
-		sn.Idx++
-		return ipo.String(), nil
+		return off, ipo, nil
 
 	case 4:
 		spv4, _ := iplib.ParseIPv4Net(sn.Pool)
-		ipo := spv4.Nth(uint32(sn.Idx))
+		if spv4 == nil || spv4.Len() < 4 {
+			return 0, nil, errors.New("Can't choose gateway for block " + sn.Pool)
+		}
+
+		// last usable address before broadcast
+		off, err := parseGatewayPolicy(policy, uint64(spv4.Len()-2))
+		if err != nil {
+			return 0, nil, err
+		}
+
+		ipo := spv4.Nth(uint32(off))
 		if ipo == nil {
-			return "", errors.New("No more address in '" + sn.ID + "' IPv4 Subnet pool " + sn.Pool)
+			return 0, nil, errors.New("Gateway offset " + policy + " is out of block " + sn.Pool)
 		}
 
-		sn.Idx++
-		return ipo.String(), nil
+		return off, ipo, nil
 
 	default:
-		return "", errors.New("Wrong IP protocol version")
+		return 0, nil, errors.New("Wrong IP protocol version")
 	}
 }
 
-// ReturnAddress - move ip from Allocated to Free, now IP is free and can be given in another Address request
-func (sn *Subnet) ReturnAddress(ip string) error {
-	// if we get ip with mask
-	ip = strings.Split(ip, "/")[0]
+// offset - offset of ip from network address of allocated block
+func (sn *Subnet) offset(ip string) (uint64, iplib.IP, error) {
+	switch sn.V {
+	case 6:
+		spv6, _ := iplib.ParseIPv6Net(sn.Pool)
+		ipv6, err := iplib.ParseIPv6(ip)
+		if err != nil || spv6 == nil || !spv6.Contains(ipv6) {
+			return 0, nil, errors.New("Address " + ip + " is out of block " + sn.Pool)
+		}
 
-	sn.Lock()
-	defer sn.Unlock()
+		return ipv6.HostId() - spv6.Network().HostId(), ipv6, nil
+
+	case 4:
+		spv4, _ := iplib.ParseIPv4Net(sn.Pool)
+		ipv4, err := iplib.ParseIPv4(ip)
+		if err != nil || spv4 == nil || !spv4.Contains(ipv4) {
+			return 0, nil, errors.New("Address " + ip + " is out of block " + sn.Pool)
+		}
+
+		return uint64(ipv4.Addr() - spv4.Network().Addr()), ipv4, nil
+
+	default:
+		return 0, nil, errors.New("Wrong IP protocol version")
+	}
+}
+
+// ip - address with offset from network address of allocated block
+func (sn *Subnet) ip(off uint64) (iplib.IP, error) {
+	switch sn.V {
+	case 6:
+		spv6, _ := iplib.ParseIPv6Net(sn.Pool)
+		if spv6 != nil {
+			if ipo := spv6.Nth(off); ipo != nil {
+				return ipo, nil
+			}
+		}
+
+	case 4:
+		spv4, _ := iplib.ParseIPv4Net(sn.Pool)
+		if spv4 != nil && off <= uint64(^uint32(0)) {
+			if ipo := spv4.Nth(uint32(off)); ipo != nil {
+				return ipo, nil
+			}
+		}
+
+	default:
+		return nil, errors.New("Wrong IP protocol version")
+	}
+
+	return nil, errors.New("Offset " + strconv.FormatUint(off, 10) + " is out of block " + sn.Pool)
+}
+
+// span - offsets of first and last address of network n from network address of allocated block
+func (sn *Subnet) span(n string) (uint64, uint64, error) {
+	switch sn.V {
+	case 6:
+		spv6, _ := iplib.ParseIPv6Net(sn.Pool)
+		nv6, err := iplib.ParseIPv6Net(n)
+		if err != nil || spv6 == nil || spv6.Netmask().PrefixLen() < maxV6Block {
+			return 0, 0, errors.New("Can't use addresses of block " + sn.Pool)
+		}
+
+		if ok, rel := spv6.Rel(nv6); !ok || rel < 0 {
+			return 0, 0, errors.New("Address range " + n + " is out of block " + sn.Pool)
+		}
+
+		// Len is 0 for /64
+		size := uint64(iplib.F64)
+		if nv6.Len() != 0 {
+			size = nv6.Len() - 1
+		}
+
+		first := nv6.Network().HostId() - spv6.Network().HostId()
+		return first, first + size, nil
 
-	for k, v := range sn.Allocated {
-		if v == ip {
-			sn.Allocated[k] = sn.Allocated[len(sn.Allocated)-1]
-			sn.Allocated = sn.Allocated[:len(sn.Allocated)-1]
-			sn.Free = append(sn.Free, ip)
-			return nil
+	case 4:
+		spv4, _ := iplib.ParseIPv4Net(sn.Pool)
+		nv4, err := iplib.ParseIPv4Net(n)
+		if err != nil || spv4 == nil {
+			return 0, 0, errors.New("Can't use addresses of block " + sn.Pool)
 		}
+
+		if ok, rel := spv4.Rel(nv4); !ok || rel < 0 {
+			return 0, 0, errors.New("Address range " + n + " is out of block " + sn.Pool)
+		}
+
+		first := uint64(nv4.Network().Addr() - spv4.Network().Addr())
+		return first, first + uint64(nv4.Len()) - 1, nil
+
+	default:
+		return 0, 0, errors.New("Wrong IP protocol version")
 	}
-	return errors.New("Returned address not found in block " + sn.ID)
+}
+
+// bounds - first and last offsets which can be given by request without address, they are restricted by range (sub pool)
+func (sn *Subnet) bounds() (uint64, uint64, error) {
+	first, last, err := sn.span(sn.Pool)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if sn.Range != "" {
+		rf, rl, err := sn.span(sn.Range)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		first, last = rf, rl
+	}
+
+	// network address is never given, IPv6 subnet-router anycast address only if it is enabled
+	if first == 0 && !(sn.V == 6 && sn.anycast) {
+		first = 1
+	}
+
+	// IPv4 broadcast address is never given, /31 and /32 have no broadcast
+	if sn.V == 4 {
+		if bcast, ok := sn.broadcast(); ok && last == bcast {
+			last--
+		}
+	}
+
+	return first, last, nil
+}
+
+// reserved - error if address can't be given: network, IPv4 broadcast or IPv6 subnet-router anycast address
+func (sn *Subnet) reserved(off uint64, ipo iplib.IP) error {
+	switch {
+	case off == 0 && sn.V == 4:
+		return errors.New("Network address " + ipo.String() + " is reserved in block " + sn.ID)
+
+	case off == 0 && !sn.anycast:
+		return errors.New("Subnet-router anycast address " + ipo.String() + " is reserved in block " + sn.ID)
+	}
+
+	if bcast, ok := sn.broadcast(); ok && off == bcast {
+		return errors.New("Broadcast address " + ipo.String() + " is reserved in block " + sn.ID)
+	}
+
+	return nil
+}
+
+// broadcast - offset of IPv4 broadcast address, false if block has no broadcast
+func (sn *Subnet) broadcast() (uint64, bool) {
+	if sn.V != 4 {
+		return 0, false
+	}
+
+	spv4, _ := iplib.ParseIPv4Net(sn.Pool)
+	if spv4 == nil || spv4.Len() < 4 {
+		return 0, false
+	}
+
+	return uint64(spv4.Len() - 1), true
 }
 
 // Reset - clear
@@ -113,18 +537,60 @@ func (sn *Subnet) Reset() {
 	sn.Lock()
 	defer sn.Unlock()
 
-	sn.Allocated = sn.Allocated[:0]
-	sn.Free = sn.Free[:0]
-	sn.Idx = 1
+	sn.Leases.Clear()
+	sn.Bindings = nil
+	sn.macs = nil
+	sn.Range = ""
+}
+
+// Mask - prefix len of allocated block
+func (sn *Subnet) Mask() string {
+	return strings.Split(sn.Pool, "/")[1]
+}
+
+// setRange - restrict given addresses to range (sub pool) inside allocated block, empty range removes restriction.
+func (sn *Subnet) setRange(r string) error {
+	sn.Lock()
+	defer sn.Unlock()
+
+	if r == "" {
+		sn.Range = ""
+		return nil
+	}
+
+	if _, _, err := sn.span(r); err != nil {
+		return err
+	}
+
+	rn, _ := iplib.ParseIPNet(r)
+	sn.Range = rn.String()
+	return nil
 }
 
-func makeRandomString(length uint) string {
-	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	var seededRand *rand.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+// parseGatewayPolicy - convert policy to offset of gateway inside block, last is offset of last usable address
+func parseGatewayPolicy(policy string, last uint64) (uint64, error) {
+	switch policy {
+	case "", GatewayFirst:
+		return 1, nil
 
-	b := make([]byte, length)
-	for i := range b {
-		b[i] = charset[seededRand.Intn(len(charset))]
+	case GatewayLast:
+		return last, nil
 	}
-	return string(b)
+
+	off, err := strconv.ParseUint(policy, 10, 64)
+	if err != nil || off == 0 {
+		return 0, errors.New("Wrong gateway policy '" + policy + "', it can be '" + GatewayFirst + "', '" + GatewayLast + "' or offset from network address")
+	}
+
+	if off > last {
+		return 0, errors.New("Gateway offset " + policy + " is out of block")
+	}
+
+	return off, nil
+}
+
+// blockID - name of block, it is the same for the same network
+func blockID(pool string) string {
+	sum := sha256.Sum256([]byte(pool))
+	return hex.EncodeToString(sum[:8])
 }
@@ -0,0 +1,170 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/archekb/gipam/pkg/leaser"
+
+	"github.com/docker/go-plugins-helpers/ipam"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Inspector - leaser which usage can be collected, leaser.Leaser implements it
+type Inspector interface {
+	Pools() []leaser.PoolInfo
+	Blocks() []leaser.BlockInfo
+}
+
+// New - create metrics with own registry, usage of leasers is collected on every scrape
+func New(spaces map[string]Inspector) *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+
+		calls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gipam_plugin_calls_total",
+			Help: "Count of IPAM plugin calls by method and result.",
+		}, []string{"method", "result"}),
+
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gipam_plugin_call_duration_seconds",
+			Help:    "Latency of RequestPool and RequestAddress plugin calls.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 4, 8),
+		}, []string{"method"}),
+
+		saved: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gipam_last_save_timestamp_seconds",
+			Help: "Time of last successful save of whole state of address space.",
+		}, []string{"space"}),
+	}
+
+	m.Registry.MustRegister(m.calls, m.latency, m.saved, &collector{spaces: spaces})
+	return m
+}
+
+// Metrics - Prometheus metrics of driver
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	calls   *prometheus.CounterVec
+	latency *prometheus.HistogramVec
+	saved   *prometheus.GaugeVec
+}
+
+// Handler - HTTP handler of /metrics
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+// observe - count call of method, latency is kept only for requests of pools and addresses
+func (m *Metrics) observe(method string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+
+	m.calls.WithLabelValues(method, result).Inc()
+	if method == "RequestPool" || method == "RequestAddress" {
+		m.latency.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	}
+}
+
+var (
+	poolBlocks = prometheus.NewDesc("gipam_pool_blocks",
+		"Count of allocate blocks of main pool: total, allocated and free (can be allocated).",
+		[]string{"space", "family", "pool", "state"}, nil)
+
+	blockAddresses = prometheus.NewDesc("gipam_block_addresses",
+		"Count of addresses of allocated block: used (leased) and free (can be given).",
+		[]string{"space", "block", "pool", "state"}, nil)
+)
+
+// collector - usage of main pools and allocated blocks, it is read from leasers under their locks on scrape
+type collector struct {
+	spaces map[string]Inspector
+}
+
+// Describe implements prometheus.Collector
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolBlocks
+	ch <- blockAddresses
+}
+
+// Collect implements prometheus.Collector
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	for name, lsr := range c.spaces {
+		for _, p := range lsr.Pools() {
+			family := "ipv" + strconv.Itoa(int(p.V))
+			ch <- prometheus.MustNewConstMetric(poolBlocks, prometheus.GaugeValue, p.Capacity, name, family, p.Pool, "total")
+			ch <- prometheus.MustNewConstMetric(poolBlocks, prometheus.GaugeValue, float64(p.Blocks), name, family, p.Pool, "allocated")
+			ch <- prometheus.MustNewConstMetric(poolBlocks, prometheus.GaugeValue, p.Available, name, family, p.Pool, "free")
+		}
+
+		for _, b := range lsr.Blocks() {
+			ch <- prometheus.MustNewConstMetric(blockAddresses, prometheus.GaugeValue, float64(b.Leased), name, b.ID, b.Pool, "used")
+			ch <- prometheus.MustNewConstMetric(blockAddresses, prometheus.GaugeValue, b.Free, name, b.ID, b.Pool, "free")
+		}
+	}
+}
+
+// Instrument - IPAM driver which counts calls of driver d
+func (m *Metrics) Instrument(d ipam.Ipam) ipam.Ipam {
+	return &driver{Ipam: d, m: m}
+}
+
+type driver struct {
+	ipam.Ipam
+	m *Metrics
+}
+
+func (d *driver) GetCapabilities() (*ipam.CapabilitiesResponse, error) {
+	defer d.m.observe("GetCapabilities", time.Now(), nil)
+	return d.Ipam.GetCapabilities()
+}
+
+func (d *driver) GetDefaultAddressSpaces() (res *ipam.AddressSpacesResponse, err error) {
+	defer func(start time.Time) { d.m.observe("GetDefaultAddressSpaces", start, err) }(time.Now())
+	return d.Ipam.GetDefaultAddressSpaces()
+}
+
+func (d *driver) RequestPool(r *ipam.RequestPoolRequest) (res *ipam.RequestPoolResponse, err error) {
+	defer func(start time.Time) { d.m.observe("RequestPool", start, err) }(time.Now())
+	return d.Ipam.RequestPool(r)
+}
+
+func (d *driver) ReleasePool(r *ipam.ReleasePoolRequest) (err error) {
+	defer func(start time.Time) { d.m.observe("ReleasePool", start, err) }(time.Now())
+	return d.Ipam.ReleasePool(r)
+}
+
+func (d *driver) RequestAddress(r *ipam.RequestAddressRequest) (res *ipam.RequestAddressResponse, err error) {
+	defer func(start time.Time) { d.m.observe("RequestAddress", start, err) }(time.Now())
+	return d.Ipam.RequestAddress(r)
+}
+
+func (d *driver) ReleaseAddress(r *ipam.ReleaseAddressRequest) (err error) {
+	defer func(start time.Time) { d.m.observe("ReleaseAddress", start, err) }(time.Now())
+	return d.Ipam.ReleaseAddress(r)
+}
+
+// Store - state store which sets time of last successful save of address space
+func (m *Metrics) Store(space string, s leaser.Store) leaser.Store {
+	return &store{Store: s, m: m, space: space}
+}
+
+type store struct {
+	leaser.Store
+	m     *Metrics
+	space string
+}
+
+func (s *store) Save(lsr *leaser.Leaser) error {
+	if err := s.Store.Save(lsr); err != nil {
+		return err
+	}
+
+	s.m.saved.WithLabelValues(s.space).SetToCurrentTime()
+	return nil
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/archekb/gipam/pkg/gipam"
+	"github.com/archekb/gipam/pkg/leaser"
+
+	"github.com/docker/go-plugins-helpers/ipam"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	lsr, err := leaser.New("", "192.168.0.0/16", 0, 24)
+	require.NoError(t, err)
+
+	m := New(map[string]Inspector{"local": lsr})
+
+	g, err := gipam.New(lsr)
+	require.NoError(t, err)
+	d := m.Instrument(g)
+
+	pool, err := d.RequestPool(&ipam.RequestPoolRequest{AddressSpace: "local"})
+	require.NoError(t, err)
+	_, err = d.RequestAddress(&ipam.RequestAddressRequest{PoolID: pool.PoolID})
+	require.NoError(t, err)
+	_, err = d.RequestAddress(&ipam.RequestAddressRequest{PoolID: "none"})
+	require.Error(t, err)
+
+	require.Equal(t, 1.0, testutil.ToFloat64(m.calls.WithLabelValues("RequestPool", "ok")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.calls.WithLabelValues("RequestAddress", "ok")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.calls.WithLabelValues("RequestAddress", "error")))
+
+	dir, err := ioutil.TempDir("", "gipam")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	st, err := leaser.NewStore(leaser.StoreJSON, filepath.Join(dir, "lease.json"), 1)
+	require.NoError(t, err)
+	st = m.Store("local", st)
+	require.NoError(t, st.Save(lsr))
+	require.NoError(t, st.Close())
+	require.NotZero(t, testutil.ToFloat64(m.saved.WithLabelValues("local")))
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, s := range []string{
+		`gipam_pool_blocks{family="ipv4",pool="192.168.0.0/16",space="local",state="total"} 256`,
+		`gipam_pool_blocks{family="ipv4",pool="192.168.0.0/16",space="local",state="allocated"} 1`,
+		`gipam_pool_blocks{family="ipv4",pool="192.168.0.0/16",space="local",state="free"} 255`,
+		`gipam_block_addresses{block="` + pool.PoolID + `",pool="192.168.0.0/24",space="local",state="used"} 1`,
+		`gipam_block_addresses{block="` + pool.PoolID + `",pool="192.168.0.0/24",space="local",state="free"} 253`,
+		`gipam_plugin_call_duration_seconds_count{method="RequestAddress"} 2`,
+	} {
+		require.True(t, strings.Contains(body, s), "Expected %s in:\n%s", s, body)
+	}
+}
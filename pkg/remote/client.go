@@ -0,0 +1,256 @@
+package remote
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Retries - count of request retries after network error or server failure
+var Retries = 5
+
+// RetryDelay - delay before first retry, it is doubled for every next retry
+var RetryDelay = 200 * time.Millisecond
+
+// NewClient - create leaser of address space on gipam server, url can list several servers of cluster separated by comma
+func NewClient(url, token, space string) (*Client, error) {
+	if url == "" {
+		return nil, errors.New("Server URL is empty")
+	}
+
+	if space == "" || strings.Contains(space, "/") {
+		return nil, errors.New("Wrong address space name '" + space + "'")
+	}
+
+	return &Client{URL: strings.TrimRight(url, "/"), Token: token, Space: space, HTTP: newHTTPClient()}, nil
+}
+
+// newHTTPClient - HTTP client which follows redirect to leader with same token and idempotency key
+func newHTTPClient() *http.Client {
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("Too many redirects")
+			}
+
+			for _, h := range []string{"Authorization", "Idempotency-Key"} {
+				if v := via[0].Header.Get(h); v != "" {
+					req.Header.Set(h, v)
+				}
+			}
+
+			return nil
+		},
+	}
+}
+
+// Spaces - names of address spaces of gipam server
+func Spaces(url, token string) ([]string, error) {
+	c := &Client{URL: strings.TrimRight(url, "/"), Token: token, HTTP: newHTTPClient()}
+
+	var res SpacesResponse
+	err := c.do(http.MethodGet, "/v1/spaces", nil, "", &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Spaces, nil
+}
+
+// Client - implements gipam.LeaserInterface by gipam server API. Every call has own idempotency key,
+// retries use same key, so server gives same result and block or address isn't allocated twice
+type Client struct {
+	URL   string // servers separated by comma, retry goes to next server
+	Token string
+	Space string
+	HTTP  *http.Client
+	Key   string // idempotency key of forwarded request, it is used for calls instead of own keys
+
+	// Leader - URL of current leader of cluster, it is asked before every try, so retry after failover goes to new leader.
+	// If it is nil or returns empty URL, servers of URL are used.
+	Leader func() string
+}
+
+// GetBlock - get free block from server
+func (c *Client) GetBlock(v uint8, prefix uint) (string, string, error) {
+	res, err := c.call("GetBlock", &Request{V: v, Prefix: prefix})
+	if err != nil {
+		return "", "", err
+	}
+
+	return res.ID, res.Pool, nil
+}
+
+// ReserveBlock - reserve pool on server
+func (c *Client) ReserveBlock(pool, subPool string) (string, string, error) {
+	res, err := c.call("ReserveBlock", &Request{Pool: pool, SubPool: subPool})
+	if err != nil {
+		return "", "", err
+	}
+
+	return res.ID, res.Pool, nil
+}
+
+// ReturnBlock - return block to server
+func (c *Client) ReturnBlock(id string) error {
+	_, err := c.call("ReturnBlock", &Request{ID: id})
+	return err
+}
+
+// GetAddress - get free address of block
+func (c *Client) GetAddress(id, mac string) (string, error) {
+	res, err := c.call("GetAddress", &Request{ID: id, MAC: mac})
+	if err != nil {
+		return "", err
+	}
+
+	return res.Address, nil
+}
+
+// ReserveAddress - reserve address of block
+func (c *Client) ReserveAddress(id, address, mac string) (string, error) {
+	res, err := c.call("ReserveAddress", &Request{ID: id, Address: address, MAC: mac})
+	if err != nil {
+		return "", err
+	}
+
+	return res.Address, nil
+}
+
+// GetGateway - get gateway of block
+func (c *Client) GetGateway(id, address string) (string, error) {
+	res, err := c.call("GetGateway", &Request{ID: id, Address: address})
+	if err != nil {
+		return "", err
+	}
+
+	return res.Address, nil
+}
+
+// ReturnAddress - return address of block
+func (c *Client) ReturnAddress(id, address string) error {
+	_, err := c.call("ReturnAddress", &Request{ID: id, Address: address})
+	return err
+}
+
+// ExcludeAddresses - set excluded addresses of block
+func (c *Client) ExcludeAddresses(id string, list []string) error {
+	_, err := c.call("ExcludeAddresses", &Request{ID: id, Exclude: list})
+	return err
+}
+
+// call - call leaser method of address space on server
+func (c *Client) call(method string, req *Request) (*Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	key := c.Key
+	if key == "" {
+		if key, err = idempotencyKey(); err != nil {
+			return nil, err
+		}
+	}
+
+	var res Response
+	err = c.do(http.MethodPost, "/v1/spaces/"+c.Space+"/"+method, body, key, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+// do - send request to path of server and retry it after network error, 429 or 5xx status, other statuses are final.
+// Server is chosen again for every try.
+func (c *Client) do(method, path string, body []byte, key string, res interface{}) error {
+	var err error
+	delay := RetryDelay
+	for try := 0; try <= Retries; try++ {
+		if try > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+
+		var retry bool
+		retry, err = c.send(method, c.server(try)+path, body, key, res)
+		if !retry {
+			return err
+		}
+	}
+
+	return errors.New("Server is unavailable: " + err.Error())
+}
+
+// server - URL of server for try: leader if it is known, else servers of URL in turn
+func (c *Client) server(try int) string {
+	if c.Leader != nil {
+		if url := c.Leader(); url != "" {
+			return strings.TrimRight(url, "/")
+		}
+	}
+
+	urls := strings.Split(c.URL, ",")
+	return strings.TrimRight(strings.TrimSpace(urls[try%len(urls)]), "/")
+}
+
+// send - send request once, returns true if request can be retried
+func (c *Client) send(method, url string, body []byte, key string, res interface{}) (bool, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return true, errors.New("Server returns " + resp.Status)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var r Response
+		if json.NewDecoder(resp.Body).Decode(&r) != nil || r.Error == "" {
+			return false, errors.New("Server returns " + resp.Status)
+		}
+
+		return false, errors.New(r.Error)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(res)
+	if err != nil {
+		// response is lost, retry gets it again by idempotency key
+		return key != "", errors.New("Wrong server response: " + err.Error())
+	}
+
+	return false, nil
+}
+
+// idempotencyKey - random key of call
+func idempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.New("Can't create idempotency key: " + err.Error())
+	}
+
+	return hex.EncodeToString(b), nil
+}
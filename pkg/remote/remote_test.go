@@ -0,0 +1,254 @@
+package remote
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/archekb/gipam/pkg/gipam"
+	"github.com/archekb/gipam/pkg/leaser"
+
+	"github.com/stretchr/testify/require"
+)
+
+// lossy - handler which loses response of first request, but request is done by server
+type lossy struct {
+	h    http.Handler
+	lost bool
+}
+
+func (l *lossy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if l.lost {
+		l.h.ServeHTTP(w, r)
+		return
+	}
+
+	l.lost = true
+	l.h.ServeHTTP(httptest.NewRecorder(), r)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+func newServer(t *testing.T) (*leaser.Leaser, *Server) {
+	lsr, err := leaser.New("fe80::/48", "192.168.0.0/16", 64, 24)
+	require.NoError(t, err)
+
+	return lsr, NewServer(map[string]gipam.LeaserInterface{"local": lsr}, "secret")
+}
+
+func TestClient(t *testing.T) {
+	lsr, srv := newServer(t)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	spaces, err := Spaces(ts.URL, "secret")
+	require.NoError(t, err)
+	require.Equal(t, []string{"local"}, spaces)
+
+	c, err := NewClient(ts.URL, "secret", "local")
+	require.NoError(t, err)
+
+	id, pool, err := c.GetBlock(4, 0)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.0/24", pool)
+
+	gw, err := c.GetGateway(id, "")
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.1/24", gw)
+
+	addr, err := c.ReserveAddress(id, "192.168.0.10", "")
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.10/24", addr)
+
+	// leaser error is returned as is and isn't retried
+	_, err = c.ReserveAddress(id, "192.168.0.10", "")
+	require.Error(t, err)
+
+	require.NoError(t, c.ExcludeAddresses(id, []string{"192.168.0.2"}))
+	addr, err = c.GetAddress(id, "")
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.3/24", addr)
+
+	require.NoError(t, c.ReturnAddress(id, addr))
+	require.NoError(t, c.ReturnBlock(id))
+	require.Len(t, lsr.Allocated, 0)
+
+	// unknown space
+	c, err = NewClient(ts.URL, "secret", "global")
+	require.NoError(t, err)
+	_, _, err = c.GetBlock(4, 0)
+	require.Error(t, err)
+
+	// wrong token
+	c, err = NewClient(ts.URL, "bla", "local")
+	require.NoError(t, err)
+	_, _, err = c.GetBlock(4, 0)
+	require.Error(t, err)
+	require.Len(t, lsr.Allocated, 0)
+
+	_, err = NewClient("", "secret", "local")
+	require.Error(t, err)
+	_, err = NewClient(ts.URL, "secret", "a/b")
+	require.Error(t, err)
+
+	// too large request isn't read
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/v1/spaces/local/ExcludeAddresses", strings.NewReader(`{"exclude":["`+strings.Repeat("1", MaxRequestSize)+`"]}`))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+// TestClientRetry - retried GetBlock gets block which was allocated by lost request
+func TestClientRetry(t *testing.T) {
+	RetryDelay = time.Millisecond
+	lsr, srv := newServer(t)
+	ts := httptest.NewServer(&lossy{h: srv})
+	defer ts.Close()
+
+	c, err := NewClient(ts.URL, "secret", "local")
+	require.NoError(t, err)
+
+	_, pool, err := c.GetBlock(4, 0)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.0/24", pool)
+	require.Len(t, lsr.Allocated, 1)
+
+	// next call has new key
+	_, pool, err = c.GetBlock(4, 0)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.1.0/24", pool)
+	require.Len(t, lsr.Allocated, 2)
+}
+
+func TestClientUnavailable(t *testing.T) {
+	RetryDelay = time.Millisecond
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(ts.URL, "", "local")
+	require.NoError(t, err)
+
+	_, _, err = c.GetBlock(4, 0)
+	require.Error(t, err)
+}
+
+// TestServerRestart - result of request with idempotency key is kept in state of leaser, retry gets it after restart
+func TestServerRestart(t *testing.T) {
+	lsr, srv := newServer(t)
+	ts := httptest.NewServer(srv)
+
+	post := func(url string) (int, string) {
+		req, err := http.NewRequest(http.MethodPost, url+"/v1/spaces/local/GetBlock", strings.NewReader(`{"v": 4}`))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Idempotency-Key", "k1")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var res Response
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		return resp.StatusCode, res.Pool
+	}
+
+	status, pool := post(ts.URL)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "192.168.0.0/24", pool)
+	ts.Close()
+
+	data, err := lsr.MarshalJSON()
+	require.NoError(t, err)
+
+	var restored leaser.Leaser
+	require.NoError(t, restored.UnmarshalJSON(data))
+
+	ts = httptest.NewServer(NewServer(map[string]gipam.LeaserInterface{"local": &restored}, "secret"))
+	defer ts.Close()
+
+	status, pool = post(ts.URL)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "192.168.0.0/24", pool)
+	require.Len(t, restored.Allocated, 1)
+}
+
+// blocking - leaser which waits in GetBlock until it is released
+type blocking struct {
+	gipam.LeaserInterface
+	wait chan struct{}
+}
+
+func (b *blocking) GetBlock(v uint8, prefix uint) (string, string, error) {
+	<-b.wait
+	return b.LeaserInterface.GetBlock(v, prefix)
+}
+
+// TestServerConcurrency - slow request of one space doesn't block requests of other spaces
+func TestServerConcurrency(t *testing.T) {
+	RetryDelay = time.Millisecond
+	slow, err := leaser.New("", "10.0.0.0/16", 0, 24)
+	require.NoError(t, err)
+	lsr, err := leaser.New("", "192.168.0.0/16", 0, 24)
+	require.NoError(t, err)
+
+	b := &blocking{LeaserInterface: slow, wait: make(chan struct{})}
+	ts := httptest.NewServer(NewServer(map[string]gipam.LeaserInterface{"slow": b, "local": lsr}, "secret"))
+	defer ts.Close()
+
+	done := make(chan error)
+	go func() {
+		c, _ := NewClient(ts.URL, "secret", "slow")
+		_, _, err := c.GetBlock(4, 0)
+		done <- err
+	}()
+
+	c, err := NewClient(ts.URL, "secret", "local")
+	require.NoError(t, err)
+	_, pool, err := c.GetBlock(4, 0)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.0/24", pool)
+
+	close(b.wait)
+	require.NoError(t, <-done)
+}
+
+// TestClientServers - retry goes to next server of list or to leader which is resolved again
+func TestClientServers(t *testing.T) {
+	RetryDelay = time.Millisecond
+	_, srv := newServer(t)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	c, err := NewClient(dead.URL+","+ts.URL, "secret", "local")
+	require.NoError(t, err)
+	_, pool, err := c.GetBlock(4, 0)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.0/24", pool)
+
+	// leader is changed after first try
+	var tries int
+	c, err = NewClient(dead.URL, "secret", "local")
+	require.NoError(t, err)
+	c.Leader = func() string {
+		if tries++; tries == 1 {
+			return dead.URL
+		}
+
+		return ts.URL
+	}
+
+	_, pool, err = c.GetBlock(4, 0)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.1.0/24", pool)
+	require.Equal(t, 2, tries)
+}
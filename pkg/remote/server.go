@@ -0,0 +1,288 @@
+package remote
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/archekb/gipam/pkg/gipam"
+)
+
+// IdempotencyTTL - how long response of request with idempotency key is kept in memory for retries, it is used
+// for leasers which aren't Idempotent
+const IdempotencyTTL = 10 * time.Minute
+
+// MaxRequestSize - limit of request body, leaser arguments are small, only list of excluded addresses can be long
+const MaxRequestSize = 1 << 20
+
+// ErrUnavailable - leaser can't serve request now, but retry can succeed, for example leader of cluster is changing
+var ErrUnavailable = errors.New("Leaser is unavailable, try again later")
+
+// Redirector - leaser which is served by another server, requests to it are redirected to URL of that server
+type Redirector interface {
+	Redirect() (string, bool)
+}
+
+// Idempotent - leaser which keeps results of requests by idempotency key in its state (journal, lease file, raft log),
+// so retried request gets the same result after restart of server or change of cluster leader
+type Idempotent interface {
+	WithKey(key string) gipam.LeaserInterface
+}
+
+// Request - arguments of leaser method
+type Request struct {
+	V       uint8    `json:"v,omitempty"`
+	Prefix  uint     `json:"prefix,omitempty"`
+	ID      string   `json:"id,omitempty"`
+	Pool    string   `json:"pool,omitempty"`
+	SubPool string   `json:"subpool,omitempty"`
+	Address string   `json:"address,omitempty"`
+	MAC     string   `json:"mac,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// Response - result of leaser method, Error is not empty if leaser returns error
+type Response struct {
+	ID      string `json:"id,omitempty"`
+	Pool    string `json:"pool,omitempty"`
+	Address string `json:"address,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// SpacesResponse - names of address spaces of server
+type SpacesResponse struct {
+	Spaces []string `json:"spaces"`
+}
+
+// NewServer - create HTTP API of leasers, every request must have 'Authorization: Bearer <token>' header
+func NewServer(spaces map[string]gipam.LeaserInterface, token string) *Server {
+	return &Server{Spaces: spaces, Token: token, keys: map[string]*keyLock{}, responses: map[string]*cached{}}
+}
+
+// Server - HTTP API of leasers of address spaces.
+// API: GET /v1/spaces - names of spaces, POST /v1/spaces/<space>/<method> - call leaser method with Request in body.
+// Result of request with 'Idempotency-Key' header is kept, so retried request gets same response and nothing is allocated twice.
+// Idempotent leasers keep results in their state, so they survive restart and failover. Responses of other leasers are kept
+// in memory only, they are lost on restart of server. Requests with the same key are served one by one, other requests
+// are served at once, leasers lock themselves.
+type Server struct {
+	Spaces map[string]gipam.LeaserInterface
+	Token  string
+
+	mu        sync.Mutex
+	keys      map[string]*keyLock
+	responses map[string]*cached
+}
+
+// keyLock - lock of requests with the same idempotency key, it is removed when its last request is done
+type keyLock struct {
+	sync.Mutex
+	n int
+}
+
+// cached - response of request with idempotency key
+type cached struct {
+	status  int
+	res     *Response
+	expires time.Time
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		writeJSON(w, http.StatusUnauthorized, &Response{Error: "Unauthorized"})
+		return
+	}
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(path) < 2 || path[0] != "v1" || path[1] != "spaces" {
+		writeJSON(w, http.StatusNotFound, &Response{Error: "Not found"})
+		return
+	}
+
+	if len(path) == 2 && r.Method == http.MethodGet {
+		res := &SpacesResponse{Spaces: []string{}}
+		for name := range s.Spaces {
+			res.Spaces = append(res.Spaces, name)
+		}
+
+		sort.Strings(res.Spaces)
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+
+	if len(path) != 4 || r.Method != http.MethodPost {
+		writeJSON(w, http.StatusNotFound, &Response{Error: "Not found"})
+		return
+	}
+
+	lsr, ok := s.Spaces[path[2]]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, &Response{Error: "Unknown address space '" + path[2] + "'"})
+		return
+	}
+
+	if rd, ok := lsr.(Redirector); ok {
+		if url, ok := rd.Redirect(); ok {
+			http.Redirect(w, r, strings.TrimRight(url, "/")+r.URL.Path, http.StatusTemporaryRedirect)
+			return
+		}
+	}
+
+	var req Request
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRequestSize)).Decode(&req); err != nil {
+		status := http.StatusBadRequest
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			status = http.StatusRequestEntityTooLarge
+		}
+
+		writeJSON(w, status, &Response{Error: "Wrong request: " + err.Error()})
+		return
+	}
+
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		status, res := call(lsr, path[3], &req)
+		writeJSON(w, status, res)
+		return
+	}
+
+	// retry waits for first request with same key
+	local := path[2] + "/" + path[3] + "/" + key
+	unlock := s.lock(local)
+	defer unlock()
+
+	// caller key is kept, so request forwarded to another server or retried on new leader has the same key
+	if il, ok := lsr.(Idempotent); ok {
+		status, res := call(il.WithKey(key), path[3], &req)
+		writeJSON(w, status, res)
+		return
+	}
+
+	if c := s.cached(local); c != nil {
+		writeJSON(w, c.status, c.res)
+		return
+	}
+
+	status, res := call(lsr, path[3], &req)
+	if status != http.StatusNotFound && status != http.StatusServiceUnavailable {
+		s.mu.Lock()
+		s.responses[local] = &cached{status: status, res: res, expires: time.Now().Add(IdempotencyTTL)}
+		s.mu.Unlock()
+	}
+
+	writeJSON(w, status, res)
+}
+
+// lock - lock requests with idempotency key, returned function unlocks them
+func (s *Server) lock(key string) func() {
+	s.mu.Lock()
+	l, ok := s.keys[key]
+	if !ok {
+		l = &keyLock{}
+		s.keys[key] = l
+	}
+
+	l.n++
+	s.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		s.mu.Lock()
+		if l.n--; l.n == 0 {
+			delete(s.keys, key)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// cached - kept response of request with idempotency key, nil if there is no one
+func (s *Server) cached(key string) *cached {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	return s.responses[key]
+}
+
+// authorized - check bearer token, empty token disables authentication
+func (s *Server) authorized(r *http.Request) bool {
+	if s.Token == "" {
+		return true
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(s.Token)) == 1
+}
+
+// expire - remove kept responses after TTL
+func (s *Server) expire() {
+	now := time.Now()
+	for k, c := range s.responses {
+		if now.After(c.expires) {
+			delete(s.responses, k)
+		}
+	}
+}
+
+// call - call leaser method, leaser error is returned with 422 status, ErrUnavailable with 503
+func call(lsr gipam.LeaserInterface, method string, req *Request) (int, *Response) {
+	var res Response
+	var err error
+	switch method {
+	case "GetBlock":
+		res.ID, res.Pool, err = lsr.GetBlock(req.V, req.Prefix)
+
+	case "ReserveBlock":
+		res.ID, res.Pool, err = lsr.ReserveBlock(req.Pool, req.SubPool)
+
+	case "ReturnBlock":
+		err = lsr.ReturnBlock(req.ID)
+
+	case "GetAddress":
+		res.Address, err = lsr.GetAddress(req.ID, req.MAC)
+
+	case "ReserveAddress":
+		res.Address, err = lsr.ReserveAddress(req.ID, req.Address, req.MAC)
+
+	case "GetGateway":
+		res.Address, err = lsr.GetGateway(req.ID, req.Address)
+
+	case "ReturnAddress":
+		err = lsr.ReturnAddress(req.ID, req.Address)
+
+	case "ExcludeAddresses":
+		err = lsr.ExcludeAddresses(req.ID, req.Exclude)
+
+	default:
+		return http.StatusNotFound, &Response{Error: "Unknown method '" + method + "'"}
+	}
+
+	if err == ErrUnavailable {
+		return http.StatusServiceUnavailable, &Response{Error: err.Error()}
+	}
+
+	if err != nil {
+		return http.StatusUnprocessableEntity, &Response{Error: err.Error()}
+	}
+
+	return http.StatusOK, &res
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/archekb/gipam/pkg/config"
+	"github.com/archekb/gipam/pkg/leaser"
+)
+
+// reloader - applies configuration to leasers of running driver on SIGHUP and admin request
+type reloader struct {
+	sync.Mutex
+
+	cnf     *config.Config
+	leasers map[string]*leaser.Leaser
+}
+
+// reload - re-read configuration and apply changes of main pools, exclusions, gateway policies, MAC retention, hold-down and anycast
+// to leasers at once. Main pool can be added, widened or get other block len while it has no blocks. If some change of main pools
+// is unsafe for allocated blocks nothing is applied and error lists every planned change. Changes are applied all or nothing:
+// if one of them fails, applied ones are rolled back. Added and removed address spaces, store, listen addresses and cluster
+// are applied after restart.
+func (r *reloader) reload() ([]string, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	cnf, err := r.cnf.Reload()
+	if err != nil {
+		return nil, errors.New("Config Error: " + err.Error())
+	}
+
+	prev := map[string]config.Space{}
+	for _, s := range r.cnf.AddressSpaces() {
+		prev[s.Name] = s
+	}
+
+	type plan struct {
+		lsr   *leaser.Leaser
+		pc    *leaser.PoolChange
+		v     uint8
+		pools []leaser.MainPool
+		prev  []leaser.MainPool
+	}
+
+	var plans []plan
+	var changes []string
+	var unsafe bool
+	spaces := cnf.AddressSpaces()
+	for _, s := range spaces {
+		lsr, ok := r.leasers[s.Name]
+		if !ok {
+			changes = append(changes, "["+s.Name+"] address space is added, it is used after restart")
+			continue
+		}
+
+		// IP version without pools in config keeps pools of restored state
+		for _, v := range []uint8{6, 4} {
+			p := plan{lsr: lsr, v: v, pools: mainPools(s, v)}
+			if len(p.pools) == 0 {
+				continue
+			}
+
+			if p.pc = lsr.PlanPools(p.v, p.pools); p.pc != nil {
+				plans = append(plans, p)
+				changes = append(changes, "["+s.Name+"] "+p.pc.String())
+				unsafe = unsafe || p.pc.Error != ""
+			}
+		}
+
+		if old := prev[s.Name]; strings.Join(old.Excluded(), ",") != strings.Join(s.Excluded(), ",") {
+			changes = append(changes, "["+s.Name+"] excluded addresses "+dash(strings.Join(old.Excluded(), ","))+" -> "+dash(strings.Join(s.Excluded(), ",")))
+		}
+	}
+
+	if unsafe {
+		return nil, errors.New("Configuration is not applied, unsafe changes of main pools:\n" + strings.Join(changes, "\n"))
+	}
+
+	// rollback - return main pools of applied plans and parameters of configured spaces to previous config
+	rollback := func(applied []plan, configured []config.Space) {
+		for _, s := range configured {
+			if err := setupSpace(r.cnf, prev[s.Name], s, r.leasers[s.Name]); err != nil {
+				log.Println("Rollback of address space '"+s.Name+"' Error:", err)
+			}
+		}
+
+		for k := len(applied) - 1; k >= 0; k-- {
+			if err := applied[k].lsr.SetPools(applied[k].v, applied[k].prev); err != nil {
+				log.Println("Rollback of change "+applied[k].pc.String()+" Error:", err)
+			}
+		}
+	}
+
+	for k := range plans {
+		p := &plans[k]
+		p.prev = p.lsr.MainPools(p.v)
+		if err := p.lsr.SetPools(p.v, p.pools); err != nil {
+			rollback(plans[:k], nil)
+			return nil, errors.New("Configuration is not applied, change " + p.pc.String() + " Error: " + err.Error())
+		}
+	}
+
+	var configured []config.Space
+	for _, s := range spaces {
+		lsr, ok := r.leasers[s.Name]
+		if !ok {
+			continue
+		}
+
+		configured = append(configured, s)
+		if err := setupSpace(cnf, s, prev[s.Name], lsr); err != nil {
+			rollback(plans, configured)
+			return nil, errors.New("Configuration is not applied, address space '" + s.Name + "' " + err.Error())
+		}
+	}
+
+	for name := range r.leasers {
+		if !hasSpace(spaces, name) {
+			changes = append(changes, "["+name+"] address space is removed, it is used until restart")
+		}
+	}
+
+	r.cnf = cnf
+	return changes, nil
+}
+
+// setupSpace - apply parameters of config to leaser of address space, gateway policies of pools of previous config are dropped
+func setupSpace(cnf *config.Config, s, old config.Space, lsr *leaser.Leaser) error {
+	for _, p := range old.Pools {
+		lsr.SetPoolGateway(p.CIDR, "")
+	}
+
+	return setupLeaser(cnf, s, lsr)
+}
+
+// logReload - reload and write result to log
+func (r *reloader) logReload() {
+	changes, err := r.reload()
+	if err != nil {
+		log.Println("Reload Error:", err)
+		return
+	}
+
+	for _, c := range changes {
+		log.Println("Reload:", c)
+	}
+
+	log.Printf("Configuration is reloaded, %d changes", len(changes))
+}
+
+func hasSpace(spaces []config.Space, name string) bool {
+	for _, s := range spaces {
+		if s.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "none"
+	}
+
+	return s
+}